@@ -0,0 +1,215 @@
+// Package agentext is the Go side of agentext.proto. There is no protoc in
+// the build, so the code below is written by hand in the shape protoc-gen-go
+// would give it. Keep the field numbers in the struct tags in sync with the
+// proto file.
+package agentext
+
+import (
+	"github.com/golang/protobuf/proto"
+	agentproto "github.com/postverta/pv_agent/proto"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type ListContextsReq struct {
+}
+
+func (m *ListContextsReq) Reset()         { *m = ListContextsReq{} }
+func (m *ListContextsReq) String() string { return proto.CompactTextString(m) }
+func (*ListContextsReq) ProtoMessage()    {}
+
+type ContextInfo struct {
+	ContextId     string                     `protobuf:"bytes,1,opt,name=context_id,json=contextId" json:"context_id,omitempty"`
+	WorktreeId    string                     `protobuf:"bytes,2,opt,name=worktree_id,json=worktreeId" json:"worktree_id,omitempty"`
+	GrpcEndpoint  string                     `protobuf:"bytes,3,opt,name=grpc_endpoint,json=grpcEndpoint" json:"grpc_endpoint,omitempty"`
+	PortEndpoints []*agentproto.PortEndpoint `protobuf:"bytes,4,rep,name=port_endpoints,json=portEndpoints" json:"port_endpoints,omitempty"`
+}
+
+func (m *ContextInfo) Reset()         { *m = ContextInfo{} }
+func (m *ContextInfo) String() string { return proto.CompactTextString(m) }
+func (*ContextInfo) ProtoMessage()    {}
+
+type ListContextsResp struct {
+	Contexts []*ContextInfo `protobuf:"bytes,1,rep,name=contexts" json:"contexts,omitempty"`
+}
+
+func (m *ListContextsResp) Reset()         { *m = ListContextsResp{} }
+func (m *ListContextsResp) String() string { return proto.CompactTextString(m) }
+func (*ListContextsResp) ProtoMessage()    {}
+
+type BindContextReq struct {
+	ContextId        string   `protobuf:"bytes,1,opt,name=context_id,json=contextId" json:"context_id,omitempty"`
+	WorktreeId       string   `protobuf:"bytes,2,opt,name=worktree_id,json=worktreeId" json:"worktree_id,omitempty"`
+	SourceWorktreeId string   `protobuf:"bytes,3,opt,name=source_worktree_id,json=sourceWorktreeId" json:"source_worktree_id,omitempty"`
+	MountPoint       string   `protobuf:"bytes,4,opt,name=mount_point,json=mountPoint" json:"mount_point,omitempty"`
+	AutosaveInterval uint32   `protobuf:"varint,5,opt,name=autosave_interval,json=autosaveInterval" json:"autosave_interval,omitempty"`
+	Env              []string `protobuf:"bytes,6,rep,name=env" json:"env,omitempty"`
+}
+
+func (m *BindContextReq) Reset()         { *m = BindContextReq{} }
+func (m *BindContextReq) String() string { return proto.CompactTextString(m) }
+func (*BindContextReq) ProtoMessage()    {}
+
+type BindContextResp struct {
+}
+
+func (m *BindContextResp) Reset()         { *m = BindContextResp{} }
+func (m *BindContextResp) String() string { return proto.CompactTextString(m) }
+func (*BindContextResp) ProtoMessage()    {}
+
+type ResourceLimits struct {
+	CpuMillis    int64 `protobuf:"varint,1,opt,name=cpu_millis,json=cpuMillis" json:"cpu_millis,omitempty"`
+	MemoryMb     int64 `protobuf:"varint,2,opt,name=memory_mb,json=memoryMb" json:"memory_mb,omitempty"`
+	DiskMb       int64 `protobuf:"varint,3,opt,name=disk_mb,json=diskMb" json:"disk_mb,omitempty"`
+	MaxProcesses int64 `protobuf:"varint,4,opt,name=max_processes,json=maxProcesses" json:"max_processes,omitempty"`
+}
+
+func (m *ResourceLimits) Reset()         { *m = ResourceLimits{} }
+func (m *ResourceLimits) String() string { return proto.CompactTextString(m) }
+func (*ResourceLimits) ProtoMessage()    {}
+
+type SetContextLimitsReq struct {
+	ContextId string          `protobuf:"bytes,1,opt,name=context_id,json=contextId" json:"context_id,omitempty"`
+	Limits    *ResourceLimits `protobuf:"bytes,2,opt,name=limits" json:"limits,omitempty"`
+}
+
+func (m *SetContextLimitsReq) Reset()         { *m = SetContextLimitsReq{} }
+func (m *SetContextLimitsReq) String() string { return proto.CompactTextString(m) }
+func (*SetContextLimitsReq) ProtoMessage()    {}
+
+type SetContextLimitsResp struct {
+}
+
+func (m *SetContextLimitsResp) Reset()         { *m = SetContextLimitsResp{} }
+func (m *SetContextLimitsResp) String() string { return proto.CompactTextString(m) }
+func (*SetContextLimitsResp) ProtoMessage()    {}
+
+// Client API for AgentExtService service
+
+type AgentExtServiceClient interface {
+	ListContexts(ctx gcontext.Context, in *ListContextsReq, opts ...grpc.CallOption) (*ListContextsResp, error)
+	BindContext(ctx gcontext.Context, in *BindContextReq, opts ...grpc.CallOption) (*BindContextResp, error)
+	SetContextLimits(ctx gcontext.Context, in *SetContextLimitsReq, opts ...grpc.CallOption) (*SetContextLimitsResp, error)
+}
+
+type agentExtServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAgentExtServiceClient(cc *grpc.ClientConn) AgentExtServiceClient {
+	return &agentExtServiceClient{cc}
+}
+
+func (c *agentExtServiceClient) ListContexts(ctx gcontext.Context, in *ListContextsReq, opts ...grpc.CallOption) (*ListContextsResp, error) {
+	out := new(ListContextsResp)
+	err := grpc.Invoke(ctx, "/agentext.AgentExtService/ListContexts", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentExtServiceClient) BindContext(ctx gcontext.Context, in *BindContextReq, opts ...grpc.CallOption) (*BindContextResp, error) {
+	out := new(BindContextResp)
+	err := grpc.Invoke(ctx, "/agentext.AgentExtService/BindContext", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentExtServiceClient) SetContextLimits(ctx gcontext.Context, in *SetContextLimitsReq, opts ...grpc.CallOption) (*SetContextLimitsResp, error) {
+	out := new(SetContextLimitsResp)
+	err := grpc.Invoke(ctx, "/agentext.AgentExtService/SetContextLimits", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for AgentExtService service
+
+type AgentExtServiceServer interface {
+	ListContexts(gcontext.Context, *ListContextsReq) (*ListContextsResp, error)
+	BindContext(gcontext.Context, *BindContextReq) (*BindContextResp, error)
+	SetContextLimits(gcontext.Context, *SetContextLimitsReq) (*SetContextLimitsResp, error)
+}
+
+func RegisterAgentExtServiceServer(s *grpc.Server, srv AgentExtServiceServer) {
+	s.RegisterService(&_AgentExtService_serviceDesc, srv)
+}
+
+func _AgentExtService_ListContexts_Handler(srv interface{}, ctx gcontext.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListContextsReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentExtServiceServer).ListContexts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agentext.AgentExtService/ListContexts",
+	}
+	handler := func(ctx gcontext.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentExtServiceServer).ListContexts(ctx, req.(*ListContextsReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentExtService_BindContext_Handler(srv interface{}, ctx gcontext.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BindContextReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentExtServiceServer).BindContext(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agentext.AgentExtService/BindContext",
+	}
+	handler := func(ctx gcontext.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentExtServiceServer).BindContext(ctx, req.(*BindContextReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentExtService_SetContextLimits_Handler(srv interface{}, ctx gcontext.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetContextLimitsReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentExtServiceServer).SetContextLimits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agentext.AgentExtService/SetContextLimits",
+	}
+	handler := func(ctx gcontext.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentExtServiceServer).SetContextLimits(ctx, req.(*SetContextLimitsReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AgentExtService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "agentext.AgentExtService",
+	HandlerType: (*AgentExtServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListContexts",
+			Handler:    _AgentExtService_ListContexts_Handler,
+		},
+		{
+			MethodName: "BindContext",
+			Handler:    _AgentExtService_BindContext_Handler,
+		},
+		{
+			MethodName: "SetContextLimits",
+			Handler:    _AgentExtService_SetContextLimits_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "agentext.proto",
+}
@@ -0,0 +1,432 @@
+package cluster
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"log"
+	"sync"
+	"time"
+)
+
+type ErrorUnknownAgent string
+
+func (eua ErrorUnknownAgent) Error() string {
+	return fmt.Sprintf("Agent %s is not in the cluster", string(eua))
+}
+
+func IsUnknownAgentError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorUnknownAgent)
+	return ok
+}
+
+type ErrorDuplicateAgent string
+
+func (eda ErrorDuplicateAgent) Error() string {
+	return fmt.Sprintf("Agent %s is already in the cluster", string(eda))
+}
+
+func IsDuplicateAgentError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorDuplicateAgent)
+	return ok
+}
+
+type ErrorAgentInUse string
+
+func (eaiu ErrorAgentInUse) Error() string {
+	return fmt.Sprintf("Agent %s still has contexts, drain it first", string(eaiu))
+}
+
+func IsAgentInUseError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorAgentInUse)
+	return ok
+}
+
+func dialAgent(agentConfig config.AgentConfig) (*Agent, error) {
+	conn, err := grpc.Dial(agentConfig.Endpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Agent{
+		Endpoint:  agentConfig.Endpoint,
+		Weight:    agentConfig.Weight,
+		Capacity:  agentConfig.Capacity,
+		Client:    agentproto.NewAgentServiceClient(conn),
+		ExtClient: agentext.NewAgentExtServiceClient(conn),
+		Healthy:   true,
+		conn:      conn,
+		stopChan:  make(chan bool, 1),
+	}, nil
+}
+
+// Whether an agent lacks an RPC of the extension service, i.e., it runs a
+// pv_agent that predates it.
+func isUnimplemented(err error) bool {
+	return grpc.Code(err) == codes.Unimplemented
+}
+
+func listAgentContexts(agent *Agent) (*agentext.ListContextsResp, error) {
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterAgentCallTimeout())
+	defer cancel()
+	return agent.ExtClient.ListContexts(ctx, &agentext.ListContextsReq{})
+}
+
+// Close a container of an agent that the cluster doesn't track.
+func closeAgentContext(agent *Agent, contextId string) error {
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterAgentCallTimeout())
+	defer cancel()
+	closeReq := &agentproto.CloseContextReq{
+		ContextId: contextId,
+	}
+	_, err := agent.Client.CloseContext(ctx, closeReq)
+	if err != nil && grpc.Code(err) != codes.InvalidArgument {
+		return err
+	}
+	return nil
+}
+
+// Rebuild the contexts that are still open on an agent, e.g., across a
+// restart of the backend, so that running apps and editor sessions survive.
+// Contexts whose app no longer exists, or whose app already has a context in
+// the cluster, are closed. Unbound containers go back into the pool. The agent
+// must not take part in placement yet.
+//
+// Agents that cannot list their contexts have all of them closed instead, as
+// nothing can be reattached and the worktrees would otherwise be opened twice.
+func (c *Cluster) reattachContexts(agent *Agent) error {
+	resp, err := listAgentContexts(agent)
+	if isUnimplemented(err) {
+		log.Println("[WARNING] Agent", agent.Endpoint, "cannot list its contexts, closing all of them")
+		ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterAgentCallTimeout())
+		defer cancel()
+		_, err = agent.Client.CloseAll(ctx, &agentproto.CloseAllReq{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range resp.Contexts {
+		if info.WorktreeId == "" {
+			// A pooled container
+			c.mutex.Lock()
+			adopted := c.adoptPooledContext(agent, info)
+			c.mutex.Unlock()
+			if !adopted {
+				log.Println("[INFO] Closing extra pooled context", info.ContextId, "on agent", agent.Endpoint)
+				closePooledContext(agent, info.ContextId)
+			}
+			continue
+		}
+
+		app, err := model.C().GetAppByWorktreeId(info.WorktreeId)
+		if err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		if app == nil || c.AppContext[app.Id] != nil || c.closing[app.Id] != nil {
+			c.mutex.Unlock()
+			log.Println("[INFO] Closing orphan context", info.ContextId, "on agent", agent.Endpoint)
+			err = closeAgentContext(agent, info.ContextId)
+			if err != nil {
+				// Not much we can do, the container lingers on
+				log.Println("[ERROR] Cannot close orphan context", info.ContextId, "err:", err)
+			}
+			continue
+		}
+
+		agent.NumContexts++
+		_, err = c.newContext(agent, app.Id, info.WorktreeId, info.ContextId,
+			info.GrpcEndpoint, info.PortEndpoints, AppIdleTimeout(app))
+		if err != nil {
+			agent.NumContexts--
+			c.mutex.Unlock()
+			return err
+		}
+		c.Placement.ContextOpened(app.Id, agent)
+		c.mutex.Unlock()
+		log.Println("[INFO] Reattached context of app", app.Id, "on agent", agent.Endpoint)
+	}
+
+	return nil
+}
+
+// Close the containers of a worktree that the agent opened after the cluster
+// gave up waiting for them. Give the agent time to finish opening first.
+func (c *Cluster) closeOrphanContexts(agent *Agent, worktreeId string) {
+	time.Sleep(config.ClusterOpenContextTimeout())
+
+	resp, err := listAgentContexts(agent)
+	if isUnimplemented(err) {
+		log.Println("[WARNING] Agent", agent.Endpoint, "cannot list its contexts, a container of worktree",
+			worktreeId, "may linger until the agent restarts")
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot list contexts on agent", agent.Endpoint, "err:", err)
+		return
+	}
+
+	// Pick the orphans under the lock, but close them without it
+	orphans := make([]string, 0)
+	c.mutex.Lock()
+	for _, info := range resp.Contexts {
+		if info.WorktreeId == worktreeId && !c.isKnownContext(info.ContextId) {
+			orphans = append(orphans, info.ContextId)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, contextId := range orphans {
+		log.Println("[INFO] Closing orphan context", contextId, "on agent", agent.Endpoint)
+		err = closeAgentContext(agent, contextId)
+		if err != nil {
+			log.Println("[ERROR] Cannot close orphan context", contextId, "err:", err)
+		}
+	}
+}
+
+// Whether a container is open in the cluster, pooled, or quarantined. Must be
+// called with the cluster lock held.
+func (c *Cluster) isKnownContext(contextId string) bool {
+	for _, agent := range c.Agents {
+		for _, pooled := range agent.pool {
+			if pooled.ContextId == contextId {
+				return true
+			}
+		}
+	}
+	for _, context := range c.AppContext {
+		if context.Id == contextId {
+			return true
+		}
+	}
+	for _, qc := range c.Quarantine {
+		if qc.context.Id == contextId {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with the cluster lock held.
+func (c *Cluster) findAgent(endpoint string) (int, *Agent) {
+	for i, agent := range c.Agents {
+		if agent.Endpoint == endpoint {
+			return i, agent
+		}
+	}
+	return -1, nil
+}
+
+// Register a new agent with the cluster. It takes new contexts right away.
+func (c *Cluster) AddAgent(agentConfig config.AgentConfig) error {
+	c.agentsMutex.Lock()
+	defer c.agentsMutex.Unlock()
+
+	c.mutex.Lock()
+	_, existing := c.findAgent(agentConfig.Endpoint)
+	c.mutex.Unlock()
+	if existing != nil {
+		return ErrorDuplicateAgent(agentConfig.Endpoint)
+	}
+
+	// Don't hold the cluster lock while talking to the agent
+	agent, err := dialAgent(agentConfig)
+	if err != nil {
+		return err
+	}
+
+	err = c.reattachContexts(agent)
+	if err != nil {
+		agent.conn.Close()
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Agents = append(c.Agents, agent)
+	go c.checkAgentHealth(agent)
+	log.Println("[INFO] Added agent", agent.Endpoint)
+	return nil
+}
+
+// Remove an agent from the cluster. The agent must not have any context left,
+// so busy agents must be drained first. Unhealthy agents are taken to be gone
+// for good: the contexts quarantined when they went down are dropped, and
+// their apps can be reopened elsewhere.
+func (c *Cluster) RemoveAgent(endpoint string) error {
+	c.agentsMutex.Lock()
+	defer c.agentsMutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	i, agent := c.findAgent(endpoint)
+	if agent == nil {
+		return ErrorUnknownAgent(endpoint)
+	}
+
+	if !agent.Healthy {
+		for appId, qc := range c.Quarantine {
+			if qc.context.Agent == agent {
+				log.Println("[WARNING] Dropping quarantined context of app", appId, "with agent", endpoint)
+				c.unquarantineContext(qc)
+			}
+		}
+	}
+
+	if agent.NumContexts > 0 {
+		return ErrorAgentInUse(endpoint)
+	}
+
+	c.Agents = append(c.Agents[:i], c.Agents[i+1:]...)
+	closePool(agent, c.takePool(agent))
+	agent.stopChan <- true
+	agent.conn.Close()
+	log.Println("[INFO] Removed agent", agent.Endpoint)
+	return nil
+}
+
+// Stop placing new contexts on an agent, and move its existing contexts away.
+// Each context has its worktree saved and is then closed, so that the next
+// access reopens it on another agent. Return the IDs of the apps whose
+// context couldn't be moved. They stay on the agent, which keeps draining.
+func (c *Cluster) DrainAgent(endpoint string) (failedAppIds []string, err error) {
+	c.mutex.Lock()
+	_, agent := c.findAgent(endpoint)
+	if agent == nil {
+		c.mutex.Unlock()
+		return nil, ErrorUnknownAgent(endpoint)
+	}
+
+	agent.Draining = true
+	pool := c.takePool(agent)
+	contexts := make([]*Context, 0)
+	for _, context := range c.AppContext {
+		if context.Agent == agent {
+			contexts = append(contexts, context)
+		}
+	}
+	c.mutex.Unlock()
+
+	log.Printf("[INFO] Draining %d contexts from agent %s", len(contexts), endpoint)
+	closePool(agent, pool)
+
+	failedAppIds = make([]string, 0)
+	var failedMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, context := range contexts {
+		wg.Add(1)
+		go func(context *Context) {
+			defer wg.Done()
+			err := c.saveAndCloseContext(gcontext.Background(), context)
+			if err != nil {
+				log.Println("[ERROR] Cannot move context of app", context.AppId, "err:", err)
+				failedMutex.Lock()
+				failedAppIds = append(failedAppIds, context.AppId)
+				failedMutex.Unlock()
+			}
+		}(context)
+	}
+	wg.Wait()
+
+	return failedAppIds, nil
+}
+
+// Save the worktree of a context, then close it even if it is in use. Users
+// still holding the context will see their calls fail, and websockets are
+// told to let go through the Done channel.
+func (c *Cluster) saveAndCloseContext(ctx gcontext.Context, context *Context) error {
+	err := saveContext(ctx, context)
+	if err != nil {
+		// Don't risk losing data, keep the context running
+		return err
+	}
+
+	return c.closeContext(ctx, context)
+}
+
+// Save the worktree of a context.
+func saveContext(ctx gcontext.Context, context *Context) error {
+	// Use the raw API to get the worktree service client, as this is not
+	// a use of the context and must not refresh its timer.
+	wtClient := worktreeproto.NewWorktreeServiceClient(context.GrpcConn)
+	saveCtx, cancel := gcontext.WithTimeout(ctx, config.ContextSaveCallTimeout())
+	defer cancel()
+	_, err := wtClient.Save(saveCtx, &worktreeproto.SaveReq{})
+	return err
+}
+
+// Close a context even if it is in use, and remove it from the cluster. The
+// app cannot be reopened while the agent closes the container. If that fails,
+// the container may still be running, and the context is quarantined.
+func (c *Cluster) closeContext(ctx gcontext.Context, context *Context) error {
+	c.mutex.Lock()
+	if c.AppContext[context.AppId] != context {
+		// Expired or evicted in the meantime
+		c.mutex.Unlock()
+		return nil
+	}
+
+	closed := c.startClosingContext(context)
+	c.mutex.Unlock()
+
+	return c.finishClosingContext(ctx, context, closed)
+}
+
+// Remove the context from the cluster, and mark its app as closing until
+// finishClosingContext is done. Must be called with the cluster lock held.
+func (c *Cluster) startClosingContext(context *Context) chan struct{} {
+	delete(c.AppContext, context.AppId)
+	closed := make(chan struct{})
+	c.closing[context.AppId] = closed
+	return closed
+}
+
+// Close the container of a context removed by startClosingContext. Must be
+// called without the cluster lock, which isn't held while talking to the
+// agent.
+func (c *Cluster) finishClosingContext(ctx gcontext.Context, context *Context, closed chan struct{}) error {
+	closeCtx, cancel := gcontext.WithTimeout(ctx, config.ClusterAgentCallTimeout())
+	closeReq := &agentproto.CloseContextReq{
+		ContextId: context.Id,
+	}
+	_, err := context.Agent.Client.CloseContext(closeCtx, closeReq)
+	cancel()
+	if grpc.Code(err) == codes.InvalidArgument {
+		// Some leftover state, which is ok
+		err = nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.closing, context.AppId)
+	close(closed)
+
+	context.release()
+	if err != nil {
+		c.quarantineContext(context, err)
+		return err
+	}
+	context.Agent.NumContexts--
+	return nil
+}
@@ -1,13 +1,14 @@
 package cluster
 
 import (
+	"github.com/postverta/pv_backend/config"
 	"time"
 )
 
 var globalCluster *Cluster
 
-func InitGlobalCluster(agents []string, contextExpirationTime time.Duration) error {
-	c, err := NewCluster(agents, contextExpirationTime)
+func InitGlobalCluster(agents []config.AgentConfig, placement PlacementStrategy, contextExpirationTime time.Duration) error {
+	c, err := NewCluster(agents, placement, contextExpirationTime)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"github.com/postverta/pv_backend/config"
+	processproto "github.com/postverta/pv_exec/proto/process"
+	gcontext "golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+// A transition of the app process state, with the time it was observed.
+type AppStateEvent struct {
+	State processproto.ProcessState
+	Time  time.Time
+}
+
+// Polls the app process state of all contexts in the cluster with a shared
+// pool of workers. The process service has no way to push state changes, so
+// contexts with subscribers are polled at the minimum interval, as the old
+// per-context pollers did. The others are polled at their own interval, which
+// starts small and doubles every time the state is found unchanged, up to a
+// maximum. A transition or a poke resets the interval.
+type appStateScheduler struct {
+	workChan chan *Context
+
+	minInterval time.Duration
+	maxInterval time.Duration
+}
+
+func newAppStateScheduler() *appStateScheduler {
+	s := &appStateScheduler{
+		workChan:    make(chan *Context, 1024),
+		minInterval: config.ClusterAppStateMinPollInterval(),
+		maxInterval: config.ClusterAppStateMaxPollInterval(),
+	}
+
+	for i := 0; i < config.ClusterAppStatePollWorkers(); i++ {
+		go s.work()
+	}
+
+	return s
+}
+
+// Start tracking the state of a context.
+func (s *appStateScheduler) add(ctx *Context) {
+	ctx.AppStateMutex.Lock()
+	defer ctx.AppStateMutex.Unlock()
+
+	ctx.appStatePollInterval = s.minInterval
+	ctx.appStatePollTimer = time.AfterFunc(0, func() {
+		s.workChan <- ctx
+	})
+}
+
+// Stop tracking the state of a context. A poll in flight is discarded.
+func (s *appStateScheduler) remove(ctx *Context) {
+	ctx.AppStateMutex.Lock()
+	defer ctx.AppStateMutex.Unlock()
+
+	ctx.appStateTrackerStopped = true
+	ctx.appStatePollTimer.Stop()
+}
+
+// Poll the context as soon as possible, and at the minimum interval after
+// that. Must be called with AppStateMutex held.
+func (s *appStateScheduler) poke(ctx *Context) {
+	if ctx.appStateTrackerStopped {
+		return
+	}
+
+	ctx.appStatePollInterval = s.minInterval
+	if ctx.appStatePolling {
+		// Too late to change the ongoing poll, do another one right
+		// after it.
+		ctx.appStatePokePending = true
+	} else if ctx.appStatePollTimer.Stop() {
+		ctx.appStatePollTimer.Reset(0)
+	}
+	// Otherwise the timer has just fired and a poll is on its way.
+}
+
+func (s *appStateScheduler) work() {
+	for ctx := range s.workChan {
+		ctx.AppStateMutex.Lock()
+		if ctx.appStateTrackerStopped {
+			ctx.AppStateMutex.Unlock()
+			continue
+		}
+		ctx.appStatePolling = true
+		ctx.AppStateMutex.Unlock()
+
+		processServiceClient := processproto.NewProcessServiceClient(ctx.GrpcConn)
+		req := &processproto.GetProcessStateReq{
+			ProcessName: "app",
+		}
+		callCtx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ContextProcessCallTimeout())
+		resp, err := processServiceClient.GetProcessState(callCtx, req)
+		cancel()
+		observedTime := time.Now()
+
+		ctx.AppStateMutex.Lock()
+		ctx.appStatePolling = false
+		if ctx.appStateTrackerStopped {
+			ctx.AppStateMutex.Unlock()
+			continue
+		}
+
+		if err != nil {
+			// ignore the error, and try again later
+		} else if ctx.AppState != resp.ProcessState {
+			ctx.AppState = resp.ProcessState
+			ctx.AppStateTime = observedTime
+			ctx.publishAppState()
+			ctx.appStatePollInterval = s.minInterval
+		} else if len(ctx.AppStateChan) > 0 {
+			// Someone is watching, don't back off
+			ctx.appStatePollInterval = s.minInterval
+		} else {
+			ctx.appStatePollInterval *= 2
+		}
+
+		if ctx.appStatePollInterval > s.maxInterval {
+			ctx.appStatePollInterval = s.maxInterval
+		}
+
+		nextPoll := ctx.appStatePollInterval
+		if ctx.appStatePokePending {
+			ctx.appStatePokePending = false
+			nextPoll = 0
+		}
+		ctx.appStatePollTimer.Reset(nextPoll)
+		ctx.AppStateMutex.Unlock()
+	}
+}
+
+// Send the current state to all subscribers. Must be called with
+// AppStateMutex held.
+func (ctx *Context) publishAppState() {
+	event := AppStateEvent{
+		State: ctx.AppState,
+		Time:  ctx.AppStateTime,
+	}
+	for _, stateChan := range ctx.AppStateChan {
+		// Always detect whether stateChan is full and
+		// the write would be blocking. Otherwise we
+		// can deadlock the entire system!
+		select {
+		case stateChan <- event:
+		default:
+			log.Println("AppState channel is full")
+		}
+	}
+}
+
+// Tell the tracker that the app state is likely to change soon, e.g., after
+// the process is (re)configured, so that the change is picked up quickly.
+func (ctx *Context) PokeAppState() {
+	ctx.AppStateMutex.Lock()
+	defer ctx.AppStateMutex.Unlock()
+	ctx.Cluster.appStateScheduler.poke(ctx)
+}
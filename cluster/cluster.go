@@ -3,7 +3,10 @@ package cluster
 import (
 	"fmt"
 	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
 	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	"github.com/postverta/pv_backend/runtimes"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	processproto "github.com/postverta/pv_exec/proto/process"
 	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
@@ -15,8 +18,11 @@ import (
 )
 
 func (ctx *Context) Refresh() {
+	ctx.timerMutex.Lock()
+	defer ctx.timerMutex.Unlock()
+	ctx.lastUsedTime = time.Now()
 	if ctx.Timer.Stop() {
-		ctx.Timer.Reset(ctx.Cluster.ContextExpirationTime)
+		ctx.Timer.Reset(ctx.idleTimeout)
 	}
 }
 
@@ -35,26 +41,29 @@ func (ctx *Context) GetWorktreeServiceClient() worktreeproto.WorktreeServiceClie
 	return worktreeproto.NewWorktreeServiceClient(ctx.GrpcConn)
 }
 
-func (ctx *Context) GetAppEndpoint() string {
-	ctx.Refresh()
-	return ctx.AppEndpoint
-}
-
 func (ctx *Context) GetAppState() processproto.ProcessState {
 	ctx.Refresh()
 	return ctx.AppState
 }
 
-func (ctx *Context) GetAppStateChan() (stateChan chan processproto.ProcessState, chanId uint64) {
+// Subscribe to the transitions of the app state. The current state is sent
+// right away.
+func (ctx *Context) GetAppStateChan() (stateChan chan AppStateEvent, chanId uint64) {
 	ctx.Refresh()
-	stateChan = make(chan processproto.ProcessState, 256)
+	stateChan = make(chan AppStateEvent, 256)
 	ctx.AppStateMutex.Lock()
 	defer ctx.AppStateMutex.Unlock()
 
 	chanId = ctx.NextChanId
 	ctx.AppStateChan[chanId] = stateChan
 	ctx.NextChanId++
-	stateChan <- ctx.AppState
+	stateChan <- AppStateEvent{
+		State: ctx.AppState,
+		Time:  ctx.AppStateTime,
+	}
+
+	// Someone is watching now, make sure the state is fresh
+	ctx.Cluster.appStateScheduler.poke(ctx)
 	return stateChan, chanId
 }
 
@@ -64,53 +73,63 @@ func (ctx *Context) RemoveAppStateChan(chanId uint64) {
 	delete(ctx.AppStateChan, chanId)
 }
 
-func NewCluster(agents []string, contextExpirationTime time.Duration) (*Cluster, error) {
+func NewCluster(agents []config.AgentConfig, placement PlacementStrategy, contextExpirationTime time.Duration) (*Cluster, error) {
 	c := &Cluster{
-		Agents:                agents,
+		Agents:                make([]*Agent, 0),
+		Placement:             placement,
 		ContextExpirationTime: contextExpirationTime,
 
-		AgentServiceClient: make(map[string]agentproto.AgentServiceClient),
-		AgentNumContexts:   make(map[string]uint),
 		AppContext:         make(map[string]*Context),
 		AppContextRefCount: make(map[string]uint),
+		Quarantine:         make(map[string]*quarantinedContext),
+		closing:            make(map[string]chan struct{}),
+
+		appStateScheduler: newAppStateScheduler(),
+
+		PoolSize:       config.ClusterContextPoolSize(),
+		poolRefillChan: make(chan bool, 1),
 	}
 
-	for _, agent := range agents {
-		conn, err := grpc.Dial(agent, grpc.WithInsecure())
+	for _, agentConfig := range agents {
+		agent, err := dialAgent(agentConfig)
 		if err != nil {
 			return nil, err
 		}
 
-		client := agentproto.NewAgentServiceClient(conn)
-
-		// For now, always clean up the containers when we start
-		_, err = client.CloseAll(gcontext.Background(), &agentproto.CloseAllReq{})
+		err = c.reattachContexts(agent)
 		if err != nil {
 			return nil, err
 		}
 
-		c.AgentServiceClient[agent] = client
+		c.Agents = append(c.Agents, agent)
+	}
+
+	for _, agent := range c.Agents {
+		go c.checkAgentHealth(agent)
 	}
 
+	go c.fillPools()
+	go c.reconcileQuarantine()
+
 	return c, nil
 }
 
-func (c *Cluster) bestAgent() string {
-	// Find the agent with the minimum number of contexts
-	minContexts := -1
-	bestAgent := ""
+// Select an agent for a new context of the app. Must be called with the
+// cluster lock held.
+func (c *Cluster) selectAgent(appId string) (*Agent, error) {
+	candidates := make([]*Agent, 0, len(c.Agents))
 	for _, agent := range c.Agents {
-		if minContexts == -1 || int(c.AgentNumContexts[agent]) < minContexts {
-			minContexts = int(c.AgentNumContexts[agent])
-			bestAgent = agent
+		if agent.Healthy && !agent.Draining && agentHasRoom(agent) {
+			candidates = append(candidates, agent)
 		}
 	}
 
-	if minContexts > 10 {
-		log.Println("[WARNING] Crowded server with %d containers", minContexts)
+	if len(candidates) == 0 {
+		log.Println("[WARNING] All agents are at capacity, cannot open context for app", appId)
+		return nil, ErrorClusterFull(len(c.Agents))
 	}
 
-	return bestAgent
+	return c.Placement.SelectAgent(appId, candidates), nil
 }
 
 // Get an existing context. Return null if none exists.
@@ -135,9 +154,32 @@ func (c *Cluster) GetExistingContext(appId string) (*Context, func()) {
 }
 
 // Get the existing context of an app. If none exists, start a new one with the
-// given worktree Ids
-func (c *Cluster) GetContext(appId string, sourceWorktreeId string, worktreeId string) (*Context, func(), error) {
+// given worktree Ids and options. The options of an existing context are left
+// alone. Opening gives up when ctx is done, or after the open timeout.
+func (c *Cluster) GetContext(ctx gcontext.Context, appId string, sourceWorktreeId string, worktreeId string,
+	options ContextOptions) (*Context, func(), error) {
 	c.mutex.Lock()
+	for {
+		closed, found := c.closing[appId]
+		if !found {
+			break
+		}
+
+		// Wait for the old container to be gone
+		c.mutex.Unlock()
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			// Same codes as a gRPC call that runs out of time
+			code := codes.DeadlineExceeded
+			if ctx.Err() == gcontext.Canceled {
+				code = codes.Canceled
+			}
+			return nil, nil, grpc.Errorf(code, "cannot wait for the old context to close: %v", ctx.Err())
+		}
+		c.mutex.Lock()
+	}
+
 	if context, found := c.AppContext[appId]; found {
 		if context.WorktreeId != worktreeId {
 			// This should never happen
@@ -158,181 +200,221 @@ func (c *Cluster) GetContext(appId string, sourceWorktreeId string, worktreeId s
 		}, nil
 	}
 
-	// Select an agent to open the context
-	agent := c.bestAgent()
-	client := c.AgentServiceClient[agent]
-	c.AgentNumContexts[agent]++
-
-	openReq := &agentproto.OpenContextReq{
-		Image: config.ClusterBaseImage(),
-		StorageConfig: &agentproto.StorageConfig{
-			AccountName: config.AzureAccountName(),
-			AccountKey:  config.AzureAccountKey(),
-			Container:   "worktree",
-		},
-		WorktreeId:       worktreeId,
-		SourceWorktreeId: sourceWorktreeId,
-		MountPoint:       "/app",
-		AutosaveInterval: config.WorktreeAutosaveInterval(),
-		// TODO: in the future, have a number of "port slots", and allocate a port from the collection when a new process is started.
-		Ports: []uint32{8080, 2089},
-		Env: []string{
-			"PV_APP_ROOT=/app",
-			fmt.Sprintf("PV_APP_ID=%s", appId),
-			fmt.Sprintf("PV_INTERNAL_API_ENDPOINT=%s", config.InternalApiEndPoint()),
-		},
-		ExecConfigRoots: []string{
-			"/etc/task/common",
-			"/etc/task/javascript",
-		},
+	if c.shuttingDown {
+		c.mutex.Unlock()
+		return nil, nil, ErrorClusterShuttingDown(appId)
 	}
 
-	startTime := time.Now()
-	openResp, err := client.OpenContext(gcontext.Background(), openReq)
-	log.Printf("[INFO] OpenContext takes %fs\n", time.Since(startTime).Seconds())
-	if err != nil {
+	if _, found := c.Quarantine[appId]; found {
 		c.mutex.Unlock()
-		return nil, nil, err
+		return nil, nil, ErrorAppQuarantined(appId)
 	}
 
-	// This call is non-blocking. Connecting happens in background.
-	grpcConn, err := grpc.Dial(openResp.GrpcEndpoint,
-		grpc.WithBackoffMaxDelay(time.Millisecond*10),
-		grpc.WithInsecure())
+	// Select an agent to open the context
+	agent, err := c.selectAgent(appId)
 	if err != nil {
 		c.mutex.Unlock()
 		return nil, nil, err
 	}
+	agent.NumContexts++
 
-	var appEndpoint string
-	var lspEndpoint string
-	for _, portEndpoint := range openResp.PortEndpoints {
-		if portEndpoint.Port == 8080 {
-			appEndpoint = portEndpoint.Endpoint
-		} else if portEndpoint.Port == 2089 {
-			lspEndpoint = portEndpoint.Endpoint
-		} else {
-			log.Println("[ERROR] Unknown port mapping")
-		}
+	rt := options.Runtime
+	if rt == nil {
+		rt = runtimes.Default()
 	}
-	context := &Context{
-		Id:                      openResp.ContextId,
-		Cluster:                 c,
-		AppId:                   appId,
-		WorktreeId:              worktreeId,
-		GrpcEndpoint:            openResp.GrpcEndpoint,
-		AppEndpoint:             appEndpoint,
-		LspEndpoint:             lspEndpoint,
-		GrpcConn:                grpcConn,
-		Timer:                   time.NewTimer(c.ContextExpirationTime),
-		AppState:                processproto.ProcessState_NOT_RUNNING,
-		AppStateChan:            make(map[uint64]chan processproto.ProcessState),
-		AppStateTrackerStopChan: make(chan bool, 1),
+
+	// Take a container from the pool if possible, otherwise open one.
+	// The pool only has containers of the default runtime.
+	var openResp *agentproto.OpenContextResp
+	if rt == runtimes.Default() {
+		openResp = c.takePooledContext(ctx, agent, appId, sourceWorktreeId, worktreeId)
 	}
+	if openResp == nil {
+		c.makeRoom(agent)
+		openReq := &agentproto.OpenContextReq{
+			Image: rt.Image,
+			StorageConfig: &agentproto.StorageConfig{
+				AccountName: config.AzureAccountName(),
+				AccountKey:  config.AzureAccountKey(),
+				Container:   "worktree",
+			},
+			WorktreeId:       worktreeId,
+			SourceWorktreeId: sourceWorktreeId,
+			MountPoint:       "/app",
+			AutosaveInterval: config.WorktreeAutosaveInterval(),
+			Ports:            config.ClusterPortSlots(),
+			Env: []string{
+				"PV_APP_ROOT=/app",
+				fmt.Sprintf("PV_APP_ID=%s", appId),
+				fmt.Sprintf("PV_INTERNAL_API_ENDPOINT=%s", config.InternalApiEndPoint()),
+			},
+			ExecConfigRoots: rt.ExecConfigRoots,
+		}
 
-	// kick off the app state tracker routine
-	go func() {
-		for {
-			select {
-			case <-time.After(100 * time.Millisecond):
-				break
-			case <-context.AppStateTrackerStopChan:
-				return
-			}
-			processServiceClient := processproto.NewProcessServiceClient(context.GrpcConn)
-			req := &processproto.GetProcessStateReq{
-				ProcessName: "app",
+		startTime := time.Now()
+		openCtx, cancel := gcontext.WithTimeout(ctx, config.ClusterOpenContextTimeout())
+		openResp, err = agent.Client.OpenContext(openCtx, openReq)
+		cancel()
+		log.Printf("[INFO] OpenContext takes %fs\n", time.Since(startTime).Seconds())
+		if err != nil {
+			agent.NumContexts--
+			c.mutex.Unlock()
+			if code := grpc.Code(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+				// The agent may still open the container after we gave up
+				go c.closeOrphanContexts(agent, worktreeId)
 			}
-			resp, err := processServiceClient.GetProcessState(gcontext.Background(), req)
+			return nil, nil, err
+		}
+	}
+
+	err = setContextLimits(ctx, agent, openResp.ContextId, options.Limits)
+	if err != nil {
+		agent.NumContexts--
+		c.mutex.Unlock()
+		log.Println("[ERROR] Cannot set limits of context", openResp.ContextId, "err:", err)
+		go func(contextId string) {
+			err := closeAgentContext(agent, contextId)
 			if err != nil {
-				// ignore the error
-			} else {
-				context.AppStateMutex.Lock()
-				if context.AppState != resp.ProcessState {
-					context.AppState = resp.ProcessState
-					for _, stateChan := range context.AppStateChan {
-						// Always detect whether stateChan is full and
-						// the write would be blocking. Otherwise we
-						// can deadlock the entire system!
-						select {
-						case stateChan <- context.AppState:
-						default:
-							log.Println("AppState channel is full")
-						}
-					}
-				}
-				context.AppStateMutex.Unlock()
+				log.Println("[ERROR] Cannot close context", contextId, "err:", err)
 			}
-		}
-	}()
+		}(openResp.ContextId)
+		return nil, nil, err
+	}
+
+	context, err := c.newContext(agent, appId, worktreeId, openResp.ContextId,
+		openResp.GrpcEndpoint, openResp.PortEndpoints, options.IdleTimeout)
+	if err != nil {
+		agent.NumContexts--
+		c.mutex.Unlock()
+		return nil, nil, err
+	}
 
-	c.AppContext[appId] = context
 	c.AppContextRefCount[appId]++
+	c.Placement.ContextOpened(appId, agent)
 	c.mutex.Unlock()
 
-	go func() {
-		for {
-			// Wait for the context to expire.
-			<-context.Timer.C
+	context.mutex.RLock()
+	return context, func() {
+		context.mutex.RUnlock()
 
-			c.mutex.Lock()
-			if c.AppContextRefCount[context.AppId] > 0 {
-				// The context is still being used. Reset the timer.
-				context.Timer.Reset(c.ContextExpirationTime)
-				c.mutex.Unlock()
-			} else {
-				break
-			}
-		}
+		c.mutex.Lock()
+		c.AppContextRefCount[appId]--
+		c.mutex.Unlock()
+	}, nil
+}
 
-		defer c.mutex.Unlock()
+// Set up a context opened on an agent, and add it to the cluster. The caller
+// must hold the cluster lock, and must have counted the context in the
+// agent's NumContexts.
+func (c *Cluster) newContext(agent *Agent, appId string, worktreeId string, contextId string,
+	grpcEndpoint string, portEndpoints []*agentproto.PortEndpoint, idleTimeout time.Duration) (*Context, error) {
+	// This call is non-blocking. Connecting happens in background.
+	grpcConn, err := grpc.Dial(grpcEndpoint,
+		grpc.WithBackoffMaxDelay(time.Millisecond*10),
+		grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
 
-		// We should never block at acquiring this lock, because new
-		// request for this context will be blocked. To be safe, acquire
-		// this lock to ensure no more instance of the context is
-		// allocated.
-		context.mutex.Lock()
+	ports := make([]uint32, 0, len(portEndpoints))
+	endpoints := make(map[uint32]string)
+	for _, portEndpoint := range portEndpoints {
+		ports = append(ports, portEndpoint.Port)
+		endpoints[portEndpoint.Port] = portEndpoint.Endpoint
+	}
+	context := &Context{
+		Id:            contextId,
+		Cluster:       c,
+		Agent:         agent,
+		AppId:         appId,
+		WorktreeId:    worktreeId,
+		GrpcEndpoint:  grpcEndpoint,
+		GrpcConn:      grpcConn,
+		Ports:         ports,
+		PortEndpoints: endpoints,
+		ProcessPorts:  make(map[string]uint32),
+		CreatedTime:   time.Now(),
+		Timer:         time.NewTimer(c.ContextExpirationTime),
+		idleTimeout:   c.ContextExpirationTime,
+		lastUsedTime:  time.Now(),
+		Done:          make(chan struct{}),
+		AppState:      processproto.ProcessState_NOT_RUNNING,
+		AppStateTime:  time.Now(),
+		AppStateChan:  make(map[uint64]chan AppStateEvent),
+	}
 
-		// Stop the tracker routine
-		context.AppStateTrackerStopChan <- true
+	context.SetIdleTimeout(idleTimeout)
+	c.appStateScheduler.add(context)
 
-		err = context.GrpcConn.Close()
-		if err != nil {
-			log.Println("Cannot close GRPC connection, err:", err)
-			// Ignore this error
-		}
+	c.AppContext[appId] = context
 
-		closeReq := &agentproto.CloseContextReq{
-			ContextId: context.Id,
-		}
-		_, err = client.CloseContext(gcontext.Background(), closeReq)
-		if err != nil {
-			if grpc.Code(err) == codes.InvalidArgument {
-				// Some leftover state, which is ok
-			} else {
-				// Something really bad has happened...
-				log.Println("[ERROR] Cannot close context", context, "err:", err)
-
-				// For now, we intentionally quit without releasing
-				// the context lock. This prevents any future access
-				// to the context or the disk. Otherwise, corruption
-				// can occur!!
-				return
-			}
-		}
+	go c.expireContext(context)
 
-		delete(c.AppContext, context.AppId)
-		c.AgentNumContexts[agent]--
+	return context, nil
+}
 
-		context.mutex.Unlock()
-	}()
+// Apply the resource limits to a container that was just opened or bound.
+// Agents that cannot set limits run the container without them.
+func setContextLimits(ctx gcontext.Context, agent *Agent, contextId string, limits model.ResourceLimits) error {
+	limitsReq := &agentext.SetContextLimitsReq{
+		ContextId: contextId,
+		Limits: &agentext.ResourceLimits{
+			CpuMillis:    limits.CpuMillis,
+			MemoryMb:     limits.MemoryMB,
+			DiskMb:       limits.DiskMB,
+			MaxProcesses: limits.MaxProcesses,
+		},
+	}
 
-	context.mutex.RLock()
-	return context, func() {
-		context.mutex.RUnlock()
+	limitsCtx, cancel := gcontext.WithTimeout(ctx, config.ClusterAgentCallTimeout())
+	defer cancel()
+	_, err := agent.ExtClient.SetContextLimits(limitsCtx, limitsReq)
+	if isUnimplemented(err) {
+		log.Println("[WARNING] Agent", agent.Endpoint, "cannot set resource limits, context", contextId, "runs without them")
+		return nil
+	}
+	return err
+}
+
+// Close the context once it expires
+func (c *Cluster) expireContext(context *Context) {
+	for {
+		// Wait for the context to expire, or to be removed from
+		// the cluster by someone else.
+		select {
+		case <-context.Timer.C:
+		case <-context.Done:
+			return
+		}
 
 		c.mutex.Lock()
-		c.AppContextRefCount[appId]--
-		c.mutex.Unlock()
-	}, nil
+		if c.AppContext[context.AppId] != context {
+			// Removed while we were waiting for the lock
+			c.mutex.Unlock()
+			return
+		} else if c.AppContextRefCount[context.AppId] > 0 {
+			// The context is still being used. Reset the timer.
+			context.timerMutex.Lock()
+			if context.idleTimeout != NeverExpire {
+				context.Timer.Reset(context.idleTimeout)
+			}
+			context.timerMutex.Unlock()
+			c.mutex.Unlock()
+		} else if context.GetIdleTimeout() == NeverExpire {
+			// Became always-on after the timer fired
+			c.mutex.Unlock()
+		} else {
+			break
+		}
+	}
+
+	// Nobody uses the context, and nobody can take it once it is out of
+	// the cluster
+	closed := c.startClosingContext(context)
+	c.mutex.Unlock()
+
+	err := c.finishClosingContext(gcontext.Background(), context, closed)
+	if err != nil {
+		log.Println("[ERROR] Cannot close expired context", context, "err:", err)
+	}
 }
@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/config"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthproto "google.golang.org/grpc/health/grpc_health_v1"
+	"log"
+	"time"
+)
+
+// Stop the app state tracker and close the connection to the context. Must
+// be called exactly once for every context, by whoever removes it from the
+// cluster.
+func (ctx *Context) release() {
+	close(ctx.Done)
+
+	// Stop tracking the app state
+	ctx.Cluster.appStateScheduler.remove(ctx)
+
+	err := ctx.GrpcConn.Close()
+	if err != nil {
+		log.Println("Cannot close GRPC connection, err:", err)
+		// Ignore this error
+	}
+}
+
+// Probe the agent once. Any answer from the gRPC server counts as alive,
+// including agents that don't implement the health service.
+func probeAgent(agent *Agent) bool {
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterHealthCheckTimeout())
+	defer cancel()
+
+	resp, err := healthproto.NewHealthClient(agent.conn).Check(ctx, &healthproto.HealthCheckRequest{})
+	if err != nil {
+		return grpc.Code(err) == codes.Unimplemented
+	}
+	return resp.Status == healthproto.HealthCheckResponse_SERVING
+}
+
+// Health check routine of an agent. Runs until the agent is removed.
+func (c *Cluster) checkAgentHealth(agent *Agent) {
+	failures := 0
+	for {
+		select {
+		case <-time.After(config.ClusterHealthCheckInterval()):
+		case <-agent.stopChan:
+			return
+		}
+
+		if probeAgent(agent) {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		c.mutex.Lock()
+		healthy := agent.Healthy
+		if healthy && failures >= config.ClusterHealthCheckFailureThreshold() {
+			log.Printf("[ERROR] Agent %s failed %d health checks, evicting its contexts", agent.Endpoint, failures)
+			agent.Healthy = false
+			c.evictAgentContexts(agent)
+		}
+		c.mutex.Unlock()
+
+		if !healthy && failures == 0 {
+			c.recoverAgent(agent)
+		}
+	}
+}
+
+// Remove all contexts of an agent from the cluster, e.g., when it stops
+// answering probes. Must be called with the cluster lock held.
+//
+// A silent agent may still be running the containers, so the contexts are
+// quarantined rather than dropped: their apps cannot be reopened elsewhere
+// until the agent is fenced, i.e., it recovers and closes all its containers,
+// or the agent is removed from the cluster. Requests still holding an evicted
+// context keep it until they finish. Their calls to the agent fail on their
+// own.
+func (c *Cluster) evictAgentContexts(agent *Agent) {
+	err := fmt.Errorf("Agent %s is unhealthy", agent.Endpoint)
+	for appId, context := range c.AppContext {
+		if context.Agent != agent {
+			continue
+		}
+
+		log.Println("[WARNING] Evicting context of app", appId, "from agent", agent.Endpoint)
+		delete(c.AppContext, appId)
+		context.release()
+		c.quarantineContext(context, err)
+	}
+
+	// The pooled containers are not bound to any worktree, they are
+	// cleaned up when the agent recovers
+	c.takePool(agent)
+}
+
+// Bring an agent back once it answers probes again. Whatever is left on it
+// must go before it takes new contexts, and before the apps evicted from it
+// can be reopened, otherwise two containers can write the same worktree.
+func (c *Cluster) recoverAgent(agent *Agent) {
+	// Don't hold the cluster lock while talking to the agent
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterAgentCallTimeout())
+	_, err := agent.Client.CloseAll(ctx, &agentproto.CloseAllReq{})
+	cancel()
+	if err != nil {
+		log.Printf("[ERROR] Cannot clean up recovered agent %s, err: %s", agent.Endpoint, err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for appId, qc := range c.Quarantine {
+		if qc.context.Agent == agent {
+			log.Println("[INFO] Closed quarantined context of app", appId, "with the rest of agent", agent.Endpoint)
+			c.unquarantineContext(qc)
+		}
+	}
+	log.Printf("[INFO] Agent %s is healthy again", agent.Endpoint)
+	agent.Healthy = true
+}
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"github.com/postverta/pv_backend/model"
+	"time"
+)
+
+// Idle timeout of contexts that are never closed for inactivity
+const NeverExpire time.Duration = -1
+
+// Get the idle timeout for the context of an app, according to its policy
+func AppIdleTimeout(app *model.App) time.Duration {
+	switch app.GetIdlePolicy() {
+	case model.IdlePolicyAlwaysOn:
+		return NeverExpire
+	case model.IdlePolicyCustom:
+		return time.Duration(app.IdleTimeout) * time.Second
+	default:
+		return 0
+	}
+}
+
+func (ctx *Context) GetIdleTimeout() time.Duration {
+	ctx.timerMutex.Lock()
+	defer ctx.timerMutex.Unlock()
+	return ctx.idleTimeout
+}
+
+// Change how long the context can stay idle before it is closed. Zero means
+// the cluster-wide expiration time, and NeverExpire keeps the context open
+// until it is closed by other means (e.g., draining its agent). The idle
+// period starts over.
+func (ctx *Context) SetIdleTimeout(idleTimeout time.Duration) {
+	if idleTimeout == 0 {
+		idleTimeout = ctx.Cluster.ContextExpirationTime
+	}
+
+	ctx.timerMutex.Lock()
+	defer ctx.timerMutex.Unlock()
+	oldIdleTimeout := ctx.idleTimeout
+	ctx.idleTimeout = idleTimeout
+
+	// The timer isn't running for a context that never expires. If it
+	// has fired already, the expiration goroutine picks up the new
+	// timeout when it resets the timer.
+	stopped := ctx.Timer.Stop()
+	if idleTimeout != NeverExpire && (stopped || oldIdleTimeout == NeverExpire) {
+		ctx.Timer.Reset(idleTimeout)
+	}
+}
+
+// Apply a new idle timeout to the context of an app, if it has one open
+func (c *Cluster) SetAppIdleTimeout(appId string, idleTimeout time.Duration) {
+	c.mutex.Lock()
+	context, found := c.AppContext[appId]
+	c.mutex.Unlock()
+
+	if found {
+		context.SetIdleTimeout(idleTimeout)
+	}
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"fmt"
+	gcontext "golang.org/x/net/context"
+	"time"
+)
+
+type ErrorNoContext string
+
+func (enc ErrorNoContext) Error() string {
+	return fmt.Sprintf("App %s has no context in the cluster", string(enc))
+}
+
+func IsNoContextError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorNoContext)
+	return ok
+}
+
+// A snapshot of an agent, for debugging
+type AgentInfo struct {
+	Endpoint    string `json:"endpoint"`
+	Weight      uint   `json:"weight"`
+	Capacity    uint   `json:"capacity"`
+	NumContexts uint   `json:"num_contexts"`
+	PoolSize    int    `json:"pool_size"`
+	Healthy     bool   `json:"healthy"`
+	Draining    bool   `json:"draining"`
+}
+
+// A snapshot of a context, for debugging. Durations are in seconds, and the
+// idle timeout is negative for contexts that never expire.
+type ContextInfo struct {
+	AppId        string    `json:"app_id"`
+	ContextId    string    `json:"context_id"`
+	WorktreeId   string    `json:"worktree_id"`
+	Agent        string    `json:"agent"`
+	CreatedTime  time.Time `json:"created_time"`
+	Age          float64   `json:"age"`
+	IdleTime     float64   `json:"idle_time"`
+	IdleTimeout  float64   `json:"idle_timeout"`
+	RefCount     uint      `json:"ref_count"`
+	AppState     string    `json:"app_state"`
+	AppStateTime time.Time `json:"app_state_time"`
+}
+
+func (c *Cluster) ListAgents() []AgentInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	infos := make([]AgentInfo, 0, len(c.Agents))
+	for _, agent := range c.Agents {
+		infos = append(infos, AgentInfo{
+			Endpoint:    agent.Endpoint,
+			Weight:      agent.Weight,
+			Capacity:    agent.Capacity,
+			NumContexts: agent.NumContexts,
+			PoolSize:    len(agent.pool),
+			Healthy:     agent.Healthy,
+			Draining:    agent.Draining,
+		})
+	}
+	return infos
+}
+
+func (c *Cluster) ListContexts() []ContextInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	infos := make([]ContextInfo, 0, len(c.AppContext))
+	for appId, context := range c.AppContext {
+		context.timerMutex.Lock()
+		idleTime := now.Sub(context.lastUsedTime)
+		idleTimeout := context.idleTimeout
+		context.timerMutex.Unlock()
+
+		context.AppStateMutex.Lock()
+		appState := context.AppState
+		appStateTime := context.AppStateTime
+		context.AppStateMutex.Unlock()
+
+		infos = append(infos, ContextInfo{
+			AppId:        appId,
+			ContextId:    context.Id,
+			WorktreeId:   context.WorktreeId,
+			Agent:        context.Agent.Endpoint,
+			CreatedTime:  context.CreatedTime,
+			Age:          now.Sub(context.CreatedTime).Seconds(),
+			IdleTime:     idleTime.Seconds(),
+			IdleTimeout:  idleTimeout.Seconds(),
+			RefCount:     c.AppContextRefCount[appId],
+			AppState:     appState.String(),
+			AppStateTime: appStateTime,
+		})
+	}
+	return infos
+}
+
+// Close the context of an app right away, even if it is in use. If save is
+// set, the worktree is saved first, and the context is kept if that fails.
+// Otherwise, changes since the last autosave are lost.
+func (c *Cluster) ForceCloseContext(appId string, save bool) error {
+	c.mutex.Lock()
+	context, found := c.AppContext[appId]
+	c.mutex.Unlock()
+	if !found {
+		return ErrorNoContext(appId)
+	}
+
+	if save {
+		return c.saveAndCloseContext(gcontext.Background(), context)
+	}
+	return c.closeContext(gcontext.Background(), context)
+}
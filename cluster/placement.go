@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+type ErrorClusterFull int
+
+func (ecf ErrorClusterFull) Error() string {
+	return fmt.Sprintf("All %d agents are at capacity", int(ecf))
+}
+
+func IsClusterFullError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorClusterFull)
+	return ok
+}
+
+// A strategy to select the agent for a new context. All methods are called
+// with the cluster lock held, so implementations don't need their own locking.
+type PlacementStrategy interface {
+	// Select an agent for the app from the candidates. The candidates
+	// are never empty, and all of them have room for one more context.
+	SelectAgent(appId string, candidates []*Agent) *Agent
+
+	// Called after a context of the app is opened on the agent.
+	ContextOpened(appId string, agent *Agent)
+}
+
+func NewPlacementStrategy(name string) (PlacementStrategy, error) {
+	switch name {
+	case "least_loaded":
+		return &WeightedLeastLoadedPlacement{}, nil
+	case "bin_packing":
+		return &BinPackingPlacement{}, nil
+	case "affinity":
+		return NewAffinityPlacement(&WeightedLeastLoadedPlacement{}), nil
+	default:
+		return nil, fmt.Errorf("Unknown placement strategy %s", name)
+	}
+}
+
+// Whether the agent can take one more context. Pooled containers count against
+// the capacity, but are given up when a context needs their room, so only the
+// ones still opening are in the way.
+func agentHasRoom(agent *Agent) bool {
+	return agent.Capacity == 0 || agent.NumContexts+uint(agent.poolOpening) < agent.Capacity
+}
+
+// The load of an agent relative to its size. Agents without a weight are
+// treated as weight 1.
+func agentLoad(agent *Agent) float64 {
+	weight := agent.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return float64(agent.NumContexts) / float64(weight)
+}
+
+// Pick the agent with the lowest number of contexts per unit of weight. With
+// equal weights this spreads the contexts evenly.
+type WeightedLeastLoadedPlacement struct{}
+
+func (p *WeightedLeastLoadedPlacement) SelectAgent(appId string, candidates []*Agent) *Agent {
+	var bestAgent *Agent
+	for _, agent := range candidates {
+		if bestAgent == nil || agentLoad(agent) < agentLoad(bestAgent) {
+			bestAgent = agent
+		}
+	}
+	return bestAgent
+}
+
+func (p *WeightedLeastLoadedPlacement) ContextOpened(appId string, agent *Agent) {}
+
+// Fill up one agent before moving on to the next one, so that idle hosts can
+// be scaled down. Agents without a capacity limit are only used once all the
+// limited ones are full.
+type BinPackingPlacement struct{}
+
+func (p *BinPackingPlacement) SelectAgent(appId string, candidates []*Agent) *Agent {
+	var bestAgent *Agent
+	for _, agent := range candidates {
+		if bestAgent == nil {
+			bestAgent = agent
+		} else if agent.Capacity == 0 {
+			// Unlimited agents: prefer the most loaded one
+			if bestAgent.Capacity == 0 && agent.NumContexts > bestAgent.NumContexts {
+				bestAgent = agent
+			}
+		} else if bestAgent.Capacity == 0 {
+			bestAgent = agent
+		} else if agent.Capacity-agent.NumContexts < bestAgent.Capacity-bestAgent.NumContexts {
+			// Limited agents: prefer the one with the least room left
+			bestAgent = agent
+		}
+	}
+	return bestAgent
+}
+
+func (p *BinPackingPlacement) ContextOpened(appId string, agent *Agent) {}
+
+// Reopen an app on the agent that hosted it last time, so that the agent can
+// reuse its cached worktree image. Fall back to another strategy if the app
+// is new, or its last agent is full or gone.
+type AffinityPlacement struct {
+	Fallback PlacementStrategy
+
+	lastAgent map[string]string
+}
+
+func NewAffinityPlacement(fallback PlacementStrategy) *AffinityPlacement {
+	return &AffinityPlacement{
+		Fallback:  fallback,
+		lastAgent: make(map[string]string),
+	}
+}
+
+func (p *AffinityPlacement) SelectAgent(appId string, candidates []*Agent) *Agent {
+	if endpoint, found := p.lastAgent[appId]; found {
+		for _, agent := range candidates {
+			if agent.Endpoint == endpoint {
+				return agent
+			}
+		}
+	}
+	return p.Fallback.SelectAgent(appId, candidates)
+}
+
+func (p *AffinityPlacement) ContextOpened(appId string, agent *Agent) {
+	p.lastAgent[appId] = agent.Endpoint
+	p.Fallback.ContextOpened(appId, agent)
+}
@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/runtimes"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Hit and miss counters of the container pool, and the number of containers
+// in the pool of each agent
+type PoolStats struct {
+	Hits      uint64         `json:"hits"`
+	Misses    uint64         `json:"misses"`
+	AgentPool map[string]int `json:"agent_pool"`
+}
+
+// Open a container that isn't bound to any worktree yet. It runs the default
+// runtime: the pool isn't keyed by runtime, as keeping containers of every
+// runtime warm on every agent would multiply the idle containers, and most
+// apps use the default runtime anyway. Apps of other runtimes always open a
+// container the slow way.
+func openPooledContext(agent *Agent) (*agentproto.OpenContextResp, error) {
+	rt := runtimes.Default()
+	openReq := &agentproto.OpenContextReq{
+		Image: rt.Image,
+		StorageConfig: &agentproto.StorageConfig{
+			AccountName: config.AzureAccountName(),
+			AccountKey:  config.AzureAccountKey(),
+			Container:   "worktree",
+		},
+		Ports: config.ClusterPortSlots(),
+		Env: []string{
+			"PV_APP_ROOT=/app",
+			fmt.Sprintf("PV_INTERNAL_API_ENDPOINT=%s", config.InternalApiEndPoint()),
+		},
+		ExecConfigRoots: rt.ExecConfigRoots,
+	}
+
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), config.ClusterOpenContextTimeout())
+	defer cancel()
+	return agent.Client.OpenContext(ctx, openReq)
+}
+
+func closePooledContext(agent *Agent, contextId string) {
+	err := closeAgentContext(agent, contextId)
+	if err != nil {
+		log.Println("[ERROR] Cannot close pooled context", contextId, "err:", err)
+	}
+}
+
+// Bind a container from the pool of the agent to the worktree of an app. Return
+// nil if the pool is empty or the bind fails, in which case the caller should
+// open a container the slow way. Must be called with the cluster lock held.
+func (c *Cluster) takePooledContext(ctx gcontext.Context, agent *Agent, appId string, sourceWorktreeId string,
+	worktreeId string) *agentproto.OpenContextResp {
+	if len(agent.pool) == 0 {
+		atomic.AddUint64(&c.poolMisses, 1)
+		c.refillPools()
+		return nil
+	}
+
+	pooled := agent.pool[0]
+	agent.pool = agent.pool[1:]
+	c.refillPools()
+
+	bindReq := &agentext.BindContextReq{
+		ContextId:        pooled.ContextId,
+		WorktreeId:       worktreeId,
+		SourceWorktreeId: sourceWorktreeId,
+		MountPoint:       "/app",
+		AutosaveInterval: config.WorktreeAutosaveInterval(),
+		Env: []string{
+			fmt.Sprintf("PV_APP_ID=%s", appId),
+		},
+	}
+
+	startTime := time.Now()
+	bindCtx, cancel := gcontext.WithTimeout(ctx, config.ClusterAgentCallTimeout())
+	_, err := agent.ExtClient.BindContext(bindCtx, bindReq)
+	cancel()
+	log.Printf("[INFO] BindContext takes %fs\n", time.Since(startTime).Seconds())
+	if isUnimplemented(err) {
+		// The pool is of no use on this agent, stop filling it
+		log.Println("[WARNING] Agent", agent.Endpoint, "cannot bind pooled contexts, disabling its pool")
+		agent.noBind = true
+		go closePool(agent, append(c.takePool(agent), pooled))
+		atomic.AddUint64(&c.poolMisses, 1)
+		return nil
+	} else if err != nil {
+		log.Println("[ERROR] Cannot bind pooled context", pooled.ContextId, "err:", err)
+		atomic.AddUint64(&c.poolMisses, 1)
+		go closePooledContext(agent, pooled.ContextId)
+		return nil
+	}
+
+	atomic.AddUint64(&c.poolHits, 1)
+	return pooled
+}
+
+// Give up pooled containers of an agent until all its containers, including
+// the context about to be opened, fit in its capacity. The caller must have
+// counted that context in NumContexts already, and must hold the cluster lock.
+// The containers are closed in the background, so the agent may briefly run
+// one more than its capacity.
+func (c *Cluster) makeRoom(agent *Agent) {
+	if agent.Capacity == 0 {
+		return
+	}
+
+	for len(agent.pool) > 0 && agent.NumContexts+uint(len(agent.pool)+agent.poolOpening) > agent.Capacity {
+		pooled := agent.pool[len(agent.pool)-1]
+		agent.pool = agent.pool[:len(agent.pool)-1]
+		go closePooledContext(agent, pooled.ContextId)
+	}
+}
+
+// Wake up the pool filler. Never blocks.
+func (c *Cluster) refillPools() {
+	select {
+	case c.poolRefillChan <- true:
+	default:
+	}
+}
+
+// Keep the pool of every agent topped up. Pools only use spare capacity, so
+// that they never keep apps from opening.
+func (c *Cluster) fillPools() {
+	for {
+		select {
+		case <-time.After(config.ClusterContextPoolRefillInterval()):
+		case <-c.poolRefillChan:
+		}
+
+		c.mutex.Lock()
+		agents := make([]*Agent, 0, len(c.Agents))
+		for _, agent := range c.Agents {
+			if !agent.Healthy || agent.Draining || agent.noBind || c.shuttingDown {
+				continue
+			}
+
+			used := agent.NumContexts + uint(len(agent.pool)+agent.poolOpening)
+			if len(agent.pool)+agent.poolOpening < c.PoolSize &&
+				(agent.Capacity == 0 || used < agent.Capacity) {
+				agent.poolOpening++
+				agents = append(agents, agent)
+			}
+		}
+		c.mutex.Unlock()
+
+		// Open one container per agent at a time. Don't hold the cluster
+		// lock while waiting for them.
+		for _, agent := range agents {
+			go c.fillPool(agent)
+		}
+	}
+}
+
+func (c *Cluster) fillPool(agent *Agent) {
+	openResp, err := openPooledContext(agent)
+
+	c.mutex.Lock()
+	agent.poolOpening--
+	if err != nil {
+		c.mutex.Unlock()
+		log.Println("[ERROR] Cannot open pooled context on agent", agent.Endpoint, "err:", err)
+		if code := grpc.Code(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+			// The agent may still open the container after we gave up.
+			// Pooled containers aren't bound to any worktree.
+			go c.closeOrphanContexts(agent, "")
+		}
+		return
+	}
+
+	_, found := c.findAgent(agent.Endpoint)
+	if found != agent || !agent.Healthy || agent.Draining || c.shuttingDown {
+		// The agent or the cluster went away in the meantime
+		c.mutex.Unlock()
+		closePooledContext(agent, openResp.ContextId)
+		return
+	}
+
+	agent.pool = append(agent.pool, openResp)
+	c.mutex.Unlock()
+
+	// There may be room for more
+	c.refillPools()
+}
+
+// Take all containers out of the pool of an agent. Must be called with the
+// cluster lock held.
+func (c *Cluster) takePool(agent *Agent) []*agentproto.OpenContextResp {
+	pool := agent.pool
+	agent.pool = nil
+	return pool
+}
+
+func closePool(agent *Agent, pool []*agentproto.OpenContextResp) {
+	for _, pooled := range pool {
+		closePooledContext(agent, pooled.ContextId)
+	}
+}
+
+// Adopt an unbound container found on an agent, e.g., after a restart of the
+// backend. Return false if the pool is full, in which case the caller should
+// close the container. Must be called with the cluster lock held.
+func (c *Cluster) adoptPooledContext(agent *Agent, info *agentext.ContextInfo) bool {
+	if len(agent.pool) >= c.PoolSize {
+		return false
+	}
+
+	agent.pool = append(agent.pool, &agentproto.OpenContextResp{
+		ContextId:     info.ContextId,
+		GrpcEndpoint:  info.GrpcEndpoint,
+		PortEndpoints: info.PortEndpoints,
+	})
+	return true
+}
+
+func (c *Cluster) GetPoolStats() PoolStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := PoolStats{
+		Hits:      atomic.LoadUint64(&c.poolHits),
+		Misses:    atomic.LoadUint64(&c.poolMisses),
+		AgentPool: make(map[string]int),
+	}
+	for _, agent := range c.Agents {
+		stats.AgentPool[agent.Endpoint] = len(agent.pool)
+	}
+	return stats
+}
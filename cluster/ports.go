@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+type ErrorNoFreePort string
+
+func (enfp ErrorNoFreePort) Error() string {
+	return fmt.Sprintf("No free port slot left in context %s", string(enfp))
+}
+
+func IsNoFreePortError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorNoFreePort)
+	return ok
+}
+
+// Reserve a port slot for a named process. A process keeps its port until it
+// is released, so calling this again returns the same port. The preferred
+// port is taken if it is free, so that well-known processes keep stable ports
+// (e.g., across a backend restart, after which all slots are free again).
+func (ctx *Context) AllocateProcessPort(processName string, preferredPort uint32) (uint32, error) {
+	ctx.Refresh()
+	ctx.portMutex.Lock()
+	defer ctx.portMutex.Unlock()
+
+	if port, found := ctx.ProcessPorts[processName]; found {
+		return port, nil
+	}
+
+	used := make(map[uint32]bool)
+	for _, port := range ctx.ProcessPorts {
+		used[port] = true
+	}
+
+	if _, found := ctx.PortEndpoints[preferredPort]; found && !used[preferredPort] {
+		ctx.ProcessPorts[processName] = preferredPort
+		return preferredPort, nil
+	}
+
+	// Go through the slots in a fixed order, so that the allocation is
+	// predictable.
+	for _, port := range ctx.Ports {
+		if _, found := ctx.PortEndpoints[port]; found && !used[port] {
+			ctx.ProcessPorts[processName] = port
+			return port, nil
+		}
+	}
+
+	return 0, ErrorNoFreePort(ctx.Id)
+}
+
+// Give the port slot of a process back to the pool.
+func (ctx *Context) ReleaseProcessPort(processName string) {
+	ctx.portMutex.Lock()
+	defer ctx.portMutex.Unlock()
+	delete(ctx.ProcessPorts, processName)
+}
+
+// Get the endpoint (host:port) to reach the port of a named process from the
+// backend. Return false if the process has no port.
+func (ctx *Context) GetProcessEndpoint(processName string) (string, bool) {
+	ctx.Refresh()
+	ctx.portMutex.Lock()
+	defer ctx.portMutex.Unlock()
+
+	port, found := ctx.ProcessPorts[processName]
+	if !found {
+		return "", false
+	}
+
+	endpoint, found := ctx.PortEndpoints[port]
+	return endpoint, found
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/postverta/pv_backend/config"
+	"log"
+	"time"
+)
+
+type ErrorAppQuarantined string
+
+func (eaq ErrorAppQuarantined) Error() string {
+	return fmt.Sprintf("App %s is unavailable, its last context failed to close", string(eaq))
+}
+
+func IsAppQuarantinedError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorAppQuarantined)
+	return ok
+}
+
+type ErrorNotQuarantined string
+
+func (enq ErrorNotQuarantined) Error() string {
+	return fmt.Sprintf("App %s is not quarantined", string(enq))
+}
+
+func IsNotQuarantinedError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorNotQuarantined)
+	return ok
+}
+
+// A context that failed to close. Its container may still be running, so the
+// app is unavailable until the close goes through. It still counts in the
+// NumContexts of its agent.
+type quarantinedContext struct {
+	context   *Context
+	since     time.Time
+	attempts  int
+	lastError error
+	backoff   time.Duration
+	nextRetry time.Time
+}
+
+// A snapshot of a quarantined context, for debugging
+type QuarantineInfo struct {
+	AppId     string    `json:"app_id"`
+	ContextId string    `json:"context_id"`
+	Agent     string    `json:"agent"`
+	Since     time.Time `json:"since"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	NextRetry time.Time `json:"next_retry"`
+}
+
+// Must be called with the cluster lock held, after the context is removed from
+// AppContext and released.
+func (c *Cluster) quarantineContext(context *Context, err error) {
+	log.Println("[WARNING] Quarantining context of app", context.AppId)
+	backoff := config.ClusterQuarantineMinRetryInterval()
+	c.Quarantine[context.AppId] = &quarantinedContext{
+		context:   context,
+		since:     time.Now(),
+		attempts:  1,
+		lastError: err,
+		backoff:   backoff,
+		nextRetry: time.Now().Add(backoff),
+	}
+}
+
+// Remove a quarantined context from the cluster for good. Must be called with
+// the cluster lock held.
+func (c *Cluster) unquarantineContext(qc *quarantinedContext) {
+	delete(c.Quarantine, qc.context.AppId)
+	qc.context.Agent.NumContexts--
+}
+
+// Try to close a quarantined context once. Return true if it is gone.
+func (c *Cluster) retryQuarantined(qc *quarantinedContext) bool {
+	err := closeAgentContext(qc.context.Agent, qc.context.Id)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.Quarantine[qc.context.AppId] != qc {
+		// Resolved in the meantime
+		return true
+	}
+
+	if err == nil {
+		log.Println("[INFO] Closed quarantined context of app", qc.context.AppId)
+		c.unquarantineContext(qc)
+		return true
+	}
+
+	qc.attempts++
+	qc.lastError = err
+	qc.backoff *= 2
+	if qc.backoff > config.ClusterQuarantineMaxRetryInterval() {
+		qc.backoff = config.ClusterQuarantineMaxRetryInterval()
+	}
+	qc.nextRetry = time.Now().Add(qc.backoff)
+	log.Printf("[ERROR] Cannot close quarantined context of app %s (attempt %d), err: %s",
+		qc.context.AppId, qc.attempts, err)
+	return false
+}
+
+// Keep retrying to close the quarantined contexts, each with its own
+// exponential backoff.
+func (c *Cluster) reconcileQuarantine() {
+	for {
+		time.Sleep(time.Second)
+
+		now := time.Now()
+		due := make([]*quarantinedContext, 0)
+		c.mutex.Lock()
+		for _, qc := range c.Quarantine {
+			if !now.Before(qc.nextRetry) {
+				due = append(due, qc)
+			}
+		}
+		c.mutex.Unlock()
+
+		for _, qc := range due {
+			c.retryQuarantined(qc)
+		}
+	}
+}
+
+func (c *Cluster) ListQuarantine() []QuarantineInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	infos := make([]QuarantineInfo, 0, len(c.Quarantine))
+	for appId, qc := range c.Quarantine {
+		infos = append(infos, QuarantineInfo{
+			AppId:     appId,
+			ContextId: qc.context.Id,
+			Agent:     qc.context.Agent.Endpoint,
+			Since:     qc.since,
+			Attempts:  qc.attempts,
+			LastError: qc.lastError.Error(),
+			NextRetry: qc.nextRetry,
+		})
+	}
+	return infos
+}
+
+// Try to close the quarantined context of an app right away. Return an error
+// if it is still stuck.
+func (c *Cluster) RetryQuarantined(appId string) error {
+	c.mutex.Lock()
+	qc, found := c.Quarantine[appId]
+	c.mutex.Unlock()
+	if !found {
+		return ErrorNotQuarantined(appId)
+	}
+
+	if !c.retryQuarantined(qc) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return qc.lastError
+	}
+	return nil
+}
+
+// Give up on the quarantined context of an app, and make the app available
+// again. Only do this once the container is known to be gone, e.g., after
+// cleaning it up on the agent by hand.
+func (c *Cluster) ResolveQuarantined(appId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	qc, found := c.Quarantine[appId]
+	if !found {
+		return ErrorNotQuarantined(appId)
+	}
+
+	log.Println("[INFO] Quarantine of app", appId, "resolved by hand")
+	c.unquarantineContext(qc)
+	return nil
+}
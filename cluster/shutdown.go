@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	gcontext "golang.org/x/net/context"
+	"log"
+	"sync"
+	"time"
+)
+
+type ErrorClusterShuttingDown string
+
+func (ecsd ErrorClusterShuttingDown) Error() string {
+	return fmt.Sprintf("Cannot open context for app %s, the cluster is shutting down", string(ecsd))
+}
+
+func IsClusterShuttingDownError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorClusterShuttingDown)
+	return ok
+}
+
+// Stop opening new contexts, then save the worktrees of all contexts in
+// parallel. Return the IDs of the apps whose context failed, or didn't make it
+// before the deadline.
+//
+// Unless closeContexts is set, the contexts are left running once saved, so
+// that the next backend reattaches to them (see reattachContexts), and apps
+// and editor sessions survive a deploy. Set it when the agents are going away
+// too. Contexts that cannot be saved are never closed, so that they can be
+// saved after the restart.
+func (c *Cluster) Shutdown(deadline time.Duration, closeContexts bool) (failedAppIds []string) {
+	c.mutex.Lock()
+	c.shuttingDown = true
+	contexts := make([]*Context, 0, len(c.AppContext))
+	for _, context := range c.AppContext {
+		contexts = append(contexts, context)
+	}
+	c.mutex.Unlock()
+
+	if closeContexts {
+		log.Printf("[INFO] Shutting down cluster, closing %d contexts", len(contexts))
+	} else {
+		log.Printf("[INFO] Shutting down cluster, saving %d contexts", len(contexts))
+	}
+
+	ctx, cancel := gcontext.WithTimeout(gcontext.Background(), deadline)
+	defer cancel()
+
+	// Every context starts as failed, and is taken off the list once
+	// done. Whatever is left at the deadline has failed.
+	var failedMutex sync.Mutex
+	failed := make(map[string]bool)
+	for _, context := range contexts {
+		failed[context.AppId] = true
+	}
+
+	var wg sync.WaitGroup
+	for _, context := range contexts {
+		wg.Add(1)
+		go func(context *Context) {
+			defer wg.Done()
+			var err error
+			if closeContexts {
+				err = c.saveAndCloseContext(ctx, context)
+			} else {
+				err = saveContext(ctx, context)
+			}
+			if err != nil {
+				log.Println("[ERROR] Cannot shut down context of app", context.AppId, "err:", err)
+				return
+			}
+
+			failedMutex.Lock()
+			delete(failed, context.AppId)
+			failedMutex.Unlock()
+		}(context)
+	}
+
+	// The pooled containers hold no data. Close them along the way, unless
+	// the next backend can adopt them.
+	if closeContexts {
+		c.mutex.Lock()
+		for _, agent := range c.Agents {
+			wg.Add(1)
+			go func(agent *Agent, pool []*agentproto.OpenContextResp) {
+				defer wg.Done()
+				closePool(agent, pool)
+			}(agent, c.takePool(agent))
+		}
+		c.mutex.Unlock()
+	}
+
+	doneChan := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneChan)
+	}()
+
+	select {
+	case <-doneChan:
+	case <-ctx.Done():
+		log.Println("[ERROR] Cluster shutdown deadline exceeded")
+	}
+
+	failedMutex.Lock()
+	defer failedMutex.Unlock()
+	failedAppIds = make([]string, 0, len(failed))
+	for appId := range failed {
+		failedAppIds = append(failedAppIds, appId)
+	}
+	return failedAppIds
+}
@@ -2,47 +2,142 @@ package cluster
 
 import (
 	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
+	"github.com/postverta/pv_backend/model"
+	"github.com/postverta/pv_backend/runtimes"
 	processproto "github.com/postverta/pv_exec/proto/process"
 	"google.golang.org/grpc"
 	"sync"
 	"time"
 )
 
+type Agent struct {
+	Endpoint string
+	Weight   uint
+	Capacity uint
+
+	Client      agentproto.AgentServiceClient
+	ExtClient   agentext.AgentExtServiceClient
+	NumContexts uint
+
+	// Maintained by the health check routine. Unhealthy agents are left
+	// out of placement.
+	Healthy bool
+
+	// Draining agents are left out of placement, and their contexts are
+	// being moved elsewhere.
+	Draining bool
+
+	// Containers opened ahead of time, not bound to any worktree yet.
+	// They don't count in NumContexts, but they do count against the
+	// capacity, see makeRoom.
+	pool        []*agentproto.OpenContextResp
+	poolOpening int
+
+	// Set when the agent turns out not to support BindContext. Its pool
+	// is left empty then.
+	noBind bool
+
+	conn     *grpc.ClientConn
+	stopChan chan bool
+}
+
 type Context struct {
 	Cluster    *Cluster
+	Agent      *Agent
 	AppId      string
 	WorktreeId string
 
 	// Received from agent service
 	Id           string
 	GrpcEndpoint string
-	AppEndpoint  string
-	LspEndpoint  string
 	GrpcConn     *grpc.ClientConn
 
-	// Track app status
-	// TODO: move this out of context
-	AppState                processproto.ProcessState
-	AppStateChan            map[uint64]chan processproto.ProcessState
-	NextChanId              uint64
-	AppStateMutex           sync.Mutex
-	AppStateTrackerStopChan chan bool
+	// The port slots of the context, and the endpoints they are mapped to
+	// on the agent. Each named process can take one slot.
+	//
+	// ProcessPorts only lives in the backend, and neither the agent nor
+	// the process service can tell which process listens where, so it
+	// starts empty when a context is reattached. The well-known processes
+	// take their preferred ports again the next time they are enabled,
+	// see AllocateProcessPort. Additional processes keep running but show
+	// no port until they are enabled again, and their ports may be handed
+	// out to other processes in the meantime.
+	Ports         []uint32
+	PortEndpoints map[uint32]string
+	ProcessPorts  map[string]uint32
+	portMutex     sync.Mutex
+
+	// Track app status, maintained by the cluster's app state scheduler
+	AppState      processproto.ProcessState
+	AppStateTime  time.Time
+	AppStateChan  map[uint64]chan AppStateEvent
+	NextChanId    uint64
+	AppStateMutex sync.Mutex
+
+	appStatePollTimer      *time.Timer
+	appStatePollInterval   time.Duration
+	appStatePolling        bool
+	appStatePokePending    bool
+	appStateTrackerStopped bool
+
+	// When the context was added to the cluster (opened or reattached)
+	CreatedTime time.Time
 
-	// Expiration timer
-	Timer *time.Timer
+	// Expiration timer. It is stopped for contexts that never expire.
+	Timer        *time.Timer
+	idleTimeout  time.Duration
+	lastUsedTime time.Time
+	timerMutex   sync.Mutex
+
+	// Closed when the context is released. Long-running users of the
+	// context (e.g., websockets) should let go of it then.
+	Done chan struct{}
 
 	mutex sync.RWMutex
 }
 
+// How to open the context of an app
+type ContextOptions struct {
+	// Zero means the cluster-wide expiration time, see SetIdleTimeout
+	IdleTimeout time.Duration
+
+	Limits model.ResourceLimits
+
+	// Nil means the default runtime
+	Runtime *runtimes.Runtime
+}
+
 type Cluster struct {
-	Agents []string
+	Agents    []*Agent
+	Placement PlacementStrategy
 
 	ContextExpirationTime time.Duration
 
-	AgentServiceClient map[string]agentproto.AgentServiceClient
-	AgentNumContexts   map[string]uint
 	AppContext         map[string]*Context
 	AppContextRefCount map[string]uint
 
+	// Contexts that failed to close, by app ID
+	Quarantine map[string]*quarantinedContext
+
+	// Apps whose context is being closed, see closeContext. The channel
+	// is closed once the close is over, the apps cannot be reopened
+	// before that.
+	closing map[string]chan struct{}
+
+	appStateScheduler *appStateScheduler
+
+	// Set once Shutdown starts. No new context is opened after that.
+	shuttingDown bool
+
+	// Target size of the container pool of each agent
+	PoolSize       int
+	poolHits       uint64
+	poolMisses     uint64
+	poolRefillChan chan bool
+
 	mutex sync.Mutex
+
+	// Serializes adding and removing agents
+	agentsMutex sync.Mutex
 }
@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/runtimes"
+	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"log"
+	"time"
+)
+
+// Copy the saved image of a worktree of an app into a new worktree, e.g., to
+// take a snapshot of the app. The copy is made by a container of its own, of
+// the runtime of the app (nil means the default runtime), which isn't part of
+// the cluster, so the context of the app (if any) is left alone. Save that
+// context first to copy its latest changes.
+func (c *Cluster) CopyWorktree(ctx gcontext.Context, appId string, sourceWorktreeId string, worktreeId string,
+	rt *runtimes.Runtime) error {
+	c.mutex.Lock()
+	if c.shuttingDown {
+		c.mutex.Unlock()
+		return ErrorClusterShuttingDown(appId)
+	}
+
+	// Prefer the agent of the app, which has the image of the runtime and
+	// likely the worktree cached
+	var agent *Agent
+	if context, found := c.AppContext[appId]; found && context.Agent.Healthy &&
+		!context.Agent.Draining && agentHasRoom(context.Agent) {
+		agent = context.Agent
+	} else {
+		var err error
+		agent, err = c.selectAgent(appId)
+		if err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+	}
+	agent.NumContexts++
+	c.makeRoom(agent)
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		agent.NumContexts--
+		c.mutex.Unlock()
+	}()
+
+	if rt == nil {
+		rt = runtimes.Default()
+	}
+	openReq := &agentproto.OpenContextReq{
+		Image: rt.Image,
+		StorageConfig: &agentproto.StorageConfig{
+			AccountName: config.AzureAccountName(),
+			AccountKey:  config.AzureAccountKey(),
+			Container:   "worktree",
+		},
+		WorktreeId:       worktreeId,
+		SourceWorktreeId: sourceWorktreeId,
+		MountPoint:       "/app",
+		ExecConfigRoots:  rt.ExecConfigRoots,
+	}
+
+	startTime := time.Now()
+	openCtx, cancel := gcontext.WithTimeout(ctx, config.ClusterOpenContextTimeout())
+	openResp, err := agent.Client.OpenContext(openCtx, openReq)
+	cancel()
+	log.Printf("[INFO] OpenContext for worktree copy takes %fs\n", time.Since(startTime).Seconds())
+	if err != nil {
+		if code := grpc.Code(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+			// The agent may still open the container after we gave up
+			go c.closeOrphanContexts(agent, worktreeId)
+		}
+		return err
+	}
+	defer closeCopyContext(agent, openResp.ContextId)
+
+	grpcConn, err := grpc.Dial(openResp.GrpcEndpoint,
+		grpc.WithBackoffMaxDelay(time.Millisecond*10),
+		grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer grpcConn.Close()
+
+	// The new worktree only has an image once it is saved
+	wtClient := worktreeproto.NewWorktreeServiceClient(grpcConn)
+	saveCtx, cancel := gcontext.WithTimeout(ctx, config.ContextSaveCallTimeout())
+	_, err = wtClient.Save(saveCtx, &worktreeproto.SaveReq{})
+	cancel()
+	return err
+}
+
+func closeCopyContext(agent *Agent, contextId string) {
+	err := closeAgentContext(agent, contextId)
+	if err != nil {
+		// Not much we can do, the container lingers on
+		log.Println("[ERROR] Cannot close worktree copy context", contextId, "err:", err)
+	}
+}
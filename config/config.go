@@ -17,21 +17,77 @@ func ClusterBaseImage() string {
 	}
 }
 
-func ClusterEndpoints() []string {
-	// TODO: a list of endpoints with pv_agent running
+// A compute host with pv_agent running. Weight is the relative size of the
+// host used by the weighted placement strategies, and Capacity is the maximum
+// number of contexts the host can take (0 means unlimited).
+type AgentConfig struct {
+	Endpoint string
+	Weight   uint
+	Capacity uint
+}
+
+func ClusterAgents() []AgentConfig {
+	// TODO: a list of endpoints with pv_agent running, and their sizes
 	if os.Getenv("PRODUCTION") != "" {
-		return []string{
-			"compute-prod-0:8080",
-			"compute-prod-1:8080",
-			"compute-prod-2:8080",
+		return []AgentConfig{
+			{Endpoint: "compute-prod-0:8080", Weight: 1, Capacity: 20},
+			{Endpoint: "compute-prod-1:8080", Weight: 1, Capacity: 20},
+			{Endpoint: "compute-prod-2:8080", Weight: 1, Capacity: 20},
 		}
 	} else {
-		return []string{
-			"compute-dev:8080",
+		return []AgentConfig{
+			{Endpoint: "compute-dev:8080", Weight: 1, Capacity: 0},
 		}
 	}
 }
 
+func ClusterPlacementStrategy() string {
+	// TODO: how to select the agent for a new context. Can be
+	// "least_loaded", "bin_packing" or "affinity".
+	if os.Getenv("PRODUCTION") != "" {
+		return "affinity"
+	} else {
+		return "least_loaded"
+	}
+}
+
+func ClusterRuntimeImage(runtime string) string {
+	// TODO: the images of the other runtimes, built the same way as the
+	// base image. The base image is the node runtime.
+	if runtime == "node" {
+		return ClusterBaseImage()
+	}
+
+	if os.Getenv("PRODUCTION") != "" {
+		return "postverta/" + runtime + ":latest"
+	} else {
+		return "postverta/" + runtime + "_dev:latest"
+	}
+}
+
+func ClusterPortSlots() []uint32 {
+	// TODO: the ports exposed by every container. The processes of an
+	// app take their listening ports from these slots. 8080 and 2089 are
+	// used by the app and the language server respectively.
+	return []uint32{8080, 2089, 8081, 8082, 8083, 8084, 8085, 8086}
+}
+
+func ClusterContextPoolSize() int {
+	// TODO: how many unbound containers each agent keeps open, so that
+	// the first access of an app doesn't wait for a container to start
+	if os.Getenv("PRODUCTION") != "" {
+		return 2
+	} else {
+		return 1
+	}
+}
+
+func ClusterContextPoolRefillInterval() time.Duration {
+	// TODO: how often the pools are topped up, in addition to right after
+	// a container is taken from them
+	return time.Second * 10
+}
+
 func ClusterContextExpirationTime() time.Duration {
 	// TODO: how long a container is shutdown after inactivity
 	if os.Getenv("PRODUCTION") != "" {
@@ -41,6 +97,190 @@ func ClusterContextExpirationTime() time.Duration {
 	}
 }
 
+func ClusterOpenContextTimeout() time.Duration {
+	// TODO: how long opening a container may take, including pulling
+	// the image and restoring the worktree
+	return time.Minute * 2
+}
+
+func ContextFileCallTimeout() time.Duration {
+	// TODO: the deadline of the calls to a container that only touch
+	// files (e.g., reading, writing and listing files)
+	return time.Second * 30
+}
+
+func ContextTaskCallTimeout() time.Duration {
+	// TODO: the deadline of the longer tasks run in a container (e.g.,
+	// importing a project, installing a package or exporting a zip)
+	return time.Minute * 5
+}
+
+func ContextProcessCallTimeout() time.Duration {
+	// TODO: the deadline of the calls to configure, restart and get the
+	// state of the processes in a container
+	return time.Second * 10
+}
+
+func ContextSaveCallTimeout() time.Duration {
+	// TODO: the deadline of saving the worktree of a container
+	return time.Minute
+}
+
+func AppMinIdleTimeout() time.Duration {
+	// TODO: the shortest custom idle timeout an app can have
+	return time.Minute
+}
+
+func AppMaxIdleTimeout() time.Duration {
+	// TODO: the longest custom idle timeout an app can have. Longer than
+	// this, and the app should be always-on.
+	return time.Hour * 24
+}
+
+func AppMaxAlwaysOnAppsPerUser() int {
+	// TODO: how many always-on apps a user can have
+	if os.Getenv("PRODUCTION") != "" {
+		return 1
+	} else {
+		return 3
+	}
+}
+
+func ClusterQuarantineMinRetryInterval() time.Duration {
+	// TODO: how soon closing a stuck context is retried. The interval
+	// doubles after every failure.
+	return time.Second * 5
+}
+
+func ClusterQuarantineMaxRetryInterval() time.Duration {
+	// TODO: the longest interval between two retries to close a stuck
+	// context
+	return time.Minute * 5
+}
+
+func ClusterShutdownDeadline() time.Duration {
+	// TODO: how long the backend waits for the worktrees to be saved (and
+	// the contexts to be closed, see ClusterCloseContextsOnShutdown) when
+	// it shuts down
+	if os.Getenv("PRODUCTION") != "" {
+		return time.Second * 60
+	} else {
+		return time.Second * 10
+	}
+}
+
+func ClusterCloseContextsOnShutdown() bool {
+	// TODO: set CLOSE_CONTEXTS_ON_SHUTDOWN to close all contexts when the
+	// backend shuts down, e.g., when the agents are taken down too.
+	// Otherwise, the worktrees are only saved, and the contexts keep
+	// running for the next backend to reattach.
+	return os.Getenv("CLOSE_CONTEXTS_ON_SHUTDOWN") != ""
+}
+
+func ClusterHealthCheckInterval() time.Duration {
+	// TODO: how often each agent is probed
+	return time.Second * 5
+}
+
+func ClusterHealthCheckTimeout() time.Duration {
+	// TODO: how long to wait for an agent to answer a probe
+	return time.Second * 2
+}
+
+func ClusterHealthCheckFailureThreshold() int {
+	// TODO: how many probes in a row must fail before an agent is
+	// considered dead and its contexts are evicted. Too small a
+	// number risks evicting contexts on a host that is only slow.
+	if os.Getenv("PRODUCTION") != "" {
+		return 3
+	} else {
+		return 2
+	}
+}
+
+func ClusterAgentCallTimeout() time.Duration {
+	// TODO: the deadline of the calls to an agent that don't open a
+	// container (e.g., listing, closing or binding containers)
+	return time.Second * 30
+}
+
+func ClusterAppStateMinPollInterval() time.Duration {
+	// TODO: how often the app process state is polled right after it
+	// changed, when a change is expected, or while someone is subscribed
+	// to it (e.g., an open editor)
+	return time.Millisecond * 100
+}
+
+func ClusterAppStateMaxPollInterval() time.Duration {
+	// TODO: how often the app process state is polled when it has been
+	// stable for a while and nobody is watching
+	return time.Second * 5
+}
+
+func ClusterAppStatePollWorkers() int {
+	// TODO: number of concurrent app state polls across the cluster
+	return 16
+}
+
+func DatabaseSqlDriver() string {
+	// TODO: set SQL_DRIVER to "sqlite3" or "postgres" to keep the meta
+	// data in a SQL database. Otherwise, production uses mongodb, and
+	// development an in-memory database.
+	return os.Getenv("SQL_DRIVER")
+}
+
+func DatabaseSqlDataSource() string {
+	// TODO: the data source of the SQL database, e.g., "pv.db" for
+	// sqlite3, or "postgres://pv:pv@postgres/postverta" for postgres
+	return os.Getenv("SQL_DATA_SOURCE")
+}
+
+func DatabaseMigrationMode() string {
+	// TODO: what to do with the pending schema migrations on startup.
+	// "apply" applies them, "dry_run" lists them and exits, and anything
+	// else only checks that there are none. Set with MIGRATE.
+	if mode := os.Getenv("MIGRATE"); mode != "" {
+		return mode
+	}
+
+	if os.Getenv("PRODUCTION") != "" {
+		return ""
+	} else {
+		return "apply"
+	}
+}
+
+func DatabaseDummyFile() string {
+	// TODO: set DUMMY_DATABASE_FILE to a file path to keep the in-memory
+	// development database in that file across restarts
+	return os.Getenv("DUMMY_DATABASE_FILE")
+}
+
+func AppTrashRetention() time.Duration {
+	// TODO: how long a deleted app stays in the trash, where its owner
+	// can restore it, before it is purged for good
+	if os.Getenv("PRODUCTION") != "" {
+		return time.Hour * 24 * 7
+	} else {
+		return time.Minute * 10
+	}
+}
+
+func AppTrashPurgeInterval() time.Duration {
+	// TODO: how often the trash is checked for apps to purge
+	if os.Getenv("PRODUCTION") != "" {
+		return time.Hour
+	} else {
+		return time.Minute
+	}
+}
+
+func GalleryMaxLimit() int {
+	// TODO: the most gallery apps returned in one page. Clients follow
+	// the cursor for more.
+	return 100
+}
+
 func InternalApiEndPoint() string {
 	// TODO: an HTTP endpoint of the pv_backend internal API
 	// service.
@@ -61,6 +301,49 @@ func Auth0Secret() []byte {
 	}
 }
 
+func UserPlanCacheTime() time.Duration {
+	// TODO: how long the plan of a user is cached, as reading it from
+	// Auth0 is slow
+	return time.Minute * 5
+}
+
+func UserPlanFailureCacheTime() time.Duration {
+	// TODO: how long a failure to read the plan of a user is cached, so
+	// that an Auth0 outage doesn't slow down every request. The user gets
+	// the free plan in the meantime.
+	return time.Second * 10
+}
+
+// The default resource limits of the apps of a plan. CpuMillis is in
+// thousandths of a CPU core.
+type PlanLimitsConfig struct {
+	CpuMillis    int64
+	MemoryMB     int64
+	DiskMB       int64
+	MaxProcesses int64
+}
+
+func PlanResourceLimits(plan string) PlanLimitsConfig {
+	// TODO: the default resource limits of the apps, by the plan of their
+	// owner ("free" or "pro"). The admins can override them per app.
+	switch plan {
+	case "pro":
+		return PlanLimitsConfig{CpuMillis: 2000, MemoryMB: 2048, DiskMB: 4096, MaxProcesses: 256}
+	default:
+		return PlanLimitsConfig{CpuMillis: 500, MemoryMB: 512, DiskMB: 1024, MaxProcesses: 64}
+	}
+}
+
+func AdminUserIds() []string {
+	// TODO: the user IDs (Auth0 "sub" claims) allowed to use the admin
+	// APIs
+	if os.Getenv("PRODUCTION") != "" {
+		return []string{}
+	} else {
+		return []string{}
+	}
+}
+
 func LogDirectory() string {
 	// TODO: the directory to store app log outputs. Better use a
 	// mounted remote file system as there can be a lot of log
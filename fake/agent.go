@@ -0,0 +1,233 @@
+// Package fake has in-process implementations of the pv_agent and pv_exec
+// gRPC services, for running the backend without compute hosts (e.g., in
+// integration tests). Contexts keep their files in memory, and worktrees are
+// "saved" into the memory of the agent, so they survive closing and reopening
+// a context on the same agent.
+package fake
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
+	"github.com/postverta/pv_backend/config"
+	"github.com/satori/go.uuid"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net"
+	"sync"
+)
+
+type Agent struct {
+	listener net.Listener
+	server   *grpc.Server
+
+	// Saved worktrees, by worktree ID
+	storage map[string]map[string][]byte
+
+	contexts map[string]*Context
+	mutex    sync.Mutex
+}
+
+// Start a fake agent listening on a random local port. Pass its Endpoint to
+// cluster.NewCluster or Cluster.AddAgent.
+func StartAgent() (*Agent, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &Agent{
+		listener: listener,
+		server:   grpc.NewServer(),
+		storage:  make(map[string]map[string][]byte),
+		contexts: make(map[string]*Context),
+	}
+	agentproto.RegisterAgentServiceServer(agent.server, agent)
+	agentext.RegisterAgentExtServiceServer(agent.server, agent)
+	go agent.server.Serve(listener)
+	return agent, nil
+}
+
+func (agent *Agent) Endpoint() string {
+	return agent.listener.Addr().String()
+}
+
+// Stop the agent and all its contexts, as if the host went down
+func (agent *Agent) Stop() {
+	agent.server.Stop()
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	for id, context := range agent.contexts {
+		context.stop()
+		delete(agent.contexts, id)
+	}
+}
+
+// Get an open context by ID. Return nil if there is none.
+func (agent *Agent) GetContext(contextId string) *Context {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	return agent.contexts[contextId]
+}
+
+// Get the open context of a worktree. Return nil if there is none.
+func (agent *Agent) GetContextByWorktreeId(worktreeId string) *Context {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	for _, context := range agent.contexts {
+		if context.GetWorktreeId() == worktreeId {
+			return context
+		}
+	}
+	return nil
+}
+
+func (agent *Agent) NumContexts() int {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	return len(agent.contexts)
+}
+
+// Get a copy of the files of a saved worktree
+func (agent *Agent) GetSavedWorktree(worktreeId string) map[string][]byte {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	return copyFiles(agent.storage[worktreeId])
+}
+
+func (agent *Agent) saveWorktree(worktreeId string, files map[string][]byte) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	agent.storage[worktreeId] = copyFiles(files)
+}
+
+// Load the files of a worktree. A new worktree starts from its source.
+// Must be called with the agent lock held.
+func (agent *Agent) loadWorktree(worktreeId string, sourceWorktreeId string) map[string][]byte {
+	if files, found := agent.storage[worktreeId]; found {
+		return copyFiles(files)
+	}
+	return copyFiles(agent.storage[sourceWorktreeId])
+}
+
+func (agent *Agent) OpenContext(ctx gcontext.Context, req *agentproto.OpenContextReq) (*agentproto.OpenContextResp, error) {
+	context, err := newContext(agent, uuid.NewV4().String(), req.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if req.WorktreeId != "" {
+		context.bind(req.WorktreeId, agent.loadWorktree(req.WorktreeId, req.SourceWorktreeId))
+	}
+	agent.contexts[context.Id] = context
+	return context.openResp(), nil
+}
+
+func (agent *Agent) BindContext(ctx gcontext.Context, req *agentext.BindContextReq) (*agentext.BindContextResp, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	context, found := agent.contexts[req.ContextId]
+	if !found {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Unknown context %s", req.ContextId)
+	}
+	if context.GetWorktreeId() != "" {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Context %s is already bound", req.ContextId)
+	}
+
+	context.bind(req.WorktreeId, agent.loadWorktree(req.WorktreeId, req.SourceWorktreeId))
+	return &agentext.BindContextResp{}, nil
+}
+
+func (agent *Agent) SetContextLimits(ctx gcontext.Context, req *agentext.SetContextLimitsReq) (*agentext.SetContextLimitsResp, error) {
+	agent.mutex.Lock()
+	context, found := agent.contexts[req.ContextId]
+	agent.mutex.Unlock()
+
+	if !found {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Unknown context %s", req.ContextId)
+	}
+
+	context.mutex.Lock()
+	context.limits = req.Limits
+	context.mutex.Unlock()
+	return &agentext.SetContextLimitsResp{}, nil
+}
+
+func (agent *Agent) CloseContext(ctx gcontext.Context, req *agentproto.CloseContextReq) (*agentproto.CloseContextResp, error) {
+	agent.mutex.Lock()
+	context, found := agent.contexts[req.ContextId]
+	delete(agent.contexts, req.ContextId)
+	agent.mutex.Unlock()
+
+	if !found {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Unknown context %s", req.ContextId)
+	}
+
+	context.stop()
+	return &agentproto.CloseContextResp{}, nil
+}
+
+func (agent *Agent) CloseAll(ctx gcontext.Context, req *agentproto.CloseAllReq) (*agentproto.CloseAllResp, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	for id, context := range agent.contexts {
+		context.stop()
+		delete(agent.contexts, id)
+	}
+	return &agentproto.CloseAllResp{}, nil
+}
+
+func (agent *Agent) ListContexts(ctx gcontext.Context, req *agentext.ListContextsReq) (*agentext.ListContextsResp, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	resp := &agentext.ListContextsResp{
+		Contexts: make([]*agentext.ContextInfo, 0, len(agent.contexts)),
+	}
+	for _, context := range agent.contexts {
+		openResp := context.openResp()
+		resp.Contexts = append(resp.Contexts, &agentext.ContextInfo{
+			ContextId:     openResp.ContextId,
+			WorktreeId:    context.GetWorktreeId(),
+			GrpcEndpoint:  openResp.GrpcEndpoint,
+			PortEndpoints: openResp.PortEndpoints,
+		})
+	}
+	return resp, nil
+}
+
+func copyFiles(files map[string][]byte) map[string][]byte {
+	result := make(map[string][]byte)
+	for path, content := range files {
+		result[path] = append([]byte(nil), content...)
+	}
+	return result
+}
+
+func (agent *Agent) String() string {
+	return fmt.Sprintf("fake agent %s", agent.Endpoint())
+}
+
+// Start a number of fake agents. The configs can be passed to
+// cluster.NewCluster or cluster.InitGlobalCluster.
+func StartAgents(numAgents int) ([]*Agent, []config.AgentConfig, error) {
+	agents := make([]*Agent, 0, numAgents)
+	configs := make([]config.AgentConfig, 0, numAgents)
+	for i := 0; i < numAgents; i++ {
+		agent, err := StartAgent()
+		if err != nil {
+			for _, agent := range agents {
+				agent.Stop()
+			}
+			return nil, nil, err
+		}
+		agents = append(agents, agent)
+		configs = append(configs, config.AgentConfig{Endpoint: agent.Endpoint(), Weight: 1})
+	}
+	return agents, configs, nil
+}
@@ -0,0 +1,200 @@
+package fake
+
+import (
+	"fmt"
+	agentproto "github.com/postverta/pv_agent/proto"
+	"github.com/postverta/pv_backend/agentext"
+	execproto "github.com/postverta/pv_exec/proto/exec"
+	processproto "github.com/postverta/pv_exec/proto/process"
+	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// A fake container. It serves the exec, process and worktree services on its
+// own gRPC endpoint, and an HTTP server on the endpoint of every exposed port,
+// which answers while a running process listens on the port.
+type Context struct {
+	Id    string
+	agent *Agent
+
+	listener net.Listener
+	server   *grpc.Server
+
+	// Exposed port -> HTTP listener
+	portListeners map[uint32]net.Listener
+
+	worktreeId string
+	files      map[string][]byte
+
+	// The last limits set by the cluster, nil if none were
+	limits *agentext.ResourceLimits
+
+	// Process name -> process
+	processes map[string]*Process
+
+	// All exec requests, in order
+	execLog []*execproto.ExecReq
+
+	numSaves int
+
+	mutex sync.Mutex
+}
+
+type Process struct {
+	Name          string
+	StartCmd      []string
+	RunPath       string
+	ListeningPort uint32
+	EnvVars       map[string]string
+	State         processproto.ProcessState
+	NumRestarts   int
+}
+
+func newContext(agent *Agent, contextId string, ports []uint32) (*Context, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	context := &Context{
+		Id:            contextId,
+		agent:         agent,
+		listener:      listener,
+		server:        grpc.NewServer(),
+		portListeners: make(map[uint32]net.Listener),
+		files:         make(map[string][]byte),
+		processes:     make(map[string]*Process),
+	}
+
+	for _, port := range ports {
+		portListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			context.stop()
+			return nil, err
+		}
+		context.portListeners[port] = portListener
+		go http.Serve(portListener, context.portHandler(port))
+	}
+
+	execproto.RegisterExecServiceServer(context.server, &execService{context: context})
+	processproto.RegisterProcessServiceServer(context.server, &processService{context: context})
+	worktreeproto.RegisterWorktreeServiceServer(context.server, &worktreeService{context: context})
+	go context.server.Serve(listener)
+	return context, nil
+}
+
+func (context *Context) openResp() *agentproto.OpenContextResp {
+	resp := &agentproto.OpenContextResp{
+		ContextId:     context.Id,
+		GrpcEndpoint:  context.listener.Addr().String(),
+		PortEndpoints: make([]*agentproto.PortEndpoint, 0, len(context.portListeners)),
+	}
+	for port, portListener := range context.portListeners {
+		resp.PortEndpoints = append(resp.PortEndpoints, &agentproto.PortEndpoint{
+			Port:     port,
+			Endpoint: portListener.Addr().String(),
+		})
+	}
+	return resp
+}
+
+func (context *Context) bind(worktreeId string, files map[string][]byte) {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	context.worktreeId = worktreeId
+	context.files = files
+}
+
+func (context *Context) stop() {
+	context.server.Stop()
+	for _, portListener := range context.portListeners {
+		portListener.Close()
+	}
+}
+
+// Answer on the port if a running process listens on it. Otherwise behave
+// like nothing is listening in the container.
+func (context *Context) portHandler(port uint32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		context.mutex.Lock()
+		var process *Process
+		for _, p := range context.processes {
+			if p.ListeningPort == port && p.State == processproto.ProcessState_RUNNING {
+				process = p
+			}
+		}
+		context.mutex.Unlock()
+
+		if process == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s %s %s", process.Name, r.Method, r.URL.Path)
+	})
+}
+
+func (context *Context) GetWorktreeId() string {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.worktreeId
+}
+
+// Get a copy of the files in the context
+func (context *Context) GetFiles() map[string][]byte {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return copyFiles(context.files)
+}
+
+// Replace a file in the context, as if the app wrote it
+func (context *Context) SetFile(filePath string, content []byte) {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	context.files[filePath] = append([]byte(nil), content...)
+}
+
+// Get a copy of a process. Return nil if it was never configured.
+func (context *Context) GetProcess(name string) *Process {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	process, found := context.processes[name]
+	if !found {
+		return nil
+	}
+	processCopy := *process
+	return &processCopy
+}
+
+// Change the state of a process, e.g., to simulate a crash of the app
+func (context *Context) SetProcessState(name string, state processproto.ProcessState) {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	if process, found := context.processes[name]; found {
+		process.State = state
+	}
+}
+
+// Get the exec requests received so far
+func (context *Context) GetExecLog() []*execproto.ExecReq {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return append([]*execproto.ExecReq(nil), context.execLog...)
+}
+
+// Get the resource limits of the context. Return nil if none were set.
+func (context *Context) GetLimits() *agentext.ResourceLimits {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.limits
+}
+
+func (context *Context) NumSaves() int {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.numSaves
+}
@@ -0,0 +1,183 @@
+package fake
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	execproto "github.com/postverta/pv_exec/proto/exec"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Exec tasks run against the in-memory files of the context. Tasks that need
+// the outside world (e.g., github_import) only succeed, and all requests are
+// kept in the exec log.
+type execService struct {
+	context *Context
+}
+
+func getKeyValue(req *execproto.ExecReq, key string) string {
+	for _, kv := range req.KeyValues {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+func (s *execService) Exec(ctx gcontext.Context, req *execproto.ExecReq) (*execproto.ExecResp, error) {
+	context := s.context
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	context.execLog = append(context.execLog, req)
+	files := context.files
+
+	switch req.TaskName {
+	case "file_list":
+		paths := make([]string, 0, len(files))
+		for filePath := range files {
+			paths = append(paths, filePath)
+		}
+		sort.Strings(paths)
+		output := ""
+		for _, filePath := range paths {
+			output += filePath + "\n"
+		}
+		return &execproto.ExecResp{Data: []byte(output)}, nil
+	case "file_read":
+		content, found := files[getKeyValue(req, "FILEPATH")]
+		if !found {
+			return nil, grpc.Errorf(codes.NotFound, "File %s doesn't exist", getKeyValue(req, "FILEPATH"))
+		}
+		return &execproto.ExecResp{Data: content}, nil
+	case "file_write":
+		files[getKeyValue(req, "FILEPATH")] = append([]byte(nil), req.Data...)
+	case "file_move", "file_copy":
+		oldPath := getKeyValue(req, "OLD_FILEPATH")
+		newPath := getKeyValue(req, "NEW_FILEPATH")
+		content, found := files[oldPath]
+		if !found {
+			return nil, grpc.Errorf(codes.NotFound, "File %s doesn't exist", oldPath)
+		}
+		if req.TaskName == "file_move" {
+			delete(files, oldPath)
+		}
+		files[newPath] = content
+	case "file_delete":
+		filePath := getKeyValue(req, "FILEPATH")
+		if _, found := files[filePath]; !found {
+			return nil, grpc.Errorf(codes.NotFound, "File %s doesn't exist", filePath)
+		}
+		delete(files, filePath)
+	case "file_export_zip":
+		data, err := exportZip(files)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Cannot export zip: %s", err)
+		}
+		return &execproto.ExecResp{Data: data}, nil
+	case "zip_import":
+		err := importZip(files, req.Data, getKeyValue(req, "PROJECTROOT"))
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Cannot import zip: %s", err)
+		}
+	case "npm_install_pkg":
+		err := updatePackageJson(files, getKeyValue(req, "NAME"), getKeyValue(req, "VERSION"))
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Cannot install package: %s", err)
+		}
+	case "npm_remove_pkg":
+		err := updatePackageJson(files, getKeyValue(req, "NAME"), "")
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Cannot remove package: %s", err)
+		}
+	}
+
+	return &execproto.ExecResp{}, nil
+}
+
+func exportZip(files map[string][]byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for filePath, content := range files {
+		fileWriter, err := zipWriter.Create(filePath)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fileWriter.Write(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := zipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unpack the files under the project root of the zip
+func importZip(files map[string][]byte, data []byte, projectRoot string) error {
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if projectRoot != "" && projectRoot != "." {
+		prefix = strings.TrimSuffix(projectRoot, "/") + "/"
+	}
+
+	for _, file := range zipReader.File {
+		if file.FileInfo().IsDir() || !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		files[path.Clean(strings.TrimPrefix(file.Name, prefix))] = content
+	}
+	return nil
+}
+
+// Add a dependency to package.json, or remove it if version is empty
+func updatePackageJson(files map[string][]byte, name string, version string) error {
+	packageJson := make(map[string]interface{})
+	if content, found := files["package.json"]; found {
+		err := json.Unmarshal(content, &packageJson)
+		if err != nil {
+			return err
+		}
+	}
+
+	dependencies, ok := packageJson["dependencies"].(map[string]interface{})
+	if !ok {
+		dependencies = make(map[string]interface{})
+	}
+	if version == "" {
+		delete(dependencies, name)
+	} else {
+		dependencies[name] = version
+	}
+	packageJson["dependencies"] = dependencies
+
+	content, err := json.MarshalIndent(packageJson, "", "  ")
+	if err != nil {
+		return err
+	}
+	files["package.json"] = content
+	return nil
+}
@@ -0,0 +1,83 @@
+package fake
+
+import (
+	processproto "github.com/postverta/pv_exec/proto/process"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Processes don't run anything. An enabled process is running until it is
+// disabled, or its state is changed with Context.SetProcessState.
+type processService struct {
+	context *Context
+}
+
+func envVarsToMap(envVars []*processproto.KeyValuePair) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range envVars {
+		result[kv.Key] = kv.Value
+	}
+	return result
+}
+
+func (s *processService) ConfigureProcess(ctx gcontext.Context, req *processproto.ConfigureProcessReq) (*processproto.ConfigureProcessResp, error) {
+	context := s.context
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if req.ProcessName == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Process name is empty")
+	}
+
+	state := processproto.ProcessState_NOT_RUNNING
+	if req.Enabled {
+		if len(req.StartCmd) == 0 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Process %s has no start command", req.ProcessName)
+		}
+		state = processproto.ProcessState_RUNNING
+	}
+
+	context.processes[req.ProcessName] = &Process{
+		Name:          req.ProcessName,
+		StartCmd:      req.StartCmd,
+		RunPath:       req.RunPath,
+		ListeningPort: req.ListeningPort,
+		EnvVars:       envVarsToMap(req.EnvVars),
+		State:         state,
+	}
+	return &processproto.ConfigureProcessResp{}, nil
+}
+
+func (s *processService) RestartProcess(ctx gcontext.Context, req *processproto.RestartProcessReq) (*processproto.RestartProcessResp, error) {
+	context := s.context
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	process, found := context.processes[req.ProcessName]
+	if !found {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Unknown process %s", req.ProcessName)
+	}
+
+	if len(req.StartCmd) != 0 {
+		process.StartCmd = req.StartCmd
+	}
+	if req.EnvVars != nil {
+		process.EnvVars = envVarsToMap(req.EnvVars)
+	}
+	process.State = processproto.ProcessState_RUNNING
+	process.NumRestarts++
+	return &processproto.RestartProcessResp{}, nil
+}
+
+func (s *processService) GetProcessState(ctx gcontext.Context, req *processproto.GetProcessStateReq) (*processproto.GetProcessStateResp, error) {
+	context := s.context
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	state := processproto.ProcessState_NOT_RUNNING
+	if process, found := context.processes[req.ProcessName]; found {
+		state = process.State
+	}
+	return &processproto.GetProcessStateResp{ProcessState: state}, nil
+}
@@ -0,0 +1,27 @@
+package fake
+
+import (
+	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
+	gcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type worktreeService struct {
+	context *Context
+}
+
+// Save the files of the context into the agent, under the bound worktree
+func (s *worktreeService) Save(ctx gcontext.Context, req *worktreeproto.SaveReq) (*worktreeproto.SaveResp, error) {
+	context := s.context
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if context.worktreeId == "" {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Context %s has no worktree", context.Id)
+	}
+
+	context.agent.saveWorktree(context.worktreeId, context.files)
+	context.numSaves++
+	return &worktreeproto.SaveResp{}, nil
+}
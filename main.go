@@ -20,17 +20,21 @@ func main() {
 	log.Printf("Server started")
 	godotenv.Load()
 
-	// Set up cluster connection
-	err := cluster.InitGlobalCluster(config.ClusterEndpoints(), config.ClusterContextExpirationTime())
-	if err != nil {
-		log.Fatal("Cannot initialize cluster:", err)
-	}
-
-	// Set up database connection
-	if os.Getenv("PRODUCTION") != "" {
+	// Set up database connection. The cluster needs it to reattach to the
+	// running contexts, so set it up first.
+	var err error
+	if driver := config.DatabaseSqlDriver(); driver != "" {
+		err = model.InitGlobalClient(func() (model.Client, error) {
+			return model.NewSqlClient(driver, config.DatabaseSqlDataSource())
+		})
+	} else if os.Getenv("PRODUCTION") != "" {
 		err = model.InitGlobalClient(func() (model.Client, error) {
 			return model.NewMongodbClient("pv:pv@mongo/postverta")
 		})
+	} else if path := config.DatabaseDummyFile(); path != "" {
+		err = model.InitGlobalClient(func() (model.Client, error) {
+			return model.NewPersistentDummyClient(path)
+		})
 	} else {
 		err = model.InitGlobalClient(func() (model.Client, error) {
 			return model.NewDummyClient(), nil
@@ -40,12 +44,46 @@ func main() {
 		log.Fatal("Cannot initialize database client:", err)
 	}
 
+	switch config.DatabaseMigrationMode() {
+	case "dry_run":
+		pending, err := model.Migrate(model.C(), true)
+		if err != nil {
+			log.Fatal("Cannot list database migrations:", err)
+		}
+		log.Println(len(pending), "database migrations pending")
+		return
+	case "apply":
+		_, err = model.Migrate(model.C(), false)
+		if err != nil {
+			log.Fatal("Cannot migrate database:", err)
+		}
+	}
+
+	// Refuse to serve with a database the code doesn't understand
+	err = model.CheckSchema(model.C())
+	if err != nil {
+		log.Fatal("Cannot use database:", err)
+	}
+
+	// Set up cluster connection
+	placement, err := cluster.NewPlacementStrategy(config.ClusterPlacementStrategy())
+	if err != nil {
+		log.Fatal("Cannot create placement strategy:", err)
+	}
+	err = cluster.InitGlobalCluster(config.ClusterAgents(), placement, config.ClusterContextExpirationTime())
+	if err != nil {
+		log.Fatal("Cannot initialize cluster:", err)
+	}
+
 	// Set up log storage
 	err = logmgr.InitGlobalLogMgr(config.LogDirectory(), config.LogIdleDuration())
 	if err != nil {
 		log.Fatal("Cannot initialize log storage:", err)
 	}
 
+	// Purge the apps that have been in the trash long enough
+	go sw.PurgeTrashPeriodically()
+
 	router := sw.NewRouter()
 	internalRouter := sw.NewInternalRouter()
 
@@ -143,6 +181,17 @@ func main() {
 	log.Println("Shutting down API server")
 	apiServer.Shutdown(context.Background())
 
+	// Keep the internal API server up until the contexts are shut down,
+	// as the containers talk to it
+	log.Println("Shutting down cluster")
+	failedAppIds := cluster.C().Shutdown(config.ClusterShutdownDeadline(),
+		config.ClusterCloseContextsOnShutdown())
+	if len(failedAppIds) > 0 {
+		log.Println("[ERROR] Cannot shut down the contexts of apps:", failedAppIds)
+	} else {
+		log.Println("All contexts shut down")
+	}
+
 	log.Println("Shutting down internal API server")
 	internalServer.Shutdown(context.Background())
 
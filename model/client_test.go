@@ -0,0 +1,388 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run a test against each client that can run without external services.
+// Each gets a fresh database, with the migrations applied.
+func forEachClient(t *testing.T, test func(t *testing.T, c Client)) {
+	newClients := []struct {
+		name      string
+		newClient func(dir string) (Client, error)
+	}{
+		{"sqlite", func(dir string) (Client, error) {
+			return NewSqlClient("sqlite3", filepath.Join(dir, "pv.db"))
+		}},
+		{"dummy", func(dir string) (Client, error) {
+			return NewDummyClient(), nil
+		}},
+		{"persistent_dummy", func(dir string) (Client, error) {
+			return NewPersistentDummyClient(filepath.Join(dir, "pv.json"))
+		}},
+	}
+
+	for _, nc := range newClients {
+		t.Run(nc.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			c, err := nc.newClient(dir)
+			if err != nil {
+				t.Fatal("Cannot create client:", err)
+			}
+			_, err = Migrate(c, false)
+			if err != nil {
+				t.Fatal("Cannot migrate:", err)
+			}
+			test(t, c)
+		})
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pv_model_test")
+	if err != nil {
+		t.Fatal("Cannot create temp dir:", err)
+	}
+	return dir
+}
+
+func newTestApp(t *testing.T, c Client, app *App) *App {
+	if app.WorktreeId == "" {
+		app.WorktreeId = NewAppId()
+	}
+	app, err := c.NewApp(app)
+	if err != nil {
+		t.Fatal("Cannot create app:", err)
+	}
+	return app
+}
+
+func getTestApp(t *testing.T, c Client, id string) *App {
+	app, err := c.GetApp(id)
+	if err != nil {
+		t.Fatal("Cannot get app:", err)
+	} else if app == nil {
+		t.Fatal("Cannot find app", id)
+	}
+	return app
+}
+
+func appIds(apps []*App) map[string]bool {
+	ids := make(map[string]bool)
+	for _, app := range apps {
+		ids[app.Id] = true
+	}
+	return ids
+}
+
+func TestClientUniqueAttributes(t *testing.T) {
+	forEachClient(t, func(t *testing.T, c Client) {
+		app := newTestApp(t, c, &App{UserId: "alice"})
+		otherApp := newTestApp(t, c, &App{UserId: "alice"})
+
+		_, err := c.NewApp(&App{UserId: "bob", WorktreeId: app.WorktreeId})
+		if !IsDuplicateAttributeError(err) {
+			t.Error("Expecting a duplicate worktree ID, got", err)
+		}
+
+		err = c.UpdateAppName(otherApp, app.Name)
+		if !IsDuplicateAttributeError(err) {
+			t.Error("Expecting a duplicate name, got", err)
+		}
+	})
+}
+
+func TestClientUpdateApp(t *testing.T) {
+	forEachClient(t, func(t *testing.T, c Client) {
+		app := newTestApp(t, c, &App{UserId: "alice"})
+		app.EnvVars = []KeyValuePair{{Key: "KEY", Value: "value"}}
+		app.ApiIds = []string{"api"}
+		app.StartCmd = "node index.js"
+		err := c.UpdateApp(app, []string{"EnvVars", "ApiIds", "StartCmd"})
+		if err != nil {
+			t.Fatal("Cannot update app:", err)
+		}
+
+		storedApp := getTestApp(t, c, app.Id)
+		if len(storedApp.EnvVars) != 1 || storedApp.EnvVars[0] != app.EnvVars[0] ||
+			len(storedApp.ApiIds) != 1 || storedApp.ApiIds[0] != "api" || storedApp.StartCmd != app.StartCmd {
+			t.Error("Wrong updated app:", storedApp)
+		}
+	})
+}
+
+func TestClientPurgeApp(t *testing.T) {
+	forEachClient(t, func(t *testing.T, c Client) {
+		app := newTestApp(t, c, &App{UserId: "alice"})
+		if err := c.SetAppEnvVar(app, "KEY", "value"); err != nil {
+			t.Fatal("Cannot set env var:", err)
+		}
+		if err := c.AddAppApiId(app, "api"); err != nil {
+			t.Fatal("Cannot add API:", err)
+		}
+		if _, err := c.NewSnapshot(&Snapshot{AppId: app.Id, UserId: "alice", WorktreeId: NewAppId()}); err != nil {
+			t.Fatal("Cannot create snapshot:", err)
+		}
+
+		if err := c.PurgeApp(app.Id, time.Now().Add(time.Minute)); err == nil {
+			t.Error("Purged an app out of the trash")
+		}
+
+		if err := c.DeleteApp(app.Id); err != nil {
+			t.Fatal("Cannot delete app:", err)
+		}
+		if err := c.PurgeApp(app.Id, time.Now().Add(-time.Minute)); err == nil {
+			t.Error("Purged an app deleted after the cutoff")
+		}
+		if err := c.PurgeApp(app.Id, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal("Cannot purge app:", err)
+		}
+
+		if deletedApp, err := c.GetDeletedApp(app.Id); err != nil || deletedApp != nil {
+			t.Error("App is still in the trash:", deletedApp, err)
+		}
+		if snapshots, err := c.GetSnapshotsByAppId(app.Id); err != nil || len(snapshots) != 0 {
+			t.Error("Snapshots are left after the purge:", snapshots, err)
+		}
+
+		// The worktree is free again
+		newTestApp(t, c, &App{UserId: "alice", WorktreeId: app.WorktreeId})
+	})
+}
+
+func TestClientVersionConflict(t *testing.T) {
+	changes := []struct {
+		name   string
+		change func(c Client, app *App) error
+	}{
+		{"UpdateApp", func(c Client, app *App) error {
+			app.Tags = []string{"tag"}
+			return c.UpdateApp(app, []string{"Tags"})
+		}},
+		{"UpdateAppName", func(c Client, app *App) error {
+			return c.UpdateAppName(app, "renamed-"+app.Id)
+		}},
+		{"UpdateAppDescription", func(c Client, app *App) error {
+			return c.UpdateAppDescription(app, "new description")
+		}},
+		{"SetAppEnvVar", func(c Client, app *App) error {
+			return c.SetAppEnvVar(app, "NEW_KEY", "value")
+		}},
+		{"RemoveAppEnvVar", func(c Client, app *App) error {
+			return c.RemoveAppEnvVar(app, "KEY")
+		}},
+		{"AddAppApiId", func(c Client, app *App) error {
+			return c.AddAppApiId(app, "new_api")
+		}},
+		{"RemoveAppApiId", func(c Client, app *App) error {
+			return c.RemoveAppApiId(app, "api")
+		}},
+		{"SetAppCollaborator", func(c Client, app *App) error {
+			return c.SetAppCollaborator(app, "carol", RoleEditor)
+		}},
+		{"RemoveAppCollaborator", func(c Client, app *App) error {
+			return c.RemoveAppCollaborator(app, "bob")
+		}},
+	}
+
+	forEachClient(t, func(t *testing.T, c Client) {
+		for _, change := range changes {
+			app := newTestApp(t, c, &App{UserId: "alice"})
+			if err := c.SetAppEnvVar(app, "KEY", "value"); err != nil {
+				t.Fatal("Cannot set env var:", err)
+			}
+			if err := c.AddAppApiId(app, "api"); err != nil {
+				t.Fatal("Cannot add API:", err)
+			}
+			if err := c.SetAppCollaborator(app, "bob", RoleViewer); err != nil {
+				t.Fatal("Cannot add collaborator:", err)
+			}
+
+			staleApp := getTestApp(t, c, app.Id)
+			if err := c.SetAppEnvVar(app, "OTHER_KEY", "value"); err != nil {
+				t.Fatal("Cannot set env var:", err)
+			}
+			if err := change.change(c, staleApp); !IsVersionConflictError(err) {
+				t.Error(change.name, "of a stale app, expecting a version conflict, got", err)
+			}
+
+			if err := change.change(c, app); err != nil {
+				t.Error(change.name, "failed:", err)
+			} else if reloadedApp := getTestApp(t, c, app.Id); reloadedApp.Version != app.Version {
+				t.Error(change.name, "left version", app.Version, "instead of", reloadedApp.Version)
+			}
+
+			// Apps in the trash cannot be changed, whatever the version
+			if err := c.DeleteApp(app.Id); err != nil {
+				t.Fatal("Cannot delete app:", err)
+			}
+			trashedApp, err := c.GetDeletedApp(app.Id)
+			if err != nil {
+				t.Fatal("Cannot get deleted app:", err)
+			}
+			if err := change.change(c, trashedApp); err == nil || IsVersionConflictError(err) {
+				t.Error(change.name, "of an app in the trash, expecting not found, got", err)
+			}
+		}
+	})
+}
+
+func TestClientTrash(t *testing.T) {
+	forEachClient(t, func(t *testing.T, c Client) {
+		team, err := c.NewTeam(&Team{Name: "team", Members: []TeamMember{{UserId: "alice", Role: RoleOwner}}})
+		if err != nil {
+			t.Fatal("Cannot create team:", err)
+		}
+		app := newTestApp(t, c, &App{UserId: "alice"})
+		teamApp := newTestApp(t, c, &App{TeamId: team.Id})
+		otherApp := newTestApp(t, c, &App{UserId: "bob"})
+		liveApp := newTestApp(t, c, &App{UserId: "alice"})
+
+		for _, id := range []string{app.Id, teamApp.Id, otherApp.Id} {
+			if err := c.DeleteApp(id); err != nil {
+				t.Fatal("Cannot delete app:", err)
+			}
+			if err := c.DeleteApp(id); err == nil {
+				t.Error("Deleted app", id, "twice")
+			}
+			if trashedApp, err := c.GetApp(id); err != nil || trashedApp != nil {
+				t.Error("App", id, "is still live:", trashedApp, err)
+			}
+		}
+
+		apps, err := c.GetDeletedAppsByUserId("alice")
+		if ids := appIds(apps); err != nil || len(ids) != 1 || !ids[app.Id] {
+			t.Error("Wrong deleted apps of the user:", ids, err)
+		}
+		apps, err = c.GetDeletedAppsByTeamId(team.Id)
+		if ids := appIds(apps); err != nil || len(ids) != 1 || !ids[teamApp.Id] {
+			t.Error("Wrong deleted apps of the team:", ids, err)
+		}
+		apps, err = c.GetAppsDeletedBefore(time.Now().Add(time.Minute))
+		if err != nil || len(apps) != 3 {
+			t.Error("Expecting 3 apps deleted before now, got", len(apps), err)
+		}
+		apps, err = c.GetAppsDeletedBefore(time.Now().Add(-time.Minute))
+		if err != nil || len(apps) != 0 {
+			t.Error("Expecting no app deleted a minute ago, got", len(apps), err)
+		}
+
+		// The name stays reserved while in the trash
+		if err := c.UpdateAppName(liveApp, app.Name); !IsDuplicateAttributeError(err) {
+			t.Error("Expecting a duplicate name, got", err)
+		}
+
+		restoredApp, err := c.RestoreApp(app.Id)
+		if err != nil {
+			t.Fatal("Cannot restore app:", err)
+		} else if restoredApp.Deleted || restoredApp.Name != app.Name {
+			t.Error("Wrong restored app:", restoredApp)
+		}
+		if _, err := c.RestoreApp(app.Id); err == nil {
+			t.Error("Restored a live app")
+		}
+		getTestApp(t, c, app.Id)
+	})
+}
+
+func TestSqlClientMigrate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := NewSqlClient("sqlite3", filepath.Join(dir, "pv.db"))
+	if err != nil {
+		t.Fatal("Cannot create client:", err)
+	}
+	if err := CheckSchema(c); !IsSchemaBehindError(err) {
+		t.Error("Expecting the schema of a new database to be behind, got", err)
+	}
+
+	numMigrations := len(c.(Migrator).Migrations())
+	pending, err := Migrate(c, true)
+	if err != nil || len(pending) != numMigrations {
+		t.Error("Expecting", numMigrations, "pending migrations, got", len(pending), err)
+	}
+	if err := CheckSchema(c); !IsSchemaBehindError(err) {
+		t.Error("Dry run changed the schema:", err)
+	}
+
+	applied, err := Migrate(c, false)
+	if err != nil || len(applied) != numMigrations {
+		t.Fatal("Expecting", numMigrations, "applied migrations, got", len(applied), err)
+	}
+	if err := CheckSchema(c); err != nil {
+		t.Error("Schema is behind after the migrations:", err)
+	}
+	if pending, err := Migrate(c, true); err != nil || len(pending) != 0 {
+		t.Error("Expecting no pending migrations, got", len(pending), err)
+	}
+}
+
+func TestPersistentDummyClientReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pv.json")
+
+	c, err := NewPersistentDummyClient(path)
+	if err != nil {
+		t.Fatal("Cannot create client:", err)
+	}
+	app := newTestApp(t, c, &App{UserId: "alice"})
+	if err := c.SetAppEnvVar(app, "KEY", "value"); err != nil {
+		t.Fatal("Cannot set env var:", err)
+	}
+
+	c, err = NewPersistentDummyClient(path)
+	if err != nil {
+		t.Fatal("Cannot reload client:", err)
+	}
+	reloadedApp := getTestApp(t, c, app.Id)
+	if reloadedApp.Name != app.Name || reloadedApp.Version != app.Version ||
+		len(reloadedApp.EnvVars) != 1 || reloadedApp.EnvVars[0].Value != "value" {
+		t.Error("Wrong reloaded app:", reloadedApp)
+	}
+	if appByName, err := c.GetAppByName(app.Name); err != nil || appByName == nil {
+		t.Error("Cannot find reloaded app by name:", err)
+	}
+}
+
+func TestPersistentDummyClientRollback(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pv.json")
+
+	c, err := NewPersistentDummyClient(path)
+	if err != nil {
+		t.Fatal("Cannot create client:", err)
+	}
+	app := newTestApp(t, c, &App{UserId: "alice"})
+
+	// Make the file impossible to replace, even for root
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.UpdateAppDescription(app, "description"); err == nil {
+		t.Error("Changed the description without saving it")
+	}
+	if err := c.SetAppEnvVar(app, "KEY", "value"); err == nil {
+		t.Error("Set an env var without saving it")
+	}
+	if app.Description != "" || len(app.EnvVars) != 0 {
+		t.Error("Failed changes are left in the app:", app)
+	}
+
+	storedApp := getTestApp(t, c, app.Id)
+	if storedApp.Description != "" || len(storedApp.EnvVars) != 0 || storedApp.Version != app.Version {
+		t.Error("Failed changes are left in the client:", storedApp)
+	}
+}
@@ -3,13 +3,18 @@ package model
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 )
 
-// Dummy implementation of the client, for development only.
+// Dummy implementation of the client, for development only. The apps are
+// copied in and out, so that callers see the same behavior as with mongodb.
+// If Path is set, all data is written to that file on every change.
 type DummyClient struct {
 	UserClient
 	Mutex            sync.RWMutex
@@ -18,8 +23,40 @@ type DummyClient struct {
 	WorktreeToAppMap map[string]*App
 
 	IdToApiMap map[string]*Api
+
+	IdToSnapshotMap map[string]*Snapshot
+
+	IdToTeamMap map[string]*Team
+
+	IdToCollectionMap map[string]*Collection
+
+	Path          string
+	schemaVersion int
+
+	// The content of the file as last written, to roll back to when a
+	// change cannot be saved
+	savedData []byte
+}
+
+// The content of the file of a persistent dummy client
+type dummyData struct {
+	SchemaVersion int
+	Apps          []*App
+	Apis          map[string]*Api
+	Snapshots     map[string]*Snapshot
+	Teams         map[string]*Team
+	Collections   map[string]*Collection
+}
+
+type dummyMigration struct {
+	Migration
+	up func(mc *DummyClient) error
 }
 
+// The migrations of the files of the persistent dummy clients, e.g., to
+// backfill a new field. Must be called with the lock held.
+var dummyMigrations = []dummyMigration{}
+
 func NewDummyClient() Client {
 	dc := &DummyClient{
 		IdToAppMap:       make(map[string]*App),
@@ -27,6 +64,15 @@ func NewDummyClient() Client {
 		WorktreeToAppMap: make(map[string]*App),
 
 		IdToApiMap: make(map[string]*Api),
+
+		IdToSnapshotMap: make(map[string]*Snapshot),
+
+		IdToTeamMap: make(map[string]*Team),
+
+		IdToCollectionMap: make(map[string]*Collection),
+
+		// New data is always up to date
+		schemaVersion: len(dummyMigrations),
 	}
 
 	if f, err := os.Open("fake_apis.json"); err == nil {
@@ -35,18 +81,198 @@ func NewDummyClient() Client {
 		if err != nil {
 			log.Println("Cannot decode fake_apis.json")
 		}
+		f.Close()
 	}
 
 	return dc
 }
 
+// Create a dummy client that keeps its data in a file, so that it survives
+// restarts. If the file doesn't exist yet, start with the APIs in
+// fake_apis.json.
+func NewPersistentDummyClient(path string) (Client, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		dc := NewDummyClient().(*DummyClient)
+		dc.Path = path
+		err = dc.save()
+		if err != nil {
+			return nil, err
+		}
+		return dc, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dc := &DummyClient{
+		Path: path,
+	}
+	err = dc.load(buf)
+	if err != nil {
+		return nil, err
+	}
+	dc.savedData = buf
+
+	return dc, nil
+}
+
+// Replace all data with the content of a file. Must be called with the lock
+// held.
+func (mc *DummyClient) load(buf []byte) error {
+	data := dummyData{}
+	err := json.Unmarshal(buf, &data)
+	if err != nil {
+		return err
+	}
+
+	mc.IdToAppMap = make(map[string]*App)
+	mc.NameToAppMap = make(map[string]*App)
+	mc.WorktreeToAppMap = make(map[string]*App)
+	mc.IdToApiMap = data.Apis
+	mc.IdToSnapshotMap = data.Snapshots
+	mc.IdToTeamMap = data.Teams
+	mc.IdToCollectionMap = data.Collections
+	mc.schemaVersion = data.SchemaVersion
+	if mc.IdToApiMap == nil {
+		mc.IdToApiMap = make(map[string]*Api)
+	}
+	if mc.IdToSnapshotMap == nil {
+		// Files written before there were snapshots
+		mc.IdToSnapshotMap = make(map[string]*Snapshot)
+	}
+	if mc.IdToTeamMap == nil {
+		mc.IdToTeamMap = make(map[string]*Team)
+	}
+	if mc.IdToCollectionMap == nil {
+		mc.IdToCollectionMap = make(map[string]*Collection)
+	}
+	for _, app := range data.Apps {
+		mc.IdToAppMap[app.Id] = app
+		mc.NameToAppMap[app.Name] = app
+		mc.WorktreeToAppMap[app.WorktreeId] = app
+	}
+	return nil
+}
+
+// Write all data to the file, if any. The file is replaced atomically, so a
+// crash leaves either the old or the new content. If the write fails, the
+// data goes back to what was last written, which undoes the change the
+// caller just made in memory. Must be called with the lock held.
+func (mc *DummyClient) save() error {
+	if mc.Path == "" {
+		return nil
+	}
+
+	buf, err := mc.marshal()
+	if err == nil {
+		err = writeFileAtomically(mc.Path, buf)
+	}
+	if err != nil {
+		if mc.savedData != nil {
+			if loadErr := mc.load(mc.savedData); loadErr != nil {
+				log.Println("[ERROR] Cannot roll back dummy database:", loadErr)
+			}
+		}
+		return err
+	}
+
+	mc.savedData = buf
+	return nil
+}
+
+// Must be called with the lock held.
+func (mc *DummyClient) marshal() ([]byte, error) {
+	data := dummyData{
+		SchemaVersion: mc.schemaVersion,
+		Apps:          make([]*App, 0, len(mc.IdToAppMap)),
+		Apis:          mc.IdToApiMap,
+		Snapshots:     mc.IdToSnapshotMap,
+		Teams:         mc.IdToTeamMap,
+		Collections:   mc.IdToCollectionMap,
+	}
+	for _, app := range mc.IdToAppMap {
+		data.Apps = append(data.Apps, app)
+	}
+	SortAppsByCreatedTime(data.Apps)
+
+	return json.MarshalIndent(data, "", "  ")
+}
+
+func writeFileAtomically(path string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (mc *DummyClient) Migrations() []Migration {
+	migrations := make([]Migration, len(dummyMigrations))
+	for i, m := range dummyMigrations {
+		migrations[i] = m.Migration
+	}
+	return migrations
+}
+
+func (mc *DummyClient) SchemaVersion() (int, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	return mc.schemaVersion, nil
+}
+
+func (mc *DummyClient) ApplyMigration(m Migration) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+	for _, dm := range dummyMigrations {
+		if dm.Version != m.Version {
+			continue
+		}
+
+		err := dm.up(mc)
+		if err != nil {
+			return err
+		}
+		mc.schemaVersion = m.Version
+		return mc.save()
+	}
+	return fmt.Errorf("Unknown migration %d", m.Version)
+}
+
+func copyApp(app *App) *App {
+	newApp := *app
+	newApp.EnvVars = append([]KeyValuePair{}, app.EnvVars...)
+	newApp.ApiIds = append([]string{}, app.ApiIds...)
+	newApp.Collaborators = append([]Collaborator{}, app.Collaborators...)
+	newApp.Tags = append([]string{}, app.Tags...)
+	return &newApp
+}
+
 func (mc *DummyClient) NewApp(app *App) (*App, error) {
 	currentTime := time.Now()
-	mc.Mutex.RLock()
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.WorktreeToAppMap[app.WorktreeId]; found {
+		return nil, ErrorDuplicateAttribute("worktree_id")
+	}
+
 	name := ""
 	for {
 		name = NewAppName()
-		if app, _ := mc.GetAppByName(name); app == nil {
+		if _, found := mc.NameToAppMap[name]; !found {
 			break
 		}
 	}
@@ -55,69 +281,269 @@ func (mc *DummyClient) NewApp(app *App) (*App, error) {
 	app.CreatedTime = currentTime
 	app.AccessedTime = currentTime
 
-	// For testing, we put all apps into gallery
-	app.Gallery = true
+	storedApp := copyApp(app)
+	mc.IdToAppMap[app.Id] = storedApp
+	mc.NameToAppMap[app.Name] = storedApp
+	mc.WorktreeToAppMap[app.WorktreeId] = storedApp
 
-	mc.Mutex.RUnlock()
+	err := mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
 
-	mc.Mutex.Lock()
-	mc.IdToAppMap[app.Id] = app
-	mc.NameToAppMap[app.Name] = app
-	mc.WorktreeToAppMap[app.WorktreeId] = app
-	mc.Mutex.Unlock()
+// Must be called with the lock held.
+func (mc *DummyClient) getStoredApp(id string) (*App, error) {
+	storedApp, found := mc.IdToAppMap[id]
+	if !found {
+		return nil, fmt.Errorf("App %s not found", id)
+	}
+	return storedApp, nil
+}
 
-	return app, nil
+// Like getStoredApp, but apps in the trash are not found either, as they
+// can't be updated. Must be called with the lock held.
+func (mc *DummyClient) getLiveStoredApp(id string) (*App, error) {
+	storedApp, err := mc.getStoredApp(id)
+	if err != nil {
+		return nil, err
+	} else if storedApp.Deleted {
+		return nil, fmt.Errorf("App %s not found", id)
+	}
+	return storedApp, nil
 }
 
 func (mc *DummyClient) UpdateApp(app *App, fields []string) error {
-	// We cannot handle updating name and worktreeId. They must
-	// go through the special functions
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedApp, err := mc.getLiveStoredApp(app.Id)
+	if err != nil {
+		return err
+	}
+
+	if storedApp.Version != app.Version {
+		return ErrorVersionConflict(app.Id)
+	}
+
+	// Check the unique attributes before changing anything
+	for _, field := range fields {
+		if field == "Name" {
+			if oldApp, found := mc.NameToAppMap[app.Name]; found && oldApp != storedApp {
+				return ErrorDuplicateAttribute("name")
+			}
+		} else if field == "WorktreeId" {
+			if oldApp, found := mc.WorktreeToAppMap[app.WorktreeId]; found && oldApp != storedApp {
+				return ErrorDuplicateAttribute("worktree_id")
+			}
+		}
+	}
+
+	delete(mc.NameToAppMap, storedApp.Name)
+	delete(mc.WorktreeToAppMap, storedApp.WorktreeId)
+
+	appValue := reflect.ValueOf(copyApp(app)).Elem()
+	storedValue := reflect.ValueOf(storedApp).Elem()
 	for _, field := range fields {
-		if field == "Name" || field == "WorktreeId" {
-			return fmt.Errorf("Don't directly update name or worktreeId")
+		v := appValue.FieldByName(field)
+		if !v.IsValid() {
+			log.Panic("Unexpected field", field)
 		}
+		storedValue.FieldByName(field).Set(v)
 	}
 
+	mc.NameToAppMap[storedApp.Name] = storedApp
+	mc.WorktreeToAppMap[storedApp.WorktreeId] = storedApp
+	storedApp.Version++
+	err = mc.save()
+	if err != nil {
+		return err
+	}
+	app.Version = storedApp.Version
 	return nil
 }
 
-func (mc *DummyClient) UpdateAppName(app *App, newName string) error {
+// Apply an atomic change to the stored app, and reload the app
+func (mc *DummyClient) changeApp(app *App, change func(storedApp *App)) error {
 	mc.Mutex.Lock()
 	defer mc.Mutex.Unlock()
-	if oldApp, found := mc.NameToAppMap[newName]; found && oldApp.Id != app.Id {
-		return ErrorDuplicateAttribute("name")
+
+	storedApp, err := mc.getLiveStoredApp(app.Id)
+	if err != nil {
+		return err
 	}
-	delete(mc.NameToAppMap, app.Name)
-	mc.NameToAppMap[newName] = app
-	app.Name = newName
+
+	if storedApp.Version != app.Version {
+		return ErrorVersionConflict(app.Id)
+	}
+
+	change(storedApp)
+	storedApp.Version++
+	err = mc.save()
+	if err != nil {
+		return err
+	}
+	*app = *copyApp(storedApp)
+	return nil
+}
+
+func (mc *DummyClient) SetAppEnvVar(app *App, key string, value string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		for i, kv := range storedApp.EnvVars {
+			if kv.Key == key {
+				storedApp.EnvVars[i].Value = value
+				return
+			}
+		}
+		storedApp.EnvVars = append(storedApp.EnvVars, KeyValuePair{
+			Key:   key,
+			Value: value,
+		})
+	})
+}
+
+func (mc *DummyClient) RemoveAppEnvVar(app *App, key string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		envVars := []KeyValuePair{}
+		for _, kv := range storedApp.EnvVars {
+			if kv.Key != key {
+				envVars = append(envVars, kv)
+			}
+		}
+		storedApp.EnvVars = envVars
+	})
+}
+
+func (mc *DummyClient) AddAppApiId(app *App, apiId string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		for _, id := range storedApp.ApiIds {
+			if id == apiId {
+				return
+			}
+		}
+		storedApp.ApiIds = append(storedApp.ApiIds, apiId)
+	})
+}
+
+func (mc *DummyClient) RemoveAppApiId(app *App, apiId string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		apiIds := []string{}
+		for _, id := range storedApp.ApiIds {
+			if id != apiId {
+				apiIds = append(apiIds, id)
+			}
+		}
+		storedApp.ApiIds = apiIds
+	})
+}
+
+func (mc *DummyClient) SetAppCollaborator(app *App, userId string, role string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		for i, collaborator := range storedApp.Collaborators {
+			if collaborator.UserId == userId {
+				storedApp.Collaborators[i].Role = role
+				return
+			}
+		}
+		storedApp.Collaborators = append(storedApp.Collaborators, Collaborator{
+			UserId: userId,
+			Role:   role,
+		})
+	})
+}
+
+func (mc *DummyClient) RemoveAppCollaborator(app *App, userId string) error {
+	return mc.changeApp(app, func(storedApp *App) {
+		collaborators := []Collaborator{}
+		for _, collaborator := range storedApp.Collaborators {
+			if collaborator.UserId != userId {
+				collaborators = append(collaborators, collaborator)
+			}
+		}
+		storedApp.Collaborators = collaborators
+	})
+}
+
+func (mc *DummyClient) UpdateAppName(app *App, newName string) error {
+	newApp := copyApp(app)
+	newApp.Name = newName
+	err := mc.UpdateApp(newApp, []string{"Name"})
+	if err != nil {
+		return err
+	}
+	*app = *newApp
 	return nil
 }
 
 func (mc *DummyClient) UpdateAppDescription(app *App, newDescription string) error {
-	app.Description = newDescription
+	newApp := copyApp(app)
+	newApp.Description = newDescription
+	err := mc.UpdateApp(newApp, []string{"Description"})
+	if err != nil {
+		return err
+	}
+	*app = *newApp
 	return nil
 }
 
+// Like the mongodb client, reload the app after setting the timestamp
 func (mc *DummyClient) UpdateAppSourceTimestamp(app *App) error {
-	app.SourceTimestamp = time.Now().UnixNano()
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedApp, err := mc.getStoredApp(app.Id)
+	if err != nil {
+		return err
+	}
+
+	storedApp.SourceTimestamp = time.Now().UnixNano()
+	err = mc.save()
+	if err != nil {
+		return err
+	}
+	*app = *copyApp(storedApp)
 	return nil
 }
 
 func (mc *DummyClient) UpdateAppRunningTimestamp(app *App) error {
-	app.RunningTimestamp = time.Now().UnixNano()
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedApp, err := mc.getStoredApp(app.Id)
+	if err != nil {
+		return err
+	}
+
+	storedApp.RunningTimestamp = time.Now().UnixNano()
+	err = mc.save()
+	if err != nil {
+		return err
+	}
+	*app = *copyApp(storedApp)
 	return nil
 }
 
+// Return a copy of the app, or nil if there is none or it is in the trash.
+// The apps in the trash stay in the maps, so that their names and worktrees
+// stay taken.
+func copyAppOrNil(app *App) *App {
+	if app == nil || app.Deleted {
+		return nil
+	}
+	return copyApp(app)
+}
+
 func (mc *DummyClient) GetApp(id string) (*App, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
-	return mc.IdToAppMap[id], nil
+	return copyAppOrNil(mc.IdToAppMap[id]), nil
 }
 
 func (mc *DummyClient) GetAppByName(name string) (*App, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
-	return mc.NameToAppMap[name], nil
+	return copyAppOrNil(mc.NameToAppMap[name]), nil
 }
 
 func (mc *DummyClient) GetAppsByUserId(userId string) ([]*App, error) {
@@ -125,8 +551,59 @@ func (mc *DummyClient) GetAppsByUserId(userId string) ([]*App, error) {
 	defer mc.Mutex.RUnlock()
 	apps := make([]*App, 0)
 	for _, app := range mc.IdToAppMap {
-		if app.UserId == userId {
-			apps = append(apps, app)
+		if app.UserId == userId && !app.Deleted {
+			apps = append(apps, copyApp(app))
+		}
+	}
+
+	return apps, nil
+}
+
+func (mc *DummyClient) GetAppsByCollaboratorId(userId string) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if app.Deleted {
+			continue
+		}
+		for _, collaborator := range app.Collaborators {
+			if collaborator.UserId == userId {
+				apps = append(apps, copyApp(app))
+				break
+			}
+		}
+	}
+
+	return apps, nil
+}
+
+func (mc *DummyClient) GetAppsByTeamId(teamId string) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if app.TeamId == teamId && !app.Deleted {
+			apps = append(apps, copyApp(app))
+		}
+	}
+
+	return apps, nil
+}
+
+func (mc *DummyClient) GetAppsByApiId(apiId string) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if app.Deleted {
+			continue
+		}
+		for _, id := range app.ApiIds {
+			if id == apiId {
+				apps = append(apps, copyApp(app))
+				break
+			}
 		}
 	}
 
@@ -136,46 +613,328 @@ func (mc *DummyClient) GetAppsByUserId(userId string) ([]*App, error) {
 func (mc *DummyClient) GetAppByWorktreeId(worktreeId string) (*App, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
-	return mc.WorktreeToAppMap[worktreeId], nil
+	return copyAppOrNil(mc.WorktreeToAppMap[worktreeId]), nil
+}
+
+// Move the app in or out of the trash. Must be called with the lock held.
+func (mc *DummyClient) setAppDeleted(id string, deleted bool) (*App, error) {
+	storedApp, err := mc.getStoredApp(id)
+	if err != nil {
+		return nil, err
+	} else if storedApp.Deleted == deleted {
+		return nil, fmt.Errorf("App %s not found", id)
+	}
+
+	storedApp.Deleted = deleted
+	if deleted {
+		storedApp.DeletedTime = time.Now()
+	} else {
+		storedApp.DeletedTime = time.Time{}
+	}
+	storedApp.Version++
+	err = mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return storedApp, nil
 }
 
 func (mc *DummyClient) DeleteApp(id string) error {
 	mc.Mutex.Lock()
 	defer mc.Mutex.Unlock()
 
-	app, found := mc.IdToAppMap[id]
-	if !found {
-		return nil
+	_, err := mc.setAppDeleted(id, true)
+	return err
+}
+
+func (mc *DummyClient) RestoreApp(id string) (*App, error) {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedApp, err := mc.setAppDeleted(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return copyApp(storedApp), nil
+}
+
+func (mc *DummyClient) PurgeApp(id string, deletedBefore time.Time) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	app, err := mc.getStoredApp(id)
+	if err != nil {
+		return err
+	} else if !app.Deleted {
+		return fmt.Errorf("App %s is not in the trash", id)
+	} else if !app.DeletedTime.Before(deletedBefore) {
+		return fmt.Errorf("App %s was moved to the trash after %s", id, deletedBefore)
 	}
 	delete(mc.IdToAppMap, id)
 	delete(mc.NameToAppMap, app.Name)
-	return nil
+	delete(mc.WorktreeToAppMap, app.WorktreeId)
+	for snapshotId, snapshot := range mc.IdToSnapshotMap {
+		if snapshot.AppId == id {
+			delete(mc.IdToSnapshotMap, snapshotId)
+		}
+	}
+	return mc.save()
+}
+
+func (mc *DummyClient) GetDeletedApp(id string) (*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	app, found := mc.IdToAppMap[id]
+	if !found || !app.Deleted {
+		return nil, nil
+	}
+	return copyApp(app), nil
 }
 
-func (mc *DummyClient) GetGalleryApps(limit int) ([]*App, error) {
+func (mc *DummyClient) GetDeletedAppsByUserId(userId string) ([]*App, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
 	apps := make([]*App, 0)
 	for _, app := range mc.IdToAppMap {
-		if app.Gallery {
-			apps = append(apps, app)
+		if app.UserId == userId && app.Deleted {
+			apps = append(apps, copyApp(app))
+		}
+	}
+
+	return apps, nil
+}
+
+func (mc *DummyClient) GetDeletedAppsByTeamId(teamId string) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if app.TeamId == teamId && app.Deleted {
+			apps = append(apps, copyApp(app))
 		}
 	}
 
-	SortAppsByCreatedTime(apps)
-	if len(apps) > limit {
-		apps = apps[:limit]
+	return apps, nil
+}
+
+func (mc *DummyClient) GetAppsDeletedBefore(t time.Time) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if app.Deleted && app.DeletedTime.Before(t) {
+			apps = append(apps, copyApp(app))
+		}
 	}
 
 	return apps, nil
 }
 
+func (mc *DummyClient) NewSnapshot(snapshot *Snapshot) (*Snapshot, error) {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	snapshot.Id = NewSnapshotId()
+	snapshot.CreatedTime = time.Now()
+	storedSnapshot := *snapshot
+	mc.IdToSnapshotMap[snapshot.Id] = &storedSnapshot
+	err := mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (mc *DummyClient) GetSnapshot(id string) (*Snapshot, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	snapshot, found := mc.IdToSnapshotMap[id]
+	if !found {
+		return nil, nil
+	}
+	snapshotCopy := *snapshot
+	return &snapshotCopy, nil
+}
+
+func (mc *DummyClient) GetSnapshotsByAppId(appId string) ([]*Snapshot, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	snapshots := make([]*Snapshot, 0)
+	for _, snapshot := range mc.IdToSnapshotMap {
+		if snapshot.AppId == appId {
+			snapshotCopy := *snapshot
+			snapshots = append(snapshots, &snapshotCopy)
+		}
+	}
+
+	SortSnapshotsByCreatedTime(snapshots)
+	return snapshots, nil
+}
+
+func (mc *DummyClient) DeleteSnapshot(id string) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.IdToSnapshotMap[id]; !found {
+		return fmt.Errorf("Snapshot %s not found", id)
+	}
+	delete(mc.IdToSnapshotMap, id)
+	return mc.save()
+}
+
+func copyTeam(team *Team) *Team {
+	newTeam := *team
+	newTeam.Members = append([]TeamMember{}, team.Members...)
+	return &newTeam
+}
+
+func (mc *DummyClient) NewTeam(team *Team) (*Team, error) {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	team.Id = NewTeamId()
+	team.CreatedTime = time.Now()
+	mc.IdToTeamMap[team.Id] = copyTeam(team)
+	err := mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (mc *DummyClient) GetTeam(id string) (*Team, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	team, found := mc.IdToTeamMap[id]
+	if !found {
+		return nil, nil
+	}
+	return copyTeam(team), nil
+}
+
+func (mc *DummyClient) GetTeamsByUserId(userId string) ([]*Team, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	teams := make([]*Team, 0)
+	for _, team := range mc.IdToTeamMap {
+		if team.GetRole(userId) != "" {
+			teams = append(teams, copyTeam(team))
+		}
+	}
+
+	return teams, nil
+}
+
+// Apply an atomic change to the stored team, and reload the team
+func (mc *DummyClient) changeTeam(team *Team, change func(storedTeam *Team)) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedTeam, found := mc.IdToTeamMap[team.Id]
+	if !found {
+		return fmt.Errorf("Team %s not found", team.Id)
+	}
+
+	change(storedTeam)
+	err := mc.save()
+	if err != nil {
+		return err
+	}
+	*team = *copyTeam(storedTeam)
+	return nil
+}
+
+func (mc *DummyClient) SetTeamMember(team *Team, userId string, role string) error {
+	return mc.changeTeam(team, func(storedTeam *Team) {
+		for i, member := range storedTeam.Members {
+			if member.UserId == userId {
+				storedTeam.Members[i].Role = role
+				return
+			}
+		}
+		storedTeam.Members = append(storedTeam.Members, TeamMember{
+			UserId: userId,
+			Role:   role,
+		})
+	})
+}
+
+func (mc *DummyClient) RemoveTeamMember(team *Team, userId string) error {
+	return mc.changeTeam(team, func(storedTeam *Team) {
+		members := []TeamMember{}
+		for _, member := range storedTeam.Members {
+			if member.UserId != userId {
+				members = append(members, member)
+			}
+		}
+		storedTeam.Members = members
+	})
+}
+
+func (mc *DummyClient) GetAppsByIds(ids []string) ([]*App, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	apps := make([]*App, 0)
+	for _, id := range ids {
+		// Like mongodb, skip the unknown IDs
+		if app := copyAppOrNil(mc.IdToAppMap[id]); app != nil {
+			apps = append(apps, app)
+		}
+	}
+
+	return apps, nil
+}
+
+func (mc *DummyClient) GetGalleryApps(query GalleryQuery) ([]*App, string, error) {
+	cursor, err := query.decodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	words := query.searchWords()
+	apps := make([]*App, 0)
+	for _, app := range mc.IdToAppMap {
+		if !app.Gallery || app.Deleted {
+			continue
+		}
+		if query.Tag != "" && !app.hasTag(query.Tag) {
+			continue
+		}
+		if !app.matchesSearchWords(words) {
+			continue
+		}
+		if cursor != nil && !query.isAfter(app, cursor) {
+			continue
+		}
+		apps = append(apps, copyApp(app))
+	}
+
+	SortGalleryApps(apps, query)
+	apps, nextCursor := query.page(apps)
+	return apps, nextCursor, nil
+}
+
+func (mc *DummyClient) IncrementAppForkCount(id string) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	storedApp, err := mc.getStoredApp(id)
+	if err != nil {
+		return err
+	}
+
+	storedApp.ForkCount++
+	return mc.save()
+}
+
 func (mc *DummyClient) GetApis() ([]*Api, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
 	apis := make([]*Api, 0)
 	for _, api := range mc.IdToApiMap {
-		apis = append(apis, api)
+		apis = append(apis, copyApi(api))
 	}
 
 	return apis, nil
@@ -184,7 +943,11 @@ func (mc *DummyClient) GetApis() ([]*Api, error) {
 func (mc *DummyClient) GetApi(id string) (*Api, error) {
 	mc.Mutex.RLock()
 	defer mc.Mutex.RUnlock()
-	return mc.IdToApiMap[id], nil
+	api, found := mc.IdToApiMap[id]
+	if !found {
+		return nil, nil
+	}
+	return copyApi(api), nil
 }
 
 func (mc *DummyClient) GetApisByIds(ids []string) ([]*Api, error) {
@@ -192,7 +955,125 @@ func (mc *DummyClient) GetApisByIds(ids []string) ([]*Api, error) {
 	defer mc.Mutex.RUnlock()
 	results := []*Api{}
 	for _, id := range ids {
-		results = append(results, mc.IdToApiMap[id])
+		// Like mongodb, skip the unknown IDs
+		if api, found := mc.IdToApiMap[id]; found {
+			results = append(results, copyApi(api))
+		}
 	}
 	return results, nil
 }
+
+// Like the apps, the APIs are copied in and out
+func copyApi(api *Api) *Api {
+	newApi := *api
+	newApi.Tags = append([]string{}, api.Tags...)
+	newApi.Packages = append([]string{}, api.Packages...)
+	newApi.RequiredEnvVarKeys = append([]string{}, api.RequiredEnvVarKeys...)
+	newApi.OptionalEnvVarKeys = append([]string{}, api.OptionalEnvVarKeys...)
+	return &newApi
+}
+
+func (mc *DummyClient) NewApi(api *Api) (*Api, error) {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if api.Id == "" {
+		api.Id = NewApiId()
+	}
+	if _, found := mc.IdToApiMap[api.Id]; found {
+		return nil, ErrorDuplicateAttribute("id")
+	}
+	mc.IdToApiMap[api.Id] = copyApi(api)
+	err := mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func (mc *DummyClient) UpdateApi(api *Api) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.IdToApiMap[api.Id]; !found {
+		return fmt.Errorf("Api %s not found", api.Id)
+	}
+	mc.IdToApiMap[api.Id] = copyApi(api)
+	return mc.save()
+}
+
+func (mc *DummyClient) DeleteApi(id string) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.IdToApiMap[id]; !found {
+		return fmt.Errorf("Api %s not found", id)
+	}
+	delete(mc.IdToApiMap, id)
+	return mc.save()
+}
+
+func copyCollection(collection *Collection) *Collection {
+	newCollection := *collection
+	newCollection.AppIds = append([]string{}, collection.AppIds...)
+	return &newCollection
+}
+
+func (mc *DummyClient) NewCollection(collection *Collection) (*Collection, error) {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	collection.Id = NewCollectionId()
+	collection.CreatedTime = time.Now()
+	mc.IdToCollectionMap[collection.Id] = copyCollection(collection)
+	err := mc.save()
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func (mc *DummyClient) GetCollection(id string) (*Collection, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	collection, found := mc.IdToCollectionMap[id]
+	if !found {
+		return nil, nil
+	}
+	return copyCollection(collection), nil
+}
+
+func (mc *DummyClient) GetCollections() ([]*Collection, error) {
+	mc.Mutex.RLock()
+	defer mc.Mutex.RUnlock()
+	collections := make([]*Collection, 0)
+	for _, collection := range mc.IdToCollectionMap {
+		collections = append(collections, copyCollection(collection))
+	}
+
+	// Like the other clients, the newest comes first
+	SortCollectionsByCreatedTime(collections)
+	return collections, nil
+}
+
+func (mc *DummyClient) UpdateCollection(collection *Collection) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.IdToCollectionMap[collection.Id]; !found {
+		return fmt.Errorf("Collection %s not found", collection.Id)
+	}
+	mc.IdToCollectionMap[collection.Id] = copyCollection(collection)
+	return mc.save()
+}
+
+func (mc *DummyClient) DeleteCollection(id string) error {
+	mc.Mutex.Lock()
+	defer mc.Mutex.Unlock()
+
+	if _, found := mc.IdToCollectionMap[id]; !found {
+		return fmt.Errorf("Collection %s not found", id)
+	}
+	delete(mc.IdToCollectionMap, id)
+	return mc.save()
+}
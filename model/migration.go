@@ -0,0 +1,130 @@
+package model
+
+import (
+	"fmt"
+	"log"
+)
+
+// A versioned change of the schema of a database, e.g., a new index, or a
+// backfill of a new field. The versions of the migrations of a backend start
+// at 1, and the migrations are applied in order.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// Implemented by the clients whose databases have a schema
+type Migrator interface {
+	// All the migrations of the backend, in order
+	Migrations() []Migration
+
+	// The version of the last migration applied to the database, or 0
+	SchemaVersion() (int, error)
+
+	// Apply a migration, and store its version as the schema version
+	ApplyMigration(m Migration) error
+}
+
+type ErrorSchemaBehind struct {
+	Version       int
+	LatestVersion int
+}
+
+func (esb ErrorSchemaBehind) Error() string {
+	return fmt.Sprintf("Database schema version %d is behind the latest version %d", esb.Version, esb.LatestVersion)
+}
+
+func IsSchemaBehindError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorSchemaBehind)
+	return ok
+}
+
+func checkMigrationOrder(migrations []Migration) error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("Migration %q has version %d, expecting %d", m.Description, m.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// Return the migrations not applied to the database yet
+func PendingMigrations(client Client) ([]Migration, error) {
+	migrator, ok := client.(Migrator)
+	if !ok {
+		return []Migration{}, nil
+	}
+
+	migrations := migrator.Migrations()
+	err := checkMigrationOrder(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := migrator.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > len(migrations) {
+		return []Migration{}, nil
+	}
+	return migrations[version:], nil
+}
+
+// Apply the pending migrations in order, and return them. With dryRun, only
+// return them. Stops at the first migration that fails, in which case the
+// schema version is the one of the last migration that succeeded.
+func Migrate(client Client, dryRun bool) ([]Migration, error) {
+	pending, err := PendingMigrations(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		for _, m := range pending {
+			log.Printf("[INFO] Would apply migration %d: %s", m.Version, m.Description)
+		}
+		return pending, nil
+	}
+
+	migrator, _ := client.(Migrator)
+	for i, m := range pending {
+		log.Printf("[INFO] Applying migration %d: %s", m.Version, m.Description)
+		err = migrator.ApplyMigration(m)
+		if err != nil {
+			return pending[:i], fmt.Errorf("Cannot apply migration %d: %s", m.Version, err)
+		}
+	}
+	return pending, nil
+}
+
+// Return ErrorSchemaBehind if the database needs migrations before the
+// client can use it. A schema ahead of the code, e.g., after a rollback, is
+// fine, as the migrations only ever add to it.
+func CheckSchema(client Client) error {
+	migrator, ok := client.(Migrator)
+	if !ok {
+		return nil
+	}
+
+	version, err := migrator.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latestVersion := len(migrator.Migrations())
+	if version < latestVersion {
+		return ErrorSchemaBehind{
+			Version:       version,
+			LatestVersion: latestVersion,
+		}
+	} else if version > latestVersion {
+		log.Printf("[WARNING] Database schema version %d is ahead of the latest version %d", version, latestVersion)
+	}
+	return nil
+}
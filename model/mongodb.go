@@ -1,10 +1,12 @@
 package model
 
 import (
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -20,52 +22,158 @@ func NewMongodbClient(url string) (Client, error) {
 	}
 	session.SetSafe(&mgo.Safe{})
 
-	// Ensure a couple of indices
-	coll := session.DB("").C("Apps")
-	err = coll.EnsureIndex(mgo.Index{
-		Key:        []string{"name"},
-		Unique:     true,
-		Background: false,
-	})
-	if err != nil {
-		return nil, err
-	}
-	err = coll.EnsureIndex(mgo.Index{
-		Key:        []string{"user_id"},
-		Unique:     false,
-		Background: false,
-	})
-	if err != nil {
-		return nil, err
-	}
-	err = coll.EnsureIndex(mgo.Index{
-		Key:        []string{"worktree_id"},
-		Unique:     true,
-		Background: false,
-	})
-	if err != nil {
-		return nil, err
-	}
-	err = coll.EnsureIndex(mgo.Index{
-		Key:        []string{"created_time"},
-		Background: false,
-	})
-	if err != nil {
-		return nil, err
-	}
-	err = coll.EnsureIndex(mgo.Index{
-		Key:        []string{"last_backup_time"},
-		Background: false,
-	})
-	if err != nil {
-		return nil, err
-	}
-
 	return &MongodbClient{
 		session: session,
 	}, nil
 }
 
+type mongodbMigration struct {
+	Migration
+	up func(db *mgo.Database) error
+}
+
+// The migrations of the mongodb database. As mongodb can't apply a migration
+// and store the schema version atomically, a migration must be safe to apply
+// twice.
+var mongodbMigrations = []mongodbMigration{
+	{
+		Migration: Migration{1, "Create the indices of the apps"},
+		up: func(db *mgo.Database) error {
+			coll := db.C("Apps")
+			indices := []mgo.Index{
+				{Key: []string{"name"}, Unique: true},
+				{Key: []string{"user_id"}},
+				{Key: []string{"worktree_id"}, Unique: true},
+				{Key: []string{"created_time"}},
+				{Key: []string{"last_backup_time"}},
+			}
+			for _, index := range indices {
+				err := coll.EnsureIndex(index)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{2, "Set the version of the apps created before versions"},
+		up: func(db *mgo.Database) error {
+			_, err := db.C("Apps").UpdateAll(
+				bson.M{"version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version": 0}},
+			)
+			return err
+		},
+	},
+	{
+		Migration: Migration{3, "Create the index of the deletion time of the apps"},
+		up: func(db *mgo.Database) error {
+			return db.C("Apps").EnsureIndex(mgo.Index{Key: []string{"deleted_time"}})
+		},
+	},
+	{
+		Migration: Migration{4, "Create the index of the app of the snapshots"},
+		up: func(db *mgo.Database) error {
+			return db.C("Snapshots").EnsureIndex(mgo.Index{Key: []string{"app_id"}})
+		},
+	},
+	{
+		Migration: Migration{5, "Create the index of the collaborators of the apps"},
+		up: func(db *mgo.Database) error {
+			return db.C("Apps").EnsureIndex(mgo.Index{Key: []string{"collaborators.user_id"}})
+		},
+	},
+	{
+		Migration: Migration{6, "Create the indices of the teams and their apps"},
+		up: func(db *mgo.Database) error {
+			err := db.C("Apps").EnsureIndex(mgo.Index{Key: []string{"team_id"}})
+			if err != nil {
+				return err
+			}
+			return db.C("Teams").EnsureIndex(mgo.Index{Key: []string{"members.user_id"}})
+		},
+	},
+	{
+		Migration: Migration{7, "Create the index of the APIs of the apps"},
+		up: func(db *mgo.Database) error {
+			return db.C("Apps").EnsureIndex(mgo.Index{Key: []string{"api_ids"}})
+		},
+	},
+	{
+		Migration: Migration{8, "Create the indices of the gallery, and set the fork count of the apps"},
+		up: func(db *mgo.Database) error {
+			// The gallery cursors skip the apps without a fork count
+			_, err := db.C("Apps").UpdateAll(
+				bson.M{"fork_count": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"fork_count": 0}},
+			)
+			if err != nil {
+				return err
+			}
+
+			coll := db.C("Apps")
+			indices := []mgo.Index{
+				{Key: []string{"$text:name", "$text:description"}},
+				{Key: []string{"gallery", "-created_time", "-_id"}},
+				{Key: []string{"gallery", "-fork_count", "-_id"}},
+				{Key: []string{"tags"}},
+			}
+			for _, index := range indices {
+				err := coll.EnsureIndex(index)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func (mc *MongodbClient) Migrations() []Migration {
+	migrations := make([]Migration, len(mongodbMigrations))
+	for i, m := range mongodbMigrations {
+		migrations[i] = m.Migration
+	}
+	return migrations
+}
+
+// The schema version is stored in a document of its own
+func (mc *MongodbClient) SchemaVersion() (int, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Schema")
+	doc := struct {
+		Version int `bson:"version"`
+	}{}
+	err := c.FindId("version").One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return doc.Version, nil
+}
+
+func (mc *MongodbClient) ApplyMigration(m Migration) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	db := session.DB("")
+	for _, mm := range mongodbMigrations {
+		if mm.Version != m.Version {
+			continue
+		}
+
+		err := mm.up(db)
+		if err != nil {
+			return err
+		}
+		_, err = db.C("Schema").UpsertId("version", bson.M{"$set": bson.M{"version": m.Version}})
+		return err
+	}
+	return fmt.Errorf("Unknown migration %d", m.Version)
+}
+
 func (app *App) toBsonMap(fields []string) bson.M {
 	appValue := reflect.ValueOf(app).Elem()
 	appType := appValue.Type()
@@ -87,6 +195,19 @@ func (app *App) toBsonMap(fields []string) bson.M {
 	return m
 }
 
+// Select the apps matching the selector that aren't in the trash. Apps
+// created before the trash have no deleted field at all.
+func liveAppSelector(selector bson.M) bson.M {
+	selector["deleted"] = bson.M{"$ne": true}
+	return selector
+}
+
+// Select the apps matching the selector that are in the trash
+func deletedAppSelector(selector bson.M) bson.M {
+	selector["deleted"] = true
+	return selector
+}
+
 func (mc *MongodbClient) NewApp(app *App) (*App, error) {
 	session := mc.session.Copy()
 	defer session.Close()
@@ -112,26 +233,114 @@ func (mc *MongodbClient) NewApp(app *App) (*App, error) {
 
 func (mc *MongodbClient) UpdateApp(app *App, fields []string) error {
 	updateMap := app.toBsonMap(fields)
-	change := bson.M{"$set": updateMap}
+	change := bson.M{"$set": updateMap, "$inc": bson.M{"version": 1}}
 
 	session := mc.session.Copy()
 	defer session.Close()
 	c := session.DB("").C("Apps")
-	return c.UpdateId(app.Id, change)
+	selector := bson.M{"_id": app.Id, "version": app.Version, "deleted": bson.M{"$ne": true}}
+	err := c.Update(selector, change)
+	if err == mgo.ErrNotFound {
+		// Either the app is gone or in the trash, or its version has
+		// changed
+		n, countErr := c.Find(bson.M{"_id": app.Id, "deleted": bson.M{"$ne": true}}).Count()
+		if countErr != nil {
+			return countErr
+		} else if n > 0 {
+			return ErrorVersionConflict(app.Id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	app.Version++
+	return nil
 }
 
-func (mc *MongodbClient) UpdateAppName(app *App, newName string) error {
-	change := bson.M{"$set": bson.M{"name": newName}}
+// Apply an atomic change to the app, and reload it. The selector is narrowed
+// to the version of the app, and to apps out of the trash. Return
+// mgo.ErrNotFound if the app is gone, or the rest of the selector doesn't
+// match.
+func (mc *MongodbClient) changeApp(app *App, selector bson.M, change bson.M) error {
+	change["$inc"] = bson.M{"version": 1}
+	selector["version"] = app.Version
+	selector["deleted"] = bson.M{"$ne": true}
 
 	session := mc.session.Copy()
 	defer session.Close()
 	c := session.DB("").C("Apps")
-	err := c.UpdateId(app.Id, change)
+	err := c.Update(selector, change)
+	if err == mgo.ErrNotFound {
+		current := App{}
+		findErr := c.Find(bson.M{"_id": app.Id, "deleted": bson.M{"$ne": true}}).One(&current)
+		if findErr != nil && findErr != mgo.ErrNotFound {
+			return findErr
+		} else if findErr == nil && current.Version != app.Version {
+			return ErrorVersionConflict(app.Id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	q := c.FindId(app.Id)
+	return q.One(app)
+}
 
-	if err == nil {
-		app.Name = newName
+func (mc *MongodbClient) SetAppEnvVar(app *App, key string, value string) error {
+	// Replace the value if the key exists, otherwise add it. As both are
+	// pinned to the version of the app, neither matches only if the app is
+	// gone or in the trash.
+	err := mc.changeApp(app,
+		bson.M{"_id": app.Id, "env_vars.key": key},
+		bson.M{"$set": bson.M{"env_vars.$.value": value}})
+	if err != mgo.ErrNotFound {
+		return err
 	}
 
+	return mc.changeApp(app,
+		bson.M{"_id": app.Id, "env_vars.key": bson.M{"$ne": key}},
+		bson.M{"$push": bson.M{"env_vars": KeyValuePair{Key: key, Value: value}}})
+}
+
+func (mc *MongodbClient) RemoveAppEnvVar(app *App, key string) error {
+	return mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$pull": bson.M{"env_vars": bson.M{"key": key}}})
+}
+
+func (mc *MongodbClient) AddAppApiId(app *App, apiId string) error {
+	return mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$addToSet": bson.M{"api_ids": apiId}})
+}
+
+func (mc *MongodbClient) RemoveAppApiId(app *App, apiId string) error {
+	return mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$pull": bson.M{"api_ids": apiId}})
+}
+
+func (mc *MongodbClient) SetAppCollaborator(app *App, userId string, role string) error {
+	// Like SetAppEnvVar, change the role if the user is a collaborator
+	// already, otherwise add one
+	err := mc.changeApp(app,
+		bson.M{"_id": app.Id, "collaborators.user_id": userId},
+		bson.M{"$set": bson.M{"collaborators.$.role": role}})
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	return mc.changeApp(app,
+		bson.M{"_id": app.Id, "collaborators.user_id": bson.M{"$ne": userId}},
+		bson.M{"$push": bson.M{"collaborators": Collaborator{UserId: userId, Role: role}}})
+}
+
+func (mc *MongodbClient) RemoveAppCollaborator(app *App, userId string) error {
+	return mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$pull": bson.M{"collaborators": bson.M{"user_id": userId}}})
+}
+
+func (mc *MongodbClient) UpdateAppName(app *App, newName string) error {
+	err := mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$set": bson.M{"name": newName}})
 	if mgo.IsDup(err) {
 		return ErrorDuplicateAttribute("name")
 	} else {
@@ -140,17 +349,8 @@ func (mc *MongodbClient) UpdateAppName(app *App, newName string) error {
 }
 
 func (mc *MongodbClient) UpdateAppDescription(app *App, newDescription string) error {
-	change := bson.M{"$set": bson.M{"description": newDescription}}
-
-	session := mc.session.Copy()
-	defer session.Close()
-	c := session.DB("").C("Apps")
-	err := c.UpdateId(app.Id, change)
-	if err == nil {
-		app.Description = newDescription
-	}
-
-	return err
+	return mc.changeApp(app, bson.M{"_id": app.Id},
+		bson.M{"$set": bson.M{"description": newDescription}})
 }
 
 func (mc *MongodbClient) UpdateAppSourceTimestamp(app *App) error {
@@ -183,7 +383,7 @@ func (mc *MongodbClient) GetApp(id string) (*App, error) {
 	session := mc.session.Copy()
 	defer session.Close()
 	c := session.DB("").C("Apps")
-	q := c.FindId(id)
+	q := c.Find(liveAppSelector(bson.M{"_id": id}))
 	app := &App{}
 	err := q.One(app)
 	if err != nil {
@@ -204,7 +404,7 @@ func (mc *MongodbClient) GetAppByName(name string) (*App, error) {
 	app := &App{
 		Name: name,
 	}
-	q := c.Find(app.toBsonMap([]string{"Name"}))
+	q := c.Find(liveAppSelector(app.toBsonMap([]string{"Name"})))
 	err := q.One(app)
 	if err != nil {
 		if err == mgo.ErrNotFound {
@@ -224,7 +424,49 @@ func (mc *MongodbClient) GetAppsByUserId(userId string) ([]*App, error) {
 	app := &App{
 		UserId: userId,
 	}
-	q := c.Find(app.toBsonMap([]string{"UserId"}))
+	q := c.Find(liveAppSelector(app.toBsonMap([]string{"UserId"})))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
+
+func (mc *MongodbClient) GetAppsByCollaboratorId(userId string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(liveAppSelector(bson.M{"collaborators.user_id": userId}))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
+
+func (mc *MongodbClient) GetAppsByTeamId(teamId string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(liveAppSelector(bson.M{"team_id": teamId}))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
+
+func (mc *MongodbClient) GetAppsByApiId(apiId string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(liveAppSelector(bson.M{"api_ids": apiId}))
 	apps := []*App{}
 	err := q.All(&apps)
 	if err != nil {
@@ -241,7 +483,7 @@ func (mc *MongodbClient) GetAppByWorktreeId(worktreeId string) (*App, error) {
 	app := &App{
 		WorktreeId: worktreeId,
 	}
-	q := c.Find(app.toBsonMap([]string{"WorktreeId"}))
+	q := c.Find(liveAppSelector(app.toBsonMap([]string{"WorktreeId"})))
 	err := q.One(app)
 	if err != nil {
 		if err == mgo.ErrNotFound {
@@ -255,22 +497,104 @@ func (mc *MongodbClient) GetAppByWorktreeId(worktreeId string) (*App, error) {
 }
 
 func (mc *MongodbClient) DeleteApp(id string) error {
+	change := bson.M{
+		"$set": bson.M{"deleted": true, "deleted_time": time.Now()},
+		"$inc": bson.M{"version": 1},
+	}
+
 	session := mc.session.Copy()
 	defer session.Close()
 	c := session.DB("").C("Apps")
-	return c.RemoveId(id)
+	return c.Update(liveAppSelector(bson.M{"_id": id}), change)
 }
 
-func (mc *MongodbClient) GetGalleryApps(limit int) ([]*App, error) {
+func (mc *MongodbClient) RestoreApp(id string) (*App, error) {
+	change := bson.M{
+		"$set":   bson.M{"deleted": false},
+		"$unset": bson.M{"deleted_time": ""},
+		"$inc":   bson.M{"version": 1},
+	}
+
 	session := mc.session.Copy()
 	defer session.Close()
 	c := session.DB("").C("Apps")
-	q := c.Find(
-		bson.M{
-			"gallery": true,
-		},
-	).Sort("-created_time").Limit(limit)
+	err := c.Update(deletedAppSelector(bson.M{"_id": id}), change)
+	if err != nil {
+		return nil, err
+	}
+
+	app := &App{}
+	err = c.FindId(id).One(app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (mc *MongodbClient) PurgeApp(id string, deletedBefore time.Time) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	err := c.Remove(deletedAppSelector(bson.M{"_id": id, "deleted_time": bson.M{"$lt": deletedBefore}}))
+	if err != nil {
+		return err
+	}
+
+	_, err = session.DB("").C("Snapshots").RemoveAll(bson.M{"app_id": id})
+	return err
+}
+
+func (mc *MongodbClient) GetDeletedApp(id string) (*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(deletedAppSelector(bson.M{"_id": id}))
+	app := &App{}
+	err := q.One(app)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return app, nil
+	}
+}
+
+func (mc *MongodbClient) GetDeletedAppsByUserId(userId string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(deletedAppSelector(bson.M{"user_id": userId}))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
+
+func (mc *MongodbClient) GetDeletedAppsByTeamId(teamId string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(deletedAppSelector(bson.M{"team_id": teamId}))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
 
+func (mc *MongodbClient) GetAppsDeletedBefore(t time.Time) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(deletedAppSelector(bson.M{"deleted_time": bson.M{"$lt": t}}))
 	apps := []*App{}
 	err := q.All(&apps)
 	if err != nil {
@@ -280,6 +604,215 @@ func (mc *MongodbClient) GetGalleryApps(limit int) ([]*App, error) {
 	}
 }
 
+func (mc *MongodbClient) NewSnapshot(snapshot *Snapshot) (*Snapshot, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Snapshots")
+
+	snapshot.Id = NewSnapshotId()
+	snapshot.CreatedTime = time.Now()
+	err := c.Insert(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (mc *MongodbClient) GetSnapshot(id string) (*Snapshot, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Snapshots")
+	q := c.FindId(id)
+	snapshot := &Snapshot{}
+	err := q.One(snapshot)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return snapshot, nil
+	}
+}
+
+func (mc *MongodbClient) GetSnapshotsByAppId(appId string) ([]*Snapshot, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Snapshots")
+	q := c.Find(bson.M{"app_id": appId}).Sort("-created_time")
+	snapshots := []*Snapshot{}
+	err := q.All(&snapshots)
+	if err != nil {
+		return nil, err
+	} else {
+		return snapshots, nil
+	}
+}
+
+func (mc *MongodbClient) DeleteSnapshot(id string) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Snapshots")
+	return c.RemoveId(id)
+}
+
+func (mc *MongodbClient) NewTeam(team *Team) (*Team, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Teams")
+
+	team.Id = NewTeamId()
+	team.CreatedTime = time.Now()
+	err := c.Insert(team)
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (mc *MongodbClient) GetTeam(id string) (*Team, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Teams")
+	q := c.FindId(id)
+	team := &Team{}
+	err := q.One(team)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return team, nil
+	}
+}
+
+func (mc *MongodbClient) GetTeamsByUserId(userId string) ([]*Team, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Teams")
+	q := c.Find(bson.M{"members.user_id": userId})
+	teams := []*Team{}
+	err := q.All(&teams)
+	if err != nil {
+		return nil, err
+	} else {
+		return teams, nil
+	}
+}
+
+// Apply an atomic change to the team, and reload it
+func (mc *MongodbClient) changeTeam(team *Team, selector bson.M, change bson.M) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Teams")
+	err := c.Update(selector, change)
+	if err != nil {
+		return err
+	}
+	q := c.FindId(team.Id)
+	return q.One(team)
+}
+
+func (mc *MongodbClient) SetTeamMember(team *Team, userId string, role string) error {
+	for {
+		// Like SetAppCollaborator
+		err := mc.changeTeam(team,
+			bson.M{"_id": team.Id, "members.user_id": userId},
+			bson.M{"$set": bson.M{"members.$.role": role}})
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		err = mc.changeTeam(team,
+			bson.M{"_id": team.Id, "members.user_id": bson.M{"$ne": userId}},
+			bson.M{"$push": bson.M{"members": TeamMember{UserId: userId, Role: role}}})
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		existingTeam, err := mc.GetTeam(team.Id)
+		if err != nil {
+			return err
+		} else if existingTeam == nil {
+			return mgo.ErrNotFound
+		}
+	}
+}
+
+func (mc *MongodbClient) RemoveTeamMember(team *Team, userId string) error {
+	return mc.changeTeam(team, bson.M{"_id": team.Id},
+		bson.M{"$pull": bson.M{"members": bson.M{"user_id": userId}}})
+}
+
+func (mc *MongodbClient) GetAppsByIds(ids []string) ([]*App, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(liveAppSelector(bson.M{"_id": bson.M{"$in": ids}}))
+	apps := []*App{}
+	err := q.All(&apps)
+	if err != nil {
+		return nil, err
+	} else {
+		return apps, nil
+	}
+}
+
+func (mc *MongodbClient) GetGalleryApps(query GalleryQuery) ([]*App, string, error) {
+	cursor, err := query.decodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	selector := liveAppSelector(bson.M{"gallery": true})
+	if query.Tag != "" {
+		selector["tags"] = query.Tag
+	}
+	if words := query.searchWords(); len(words) > 0 {
+		// Quoted, all the words must match
+		selector["$text"] = bson.M{"$search": "\"" + strings.Join(words, "\" \"") + "\""}
+	}
+
+	sortField := "created_time"
+	if query.Sort == GallerySortPopular {
+		sortField = "fork_count"
+	}
+	if cursor != nil {
+		var cursorKey interface{} = cursor.Key
+		if sortField == "created_time" {
+			cursorKey = gallerySortKeyTime(cursor.Key)
+		}
+		selector["$or"] = []bson.M{
+			{sortField: bson.M{"$lt": cursorKey}},
+			{sortField: cursorKey, "_id": bson.M{"$lt": cursor.Id}},
+		}
+	}
+
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	q := c.Find(selector).Sort("-"+sortField, "-_id").Limit(query.Limit + 1)
+
+	apps := []*App{}
+	err = q.All(&apps)
+	if err != nil {
+		return nil, "", err
+	}
+
+	apps, nextCursor := query.page(apps)
+	return apps, nextCursor, nil
+}
+
+func (mc *MongodbClient) IncrementAppForkCount(id string) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apps")
+	return c.UpdateId(id, bson.M{"$inc": bson.M{"fork_count": 1}})
+}
+
 func (mc *MongodbClient) GetApis() ([]*Api, error) {
 	session := mc.session.Copy()
 	defer session.Close()
@@ -325,3 +858,94 @@ func (mc *MongodbClient) GetApisByIds(ids []string) ([]*Api, error) {
 		return apis, nil
 	}
 }
+
+func (mc *MongodbClient) NewApi(api *Api) (*Api, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apis")
+
+	if api.Id == "" {
+		api.Id = NewApiId()
+	}
+	err := c.Insert(api)
+	if mgo.IsDup(err) {
+		return nil, ErrorDuplicateAttribute("id")
+	} else if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func (mc *MongodbClient) UpdateApi(api *Api) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apis")
+	return c.UpdateId(api.Id, api)
+}
+
+func (mc *MongodbClient) DeleteApi(id string) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Apis")
+	return c.RemoveId(id)
+}
+
+func (mc *MongodbClient) NewCollection(collection *Collection) (*Collection, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Collections")
+
+	collection.Id = NewCollectionId()
+	collection.CreatedTime = time.Now()
+	err := c.Insert(collection)
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func (mc *MongodbClient) GetCollection(id string) (*Collection, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Collections")
+	q := c.FindId(id)
+	collection := &Collection{}
+	err := q.One(collection)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return collection, nil
+	}
+}
+
+func (mc *MongodbClient) GetCollections() ([]*Collection, error) {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Collections")
+	q := c.Find(nil).Sort("-created_time")
+	collections := []*Collection{}
+	err := q.All(&collections)
+	if err != nil {
+		return nil, err
+	} else {
+		return collections, nil
+	}
+}
+
+func (mc *MongodbClient) UpdateCollection(collection *Collection) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Collections")
+	return c.UpdateId(collection.Id, collection)
+}
+
+func (mc *MongodbClient) DeleteCollection(id string) error {
+	session := mc.session.Copy()
+	defer session.Close()
+	c := session.DB("").C("Collections")
+	return c.RemoveId(id)
+}
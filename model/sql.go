@@ -0,0 +1,1631 @@
+package model
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Relational implementation of the client. Supports SQLite (driver "sqlite3")
+// for local development, and Postgres (driver "postgres"). The tables are
+// created by the migrations, see Migrate.
+type SqlClient struct {
+	UserClient
+	db     *sql.DB
+	driver string
+}
+
+type sqlMigration struct {
+	Migration
+	up func(sc *SqlClient, tx *sql.Tx) error
+}
+
+// Return a migration running the given statements. {{time}} in them is
+// replaced with the type of the time columns, which differs between the
+// databases.
+func sqlStatements(stmts ...string) func(sc *SqlClient, tx *sql.Tx) error {
+	return func(sc *SqlClient, tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(strings.Replace(stmt, "{{time}}", sc.timeType(), -1))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// The migrations of the SQL databases. Each runs in a transaction together
+// with storing the schema version.
+var sqlMigrations = []sqlMigration{
+	{
+		Migration: Migration{1, "Create the tables of the apps and the APIs"},
+		up:        sqlStatements(sqlInitialSchema...),
+	},
+	{
+		Migration: Migration{2, "Add the trash of the apps"},
+		up: sqlStatements(
+			`ALTER TABLE apps ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE apps ADD COLUMN deleted_time {{time}}`,
+			`CREATE INDEX IF NOT EXISTS apps_deleted_time ON apps (deleted_time)`,
+		),
+	},
+	{
+		Migration: Migration{3, "Create the table of the snapshots"},
+		up: sqlStatements(
+			`CREATE TABLE IF NOT EXISTS snapshots (
+				id TEXT PRIMARY KEY,
+				app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				worktree_id TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				created_time {{time}} NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS snapshots_app_id ON snapshots (app_id)`,
+		),
+	},
+	{
+		Migration: Migration{4, "Create the table of the collaborators of the apps"},
+		up: sqlStatements(
+			`CREATE TABLE IF NOT EXISTS app_collaborators (
+				app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+				idx INTEGER NOT NULL,
+				user_id TEXT NOT NULL,
+				role TEXT NOT NULL,
+				PRIMARY KEY (app_id, user_id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS app_collaborators_user_id ON app_collaborators (user_id)`,
+		),
+	},
+	{
+		Migration: Migration{5, "Create the tables of the teams, and add the team of the apps"},
+		up: sqlStatements(
+			`CREATE TABLE IF NOT EXISTS teams (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				created_time {{time}} NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS team_members (
+				team_id TEXT NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+				idx INTEGER NOT NULL,
+				user_id TEXT NOT NULL,
+				role TEXT NOT NULL,
+				PRIMARY KEY (team_id, user_id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS team_members_user_id ON team_members (user_id)`,
+			`ALTER TABLE apps ADD COLUMN team_id TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS apps_team_id ON apps (team_id)`,
+		),
+	},
+	{
+		Migration: Migration{6, "Add the deprecation of the APIs"},
+		up: sqlStatements(
+			`ALTER TABLE apis ADD COLUMN deprecated BOOLEAN NOT NULL DEFAULT FALSE`,
+			`CREATE INDEX IF NOT EXISTS app_apis_api_id ON app_apis (api_id)`,
+		),
+	},
+	{
+		Migration: Migration{7, "Add the tags, the fork count and the featured collections of the gallery"},
+		up: sqlStatements(
+			`ALTER TABLE apps ADD COLUMN fork_count BIGINT NOT NULL DEFAULT 0`,
+			`CREATE INDEX IF NOT EXISTS apps_gallery_fork_count ON apps (gallery, fork_count)`,
+			`CREATE TABLE IF NOT EXISTS app_tags (
+				app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+				idx INTEGER NOT NULL,
+				tag TEXT NOT NULL,
+				PRIMARY KEY (app_id, tag)
+			)`,
+			`CREATE INDEX IF NOT EXISTS app_tags_tag ON app_tags (tag)`,
+			`CREATE TABLE IF NOT EXISTS collections (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL,
+				created_time {{time}} NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS collection_apps (
+				collection_id TEXT NOT NULL REFERENCES collections (id) ON DELETE CASCADE,
+				idx INTEGER NOT NULL,
+				app_id TEXT NOT NULL,
+				PRIMARY KEY (collection_id, idx)
+			)`,
+		),
+	},
+}
+
+// The tables as of the first migration
+var sqlInitialSchema = []string{
+	`CREATE TABLE IF NOT EXISTS apps (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		worktree_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		description TEXT NOT NULL,
+		icon TEXT NOT NULL,
+		created_time {{time}} NOT NULL,
+		accessed_time {{time}} NOT NULL,
+		private BOOLEAN NOT NULL,
+		runtime TEXT NOT NULL,
+		start_cmd TEXT NOT NULL,
+		gallery BOOLEAN NOT NULL,
+		idle_policy TEXT NOT NULL,
+		idle_timeout BIGINT NOT NULL,
+		limit_cpu_millis BIGINT NOT NULL,
+		limit_memory_mb BIGINT NOT NULL,
+		limit_disk_mb BIGINT NOT NULL,
+		limit_max_processes BIGINT NOT NULL,
+		source_timestamp BIGINT NOT NULL,
+		running_timestamp BIGINT NOT NULL,
+		version BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS apps_user_id ON apps (user_id)`,
+	`CREATE INDEX IF NOT EXISTS apps_created_time ON apps (created_time)`,
+	`CREATE TABLE IF NOT EXISTS app_env_vars (
+		app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+		idx INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (app_id, idx),
+		UNIQUE (app_id, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS app_apis (
+		app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+		idx INTEGER NOT NULL,
+		api_id TEXT NOT NULL,
+		PRIMARY KEY (app_id, api_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS apis (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		logo_url TEXT NOT NULL,
+		description TEXT NOT NULL,
+		portal_url TEXT NOT NULL,
+		tags TEXT NOT NULL,
+		packages TEXT NOT NULL,
+		required_env_var_keys TEXT NOT NULL,
+		optional_env_var_keys TEXT NOT NULL,
+		snippet TEXT NOT NULL
+	)`,
+}
+
+const sqlAppColumns = `id, name, worktree_id, user_id, description, icon, created_time, accessed_time,
+	private, runtime, start_cmd, gallery, idle_policy, idle_timeout, limit_cpu_millis, limit_memory_mb,
+	limit_disk_mb, limit_max_processes, source_timestamp, running_timestamp, version, deleted, deleted_time, team_id,
+	fork_count`
+
+const sqlSnapshotColumns = `id, app_id, name, worktree_id, user_id, created_time`
+
+const sqlTeamColumns = `id, name, created_time`
+
+const sqlCollectionColumns = `id, name, description, created_time`
+
+const sqlApiColumns = `id, name, logo_url, description, portal_url, tags, packages, required_env_var_keys,
+	optional_env_var_keys, snippet, deprecated`
+
+// Columns of the App fields that UpdateApp can set directly. EnvVars, ApiIds,
+// Collaborators, Tags and Limits are handled separately.
+var sqlAppFieldColumns = map[string]string{
+	"Description":      "description",
+	"Icon":             "icon",
+	"UserId":           "user_id",
+	"TeamId":           "team_id",
+	"Name":             "name",
+	"WorktreeId":       "worktree_id",
+	"CreatedTime":      "created_time",
+	"AccessedTime":     "accessed_time",
+	"Private":          "private",
+	"Runtime":          "runtime",
+	"StartCmd":         "start_cmd",
+	"Gallery":          "gallery",
+	"IdlePolicy":       "idle_policy",
+	"IdleTimeout":      "idle_timeout",
+	"SourceTimestamp":  "source_timestamp",
+	"RunningTimestamp": "running_timestamp",
+	"ForkCount":        "fork_count",
+}
+
+// Either a *sql.DB or a *sql.Tx
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func NewSqlClient(driver string, dataSource string) (Client, error) {
+	if driver != "sqlite3" && driver != "postgres" {
+		return nil, fmt.Errorf("Unsupported SQL driver %s", driver)
+	}
+
+	if driver == "sqlite3" {
+		// SQLite only enforces the foreign keys, and so runs the cascades,
+		// on the connections that ask for it
+		dataSource = sqliteForeignKeysDataSource(dataSource)
+	}
+
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+
+		// Older drivers ignore the parameter they don't know
+		enabled := false
+		err = db.QueryRow("PRAGMA foreign_keys").Scan(&enabled)
+		if err == nil && !enabled {
+			err = fmt.Errorf("Cannot enable the foreign keys of SQLite")
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// A row for every migration applied. The tables themselves are
+	// created by the migrations.
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_versions (version INTEGER PRIMARY KEY)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SqlClient{
+		db:     db,
+		driver: driver,
+	}, nil
+}
+
+func sqliteForeignKeysDataSource(dataSource string) string {
+	if strings.Contains(dataSource, "?") {
+		return dataSource + "&_foreign_keys=1"
+	}
+	return dataSource + "?_foreign_keys=1"
+}
+
+func (sc *SqlClient) timeType() string {
+	if sc.driver == "postgres" {
+		return "TIMESTAMP WITH TIME ZONE"
+	}
+	return "TIMESTAMP"
+}
+
+func (sc *SqlClient) Migrations() []Migration {
+	migrations := make([]Migration, len(sqlMigrations))
+	for i, m := range sqlMigrations {
+		migrations[i] = m.Migration
+	}
+	return migrations
+}
+
+func (sc *SqlClient) SchemaVersion() (int, error) {
+	version := 0
+	err := sc.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_versions").Scan(&version)
+	return version, err
+}
+
+func (sc *SqlClient) ApplyMigration(m Migration) error {
+	for _, sm := range sqlMigrations {
+		if sm.Version != m.Version {
+			continue
+		}
+
+		tx, err := sc.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = sm.up(sc, tx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sc.rebind("INSERT INTO schema_versions (version) VALUES (?)"), m.Version)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	return fmt.Errorf("Unknown migration %d", m.Version)
+}
+
+// Replace the ? placeholders with the ones of the database
+func (sc *SqlClient) rebind(query string) string {
+	if sc.driver != "postgres" {
+		return query
+	}
+
+	buf := bytes.Buffer{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&buf, "$%d", n)
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// Return the column of the unique constraint an error violates, if any
+func sqlDuplicateColumn(err error) (string, bool) {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		if e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			// The message looks like "UNIQUE constraint failed: apps.name"
+			msg := e.Error()
+			return msg[strings.LastIndex(msg, ".")+1:], true
+		}
+	case *pq.Error:
+		if e.Code == "23505" {
+			// Postgres names the constraints like "apps_name_key"
+			return strings.TrimSuffix(strings.TrimPrefix(e.Constraint, e.Table+"_"), "_key"), true
+		}
+	}
+	return "", false
+}
+
+func sqlAppValues(app *App) []interface{} {
+	// The deletion time is NULL for the apps not in the trash
+	var deletedTime interface{}
+	if app.Deleted {
+		deletedTime = app.DeletedTime
+	}
+
+	return []interface{}{
+		app.Id, app.Name, app.WorktreeId, app.UserId, app.Description, app.Icon, app.CreatedTime,
+		app.AccessedTime, app.Private, app.Runtime, app.StartCmd, app.Gallery, app.IdlePolicy,
+		app.IdleTimeout, app.Limits.CpuMillis, app.Limits.MemoryMB, app.Limits.DiskMB,
+		app.Limits.MaxProcesses, app.SourceTimestamp, app.RunningTimestamp, app.Version,
+		app.Deleted, deletedTime, app.TeamId, app.ForkCount,
+	}
+}
+
+func sqlScanApp(s sqlScanner) (*App, error) {
+	app := &App{}
+	var deletedTime *time.Time
+	err := s.Scan(&app.Id, &app.Name, &app.WorktreeId, &app.UserId, &app.Description, &app.Icon,
+		&app.CreatedTime, &app.AccessedTime, &app.Private, &app.Runtime, &app.StartCmd, &app.Gallery,
+		&app.IdlePolicy, &app.IdleTimeout, &app.Limits.CpuMillis, &app.Limits.MemoryMB,
+		&app.Limits.DiskMB, &app.Limits.MaxProcesses, &app.SourceTimestamp, &app.RunningTimestamp,
+		&app.Version, &app.Deleted, &deletedTime, &app.TeamId,
+		&app.ForkCount)
+	if err != nil {
+		return nil, err
+	}
+	if deletedTime != nil {
+		app.DeletedTime = *deletedTime
+	}
+	return app, nil
+}
+
+func (sc *SqlClient) setAppEnvVars(q sqlQuerier, appId string, envVars []KeyValuePair) error {
+	_, err := q.Exec(sc.rebind("DELETE FROM app_env_vars WHERE app_id = ?"), appId)
+	if err != nil {
+		return err
+	}
+
+	for i, kv := range envVars {
+		_, err = q.Exec(sc.rebind("INSERT INTO app_env_vars (app_id, idx, key, value) VALUES (?, ?, ?, ?)"),
+			appId, i, kv.Key, kv.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *SqlClient) setAppApiIds(q sqlQuerier, appId string, apiIds []string) error {
+	_, err := q.Exec(sc.rebind("DELETE FROM app_apis WHERE app_id = ?"), appId)
+	if err != nil {
+		return err
+	}
+
+	for i, apiId := range apiIds {
+		_, err = q.Exec(sc.rebind("INSERT INTO app_apis (app_id, idx, api_id) VALUES (?, ?, ?)"),
+			appId, i, apiId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *SqlClient) setAppCollaborators(q sqlQuerier, appId string, collaborators []Collaborator) error {
+	_, err := q.Exec(sc.rebind("DELETE FROM app_collaborators WHERE app_id = ?"), appId)
+	if err != nil {
+		return err
+	}
+
+	for i, collaborator := range collaborators {
+		_, err = q.Exec(sc.rebind("INSERT INTO app_collaborators (app_id, idx, user_id, role) VALUES (?, ?, ?, ?)"),
+			appId, i, collaborator.UserId, collaborator.Role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *SqlClient) setAppTags(q sqlQuerier, appId string, tags []string) error {
+	_, err := q.Exec(sc.rebind("DELETE FROM app_tags WHERE app_id = ?"), appId)
+	if err != nil {
+		return err
+	}
+
+	for i, tag := range tags {
+		_, err = q.Exec(sc.rebind("INSERT INTO app_tags (app_id, idx, tag) VALUES (?, ?, ?)"),
+			appId, i, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fill in the env vars, API IDs, collaborators and tags of the apps
+func (sc *SqlClient) loadAppChildren(q sqlQuerier, apps []*App) error {
+	for _, app := range apps {
+		app.EnvVars = []KeyValuePair{}
+		rows, err := q.Query(sc.rebind("SELECT key, value FROM app_env_vars WHERE app_id = ? ORDER BY idx"), app.Id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			kv := KeyValuePair{}
+			err = rows.Scan(&kv.Key, &kv.Value)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			app.EnvVars = append(app.EnvVars, kv)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		app.ApiIds = []string{}
+		rows, err = q.Query(sc.rebind("SELECT api_id FROM app_apis WHERE app_id = ? ORDER BY idx"), app.Id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			apiId := ""
+			err = rows.Scan(&apiId)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			app.ApiIds = append(app.ApiIds, apiId)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		app.Collaborators = []Collaborator{}
+		rows, err = q.Query(sc.rebind("SELECT user_id, role FROM app_collaborators WHERE app_id = ? ORDER BY idx"),
+			app.Id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			collaborator := Collaborator{}
+			err = rows.Scan(&collaborator.UserId, &collaborator.Role)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			app.Collaborators = append(app.Collaborators, collaborator)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		app.Tags = []string{}
+		rows, err = q.Query(sc.rebind("SELECT tag FROM app_tags WHERE app_id = ? ORDER BY idx"), app.Id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			tag := ""
+			err = rows.Scan(&tag)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			app.Tags = append(app.Tags, tag)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the apps matching a condition, e.g., "user_id = ?"
+func (sc *SqlClient) queryApps(cond string, args ...interface{}) ([]*App, error) {
+	rows, err := sc.db.Query(sc.rebind("SELECT "+sqlAppColumns+" FROM apps WHERE "+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read all the rows before loading the children, as SQLite only has
+	// one connection
+	apps := []*App{}
+	for rows.Next() {
+		app, err := sqlScanApp(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = sc.loadAppChildren(sc.db, apps)
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// Read the app matching a condition. Return nil if there is none.
+func (sc *SqlClient) queryApp(cond string, args ...interface{}) (*App, error) {
+	apps, err := sc.queryApps(cond, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(apps) == 0 {
+		return nil, nil
+	}
+	return apps[0], nil
+}
+
+func (sc *SqlClient) insertApp(app *App) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sc.rebind("INSERT INTO apps ("+sqlAppColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		sqlAppValues(app)...)
+	if err != nil {
+		return err
+	}
+
+	err = sc.setAppEnvVars(tx, app.Id, app.EnvVars)
+	if err != nil {
+		return err
+	}
+
+	err = sc.setAppApiIds(tx, app.Id, app.ApiIds)
+	if err != nil {
+		return err
+	}
+
+	err = sc.setAppCollaborators(tx, app.Id, app.Collaborators)
+	if err != nil {
+		return err
+	}
+
+	err = sc.setAppTags(tx, app.Id, app.Tags)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (sc *SqlClient) NewApp(app *App) (*App, error) {
+	currentTime := time.Now()
+
+	app.Id = NewAppId()
+	app.CreatedTime = currentTime
+	app.AccessedTime = currentTime
+
+	for {
+		app.Name = NewAppName()
+		err := sc.insertApp(app)
+		if err == nil {
+			break
+		}
+
+		// Try another name if the name is taken
+		column, dup := sqlDuplicateColumn(err)
+		if !dup {
+			return nil, err
+		} else if column != "name" {
+			return nil, ErrorDuplicateAttribute(column)
+		}
+	}
+
+	return app, nil
+}
+
+func (sc *SqlClient) UpdateApp(app *App, fields []string) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	appValue := reflect.ValueOf(app).Elem()
+	sets := []string{"version = version + 1"}
+	values := []interface{}{}
+	for _, field := range fields {
+		switch field {
+		case "EnvVars", "ApiIds", "Collaborators", "Tags":
+			// Set after the version is checked
+		case "Limits":
+			sets = append(sets, "limit_cpu_millis = ?", "limit_memory_mb = ?", "limit_disk_mb = ?",
+				"limit_max_processes = ?")
+			values = append(values, app.Limits.CpuMillis, app.Limits.MemoryMB, app.Limits.DiskMB,
+				app.Limits.MaxProcesses)
+		default:
+			column, found := sqlAppFieldColumns[field]
+			if !found {
+				log.Panic("Unexpected field", field)
+			}
+			sets = append(sets, column+" = ?")
+			values = append(values, appValue.FieldByName(field).Interface())
+		}
+	}
+
+	values = append(values, app.Id, app.Version)
+	result, err := tx.Exec(sc.rebind("UPDATE apps SET "+strings.Join(sets, ", ")+
+		" WHERE id = ? AND version = ? AND NOT deleted"), values...)
+	if column, dup := sqlDuplicateColumn(err); dup {
+		return ErrorDuplicateAttribute(column)
+	} else if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sc.appUpdateError(tx, app.Id)
+	}
+
+	for _, field := range fields {
+		if field == "EnvVars" {
+			err = sc.setAppEnvVars(tx, app.Id, app.EnvVars)
+		} else if field == "ApiIds" {
+			err = sc.setAppApiIds(tx, app.Id, app.ApiIds)
+		} else if field == "Collaborators" {
+			err = sc.setAppCollaborators(tx, app.Id, app.Collaborators)
+		} else if field == "Tags" {
+			err = sc.setAppTags(tx, app.Id, app.Tags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	app.Version++
+	return nil
+}
+
+// Tell why an update of an app matched no row: either the app is gone or in
+// the trash, or its version has changed. Ask within the transaction, as
+// SQLite only has one connection.
+func (sc *SqlClient) appUpdateError(tx *sql.Tx, id string) error {
+	n := 0
+	err := tx.QueryRow(sc.rebind("SELECT COUNT(*) FROM apps WHERE id = ? AND NOT deleted"), id).Scan(&n)
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return ErrorVersionConflict(id)
+	}
+	return sql.ErrNoRows
+}
+
+// Apply an atomic change to the env vars, APIs or collaborators of the app,
+// and reload it.
+// Bumping the version first also locks the app until the change is
+// committed.
+func (sc *SqlClient) changeApp(app *App, change func(tx *sql.Tx) error) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(sc.rebind("UPDATE apps SET version = version + 1 WHERE id = ? AND version = ? AND NOT deleted"),
+		app.Id, app.Version)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sc.appUpdateError(tx, app.Id)
+	}
+
+	err = change(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return sc.reloadApp(app)
+}
+
+func (sc *SqlClient) SetAppEnvVar(app *App, key string, value string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		result, err := tx.Exec(sc.rebind("UPDATE app_env_vars SET value = ? WHERE app_id = ? AND key = ?"),
+			value, app.Id, key)
+		if err != nil {
+			return err
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.Exec(sc.rebind(`INSERT INTO app_env_vars (app_id, idx, key, value)
+			SELECT ?, COALESCE(MAX(idx) + 1, 0), ?, ? FROM app_env_vars WHERE app_id = ?`),
+			app.Id, key, value, app.Id)
+		return err
+	})
+}
+
+func (sc *SqlClient) RemoveAppEnvVar(app *App, key string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("DELETE FROM app_env_vars WHERE app_id = ? AND key = ?"), app.Id, key)
+		return err
+	})
+}
+
+func (sc *SqlClient) AddAppApiId(app *App, apiId string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		n := 0
+		err := tx.QueryRow(sc.rebind("SELECT COUNT(*) FROM app_apis WHERE app_id = ? AND api_id = ?"),
+			app.Id, apiId).Scan(&n)
+		if err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.Exec(sc.rebind(`INSERT INTO app_apis (app_id, idx, api_id)
+			SELECT ?, COALESCE(MAX(idx) + 1, 0), ? FROM app_apis WHERE app_id = ?`),
+			app.Id, apiId, app.Id)
+		return err
+	})
+}
+
+func (sc *SqlClient) RemoveAppApiId(app *App, apiId string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("DELETE FROM app_apis WHERE app_id = ? AND api_id = ?"), app.Id, apiId)
+		return err
+	})
+}
+
+func (sc *SqlClient) SetAppCollaborator(app *App, userId string, role string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		result, err := tx.Exec(sc.rebind("UPDATE app_collaborators SET role = ? WHERE app_id = ? AND user_id = ?"),
+			role, app.Id, userId)
+		if err != nil {
+			return err
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.Exec(sc.rebind(`INSERT INTO app_collaborators (app_id, idx, user_id, role)
+			SELECT ?, COALESCE(MAX(idx) + 1, 0), ?, ? FROM app_collaborators WHERE app_id = ?`),
+			app.Id, userId, role, app.Id)
+		return err
+	})
+}
+
+func (sc *SqlClient) RemoveAppCollaborator(app *App, userId string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("DELETE FROM app_collaborators WHERE app_id = ? AND user_id = ?"),
+			app.Id, userId)
+		return err
+	})
+}
+
+// Set a column of an app, and return an error if the app doesn't exist
+func (sc *SqlClient) updateAppColumn(appId string, column string, value interface{}) error {
+	result, err := sc.db.Exec(sc.rebind("UPDATE apps SET "+column+" = ? WHERE id = ?"), value, appId)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) UpdateAppName(app *App, newName string) error {
+	err := sc.changeApp(app, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("UPDATE apps SET name = ? WHERE id = ?"), newName, app.Id)
+		return err
+	})
+	if _, dup := sqlDuplicateColumn(err); dup {
+		return ErrorDuplicateAttribute("name")
+	} else {
+		return err
+	}
+}
+
+func (sc *SqlClient) UpdateAppDescription(app *App, newDescription string) error {
+	return sc.changeApp(app, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("UPDATE apps SET description = ? WHERE id = ?"), newDescription, app.Id)
+		return err
+	})
+}
+
+// Set a timestamp column to the current time, then reload the app like the
+// mongodb client does
+func (sc *SqlClient) updateAppTimestamp(app *App, column string) error {
+	err := sc.updateAppColumn(app.Id, column, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return sc.reloadApp(app)
+}
+
+func (sc *SqlClient) reloadApp(app *App) error {
+	newApp, err := sc.GetApp(app.Id)
+	if err != nil {
+		return err
+	} else if newApp == nil {
+		return sql.ErrNoRows
+	}
+
+	*app = *newApp
+	return nil
+}
+
+func (sc *SqlClient) UpdateAppSourceTimestamp(app *App) error {
+	return sc.updateAppTimestamp(app, "source_timestamp")
+}
+
+func (sc *SqlClient) UpdateAppRunningTimestamp(app *App) error {
+	return sc.updateAppTimestamp(app, "running_timestamp")
+}
+
+func (sc *SqlClient) GetApp(id string) (*App, error) {
+	return sc.queryApp("NOT deleted AND id = ?", id)
+}
+
+func (sc *SqlClient) GetAppByName(name string) (*App, error) {
+	return sc.queryApp("NOT deleted AND name = ?", name)
+}
+
+func (sc *SqlClient) GetAppsByUserId(userId string) ([]*App, error) {
+	return sc.queryApps("NOT deleted AND user_id = ?", userId)
+}
+
+func (sc *SqlClient) GetAppsByCollaboratorId(userId string) ([]*App, error) {
+	return sc.queryApps("NOT deleted AND id IN (SELECT app_id FROM app_collaborators WHERE user_id = ?)", userId)
+}
+
+func (sc *SqlClient) GetAppsByTeamId(teamId string) ([]*App, error) {
+	return sc.queryApps("NOT deleted AND team_id = ?", teamId)
+}
+
+func (sc *SqlClient) GetAppsByApiId(apiId string) ([]*App, error) {
+	return sc.queryApps("NOT deleted AND id IN (SELECT app_id FROM app_apis WHERE api_id = ?)", apiId)
+}
+
+func (sc *SqlClient) GetAppByWorktreeId(worktreeId string) (*App, error) {
+	return sc.queryApp("NOT deleted AND worktree_id = ?", worktreeId)
+}
+
+// Move the app in or out of the trash. Return sql.ErrNoRows if it isn't where
+// it is taken from.
+func (sc *SqlClient) setAppDeleted(id string, deleted bool) error {
+	var deletedTime interface{}
+	if deleted {
+		deletedTime = time.Now()
+	}
+
+	result, err := sc.db.Exec(sc.rebind(`UPDATE apps SET deleted = ?, deleted_time = ?, version = version + 1
+		WHERE id = ? AND deleted = ?`), deleted, deletedTime, id, !deleted)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) DeleteApp(id string) error {
+	return sc.setAppDeleted(id, true)
+}
+
+func (sc *SqlClient) RestoreApp(id string) (*App, error) {
+	err := sc.setAppDeleted(id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := sc.GetApp(id)
+	if err != nil {
+		return nil, err
+	} else if app == nil {
+		return nil, sql.ErrNoRows
+	}
+	return app, nil
+}
+
+func (sc *SqlClient) PurgeApp(id string, deletedBefore time.Time) error {
+	// The children of the app and its snapshots go with it, see the
+	// cascades of the foreign keys
+	result, err := sc.db.Exec(sc.rebind("DELETE FROM apps WHERE id = ? AND deleted AND deleted_time < ?"),
+		id, deletedBefore)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) GetDeletedApp(id string) (*App, error) {
+	return sc.queryApp("deleted AND id = ?", id)
+}
+
+func (sc *SqlClient) GetDeletedAppsByUserId(userId string) ([]*App, error) {
+	return sc.queryApps("deleted AND user_id = ?", userId)
+}
+
+func (sc *SqlClient) GetDeletedAppsByTeamId(teamId string) ([]*App, error) {
+	return sc.queryApps("deleted AND team_id = ?", teamId)
+}
+
+func (sc *SqlClient) GetAppsDeletedBefore(t time.Time) ([]*App, error) {
+	return sc.queryApps("deleted AND deleted_time < ?", t)
+}
+
+// Return the IN condition of a list, e.g., "id IN (?, ?)", and its arguments
+func sqlInCondition(column string, values []string) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		placeholders[i] = "?"
+		args[i] = value
+	}
+	return column + " IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+func (sc *SqlClient) GetAppsByIds(ids []string) ([]*App, error) {
+	if len(ids) == 0 {
+		return []*App{}, nil
+	}
+
+	cond, args := sqlInCondition("id", ids)
+	return sc.queryApps("NOT deleted AND "+cond, args...)
+}
+
+// Escape the wildcards of LIKE
+var sqlLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (sc *SqlClient) GetGalleryApps(query GalleryQuery) ([]*App, string, error) {
+	cursor, err := query.decodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	conds := []string{"NOT deleted", "gallery = ?"}
+	args := []interface{}{true}
+	if query.Tag != "" {
+		conds = append(conds, "id IN (SELECT app_id FROM app_tags WHERE tag = ?)")
+		args = append(args, query.Tag)
+	}
+	for _, word := range query.searchWords() {
+		pattern := "%" + sqlLikeEscaper.Replace(word) + "%"
+		conds = append(conds, `(LOWER(name) LIKE ? ESCAPE '\' OR LOWER(description) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+
+	sortColumn := "created_time"
+	if query.Sort == GallerySortPopular {
+		sortColumn = "fork_count"
+	}
+	if cursor != nil {
+		var cursorKey interface{} = cursor.Key
+		if sortColumn == "created_time" {
+			cursorKey = gallerySortKeyTime(cursor.Key)
+		}
+		conds = append(conds, "("+sortColumn+" < ? OR ("+sortColumn+" = ? AND id < ?))")
+		args = append(args, cursorKey, cursorKey, cursor.Id)
+	}
+
+	args = append(args, query.Limit+1)
+	apps, err := sc.queryApps(strings.Join(conds, " AND ")+" ORDER BY "+sortColumn+" DESC, id DESC LIMIT ?",
+		args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	apps, nextCursor := query.page(apps)
+	return apps, nextCursor, nil
+}
+
+func (sc *SqlClient) IncrementAppForkCount(id string) error {
+	result, err := sc.db.Exec(sc.rebind("UPDATE apps SET fork_count = fork_count + 1 WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) NewSnapshot(snapshot *Snapshot) (*Snapshot, error) {
+	snapshot.Id = NewSnapshotId()
+	snapshot.CreatedTime = time.Now()
+	_, err := sc.db.Exec(sc.rebind("INSERT INTO snapshots ("+sqlSnapshotColumns+") VALUES (?, ?, ?, ?, ?, ?)"),
+		snapshot.Id, snapshot.AppId, snapshot.Name, snapshot.WorktreeId, snapshot.UserId, snapshot.CreatedTime)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Read the snapshots matching a condition, e.g., "app_id = ?"
+func (sc *SqlClient) querySnapshots(cond string, args ...interface{}) ([]*Snapshot, error) {
+	rows, err := sc.db.Query(sc.rebind("SELECT "+sqlSnapshotColumns+" FROM snapshots WHERE "+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []*Snapshot{}
+	for rows.Next() {
+		snapshot := &Snapshot{}
+		err = rows.Scan(&snapshot.Id, &snapshot.AppId, &snapshot.Name, &snapshot.WorktreeId, &snapshot.UserId,
+			&snapshot.CreatedTime)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+func (sc *SqlClient) GetSnapshot(id string) (*Snapshot, error) {
+	snapshots, err := sc.querySnapshots("id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, nil
+	}
+	return snapshots[0], nil
+}
+
+func (sc *SqlClient) GetSnapshotsByAppId(appId string) ([]*Snapshot, error) {
+	return sc.querySnapshots("app_id = ? ORDER BY created_time DESC", appId)
+}
+
+func (sc *SqlClient) DeleteSnapshot(id string) error {
+	result, err := sc.db.Exec(sc.rebind("DELETE FROM snapshots WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) NewTeam(team *Team) (*Team, error) {
+	team.Id = NewTeamId()
+	team.CreatedTime = time.Now()
+
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sc.rebind("INSERT INTO teams ("+sqlTeamColumns+") VALUES (?, ?, ?)"),
+		team.Id, team.Name, team.CreatedTime)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, member := range team.Members {
+		_, err = tx.Exec(sc.rebind("INSERT INTO team_members (team_id, idx, user_id, role) VALUES (?, ?, ?, ?)"),
+			team.Id, i, member.UserId, member.Role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// Read the teams matching a condition, e.g., "id = ?", with their members
+func (sc *SqlClient) queryTeams(cond string, args ...interface{}) ([]*Team, error) {
+	rows, err := sc.db.Query(sc.rebind("SELECT "+sqlTeamColumns+" FROM teams WHERE "+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like queryApps, read all the rows before loading the members
+	teams := []*Team{}
+	for rows.Next() {
+		team := &Team{}
+		err = rows.Scan(&team.Id, &team.Name, &team.CreatedTime)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, team := range teams {
+		team.Members = []TeamMember{}
+		rows, err = sc.db.Query(sc.rebind("SELECT user_id, role FROM team_members WHERE team_id = ? ORDER BY idx"),
+			team.Id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			member := TeamMember{}
+			err = rows.Scan(&member.UserId, &member.Role)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			team.Members = append(team.Members, member)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return teams, nil
+}
+
+func (sc *SqlClient) GetTeam(id string) (*Team, error) {
+	teams, err := sc.queryTeams("id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(teams) == 0 {
+		return nil, nil
+	}
+	return teams[0], nil
+}
+
+func (sc *SqlClient) GetTeamsByUserId(userId string) ([]*Team, error) {
+	return sc.queryTeams("id IN (SELECT team_id FROM team_members WHERE user_id = ?)", userId)
+}
+
+// Apply an atomic change to the members of the team, and reload it
+func (sc *SqlClient) changeTeam(team *Team, change func(tx *sql.Tx) error) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	n := 0
+	err = tx.QueryRow(sc.rebind("SELECT COUNT(*) FROM teams WHERE id = ?"), team.Id).Scan(&n)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = change(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	newTeam, err := sc.GetTeam(team.Id)
+	if err != nil {
+		return err
+	} else if newTeam == nil {
+		return sql.ErrNoRows
+	}
+
+	*team = *newTeam
+	return nil
+}
+
+func (sc *SqlClient) SetTeamMember(team *Team, userId string, role string) error {
+	return sc.changeTeam(team, func(tx *sql.Tx) error {
+		result, err := tx.Exec(sc.rebind("UPDATE team_members SET role = ? WHERE team_id = ? AND user_id = ?"),
+			role, team.Id, userId)
+		if err != nil {
+			return err
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.Exec(sc.rebind(`INSERT INTO team_members (team_id, idx, user_id, role)
+			SELECT ?, COALESCE(MAX(idx) + 1, 0), ?, ? FROM team_members WHERE team_id = ?`),
+			team.Id, userId, role, team.Id)
+		return err
+	})
+}
+
+func (sc *SqlClient) RemoveTeamMember(team *Team, userId string) error {
+	return sc.changeTeam(team, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sc.rebind("DELETE FROM team_members WHERE team_id = ? AND user_id = ?"),
+			team.Id, userId)
+		return err
+	})
+}
+
+// The string lists of an Api are stored as JSON arrays
+func sqlDecodeLists(encs []string, lists []*[]string) error {
+	for i, enc := range encs {
+		err := json.Unmarshal([]byte(enc), lists[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlEncodeLists(lists [][]string) ([]string, error) {
+	encs := make([]string, len(lists))
+	for i, list := range lists {
+		if list == nil {
+			list = []string{}
+		}
+		buf, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		encs[i] = string(buf)
+	}
+	return encs, nil
+}
+
+func sqlApiValues(api *Api) ([]interface{}, error) {
+	encs, err := sqlEncodeLists([][]string{api.Tags, api.Packages, api.RequiredEnvVarKeys,
+		api.OptionalEnvVarKeys})
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{
+		api.Id, api.Name, api.LogoUrl, api.Description, api.PortalUrl, encs[0], encs[1], encs[2], encs[3],
+		api.Snippet, api.Deprecated,
+	}, nil
+}
+
+func sqlScanApi(s sqlScanner) (*Api, error) {
+	api := &Api{}
+	tags, packages, requiredKeys, optionalKeys := "", "", "", ""
+	err := s.Scan(&api.Id, &api.Name, &api.LogoUrl, &api.Description, &api.PortalUrl, &tags, &packages,
+		&requiredKeys, &optionalKeys, &api.Snippet, &api.Deprecated)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlDecodeLists([]string{tags, packages, requiredKeys, optionalKeys},
+		[]*[]string{&api.Tags, &api.Packages, &api.RequiredEnvVarKeys, &api.OptionalEnvVarKeys})
+	if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+// Read the APIs matching a condition, e.g., "id = ?"
+func (sc *SqlClient) queryApis(cond string, args ...interface{}) ([]*Api, error) {
+	rows, err := sc.db.Query(sc.rebind("SELECT "+sqlApiColumns+" FROM apis WHERE "+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apis := []*Api{}
+	for rows.Next() {
+		api, err := sqlScanApi(rows)
+		if err != nil {
+			return nil, err
+		}
+		apis = append(apis, api)
+	}
+	return apis, rows.Err()
+}
+
+func (sc *SqlClient) GetApis() ([]*Api, error) {
+	return sc.queryApis("1 = 1")
+}
+
+func (sc *SqlClient) GetApi(id string) (*Api, error) {
+	apis, err := sc.queryApis("id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(apis) == 0 {
+		return nil, nil
+	}
+	return apis[0], nil
+}
+
+func (sc *SqlClient) GetApisByIds(ids []string) ([]*Api, error) {
+	if len(ids) == 0 {
+		return []*Api{}, nil
+	}
+
+	cond, args := sqlInCondition("id", ids)
+	return sc.queryApis(cond, args...)
+}
+
+func (sc *SqlClient) NewApi(api *Api) (*Api, error) {
+	if api.Id == "" {
+		api.Id = NewApiId()
+	}
+
+	values, err := sqlApiValues(api)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sc.db.Exec(sc.rebind("INSERT INTO apis ("+sqlApiColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		values...)
+	if _, dup := sqlDuplicateColumn(err); dup {
+		return nil, ErrorDuplicateAttribute("id")
+	} else if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func (sc *SqlClient) UpdateApi(api *Api) error {
+	values, err := sqlApiValues(api)
+	if err != nil {
+		return err
+	}
+
+	// The ID goes last, for the condition
+	values = append(values[1:], api.Id)
+	result, err := sc.db.Exec(sc.rebind(`UPDATE apis SET name = ?, logo_url = ?, description = ?, portal_url = ?,
+		tags = ?, packages = ?, required_env_var_keys = ?, optional_env_var_keys = ?, snippet = ?,
+		deprecated = ? WHERE id = ?`), values...)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) DeleteApi(id string) error {
+	result, err := sc.db.Exec(sc.rebind("DELETE FROM apis WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (sc *SqlClient) setCollectionAppIds(q sqlQuerier, collectionId string, appIds []string) error {
+	_, err := q.Exec(sc.rebind("DELETE FROM collection_apps WHERE collection_id = ?"), collectionId)
+	if err != nil {
+		return err
+	}
+
+	for i, appId := range appIds {
+		_, err = q.Exec(sc.rebind("INSERT INTO collection_apps (collection_id, idx, app_id) VALUES (?, ?, ?)"),
+			collectionId, i, appId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *SqlClient) NewCollection(collection *Collection) (*Collection, error) {
+	collection.Id = NewCollectionId()
+	collection.CreatedTime = time.Now()
+
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sc.rebind("INSERT INTO collections ("+sqlCollectionColumns+") VALUES (?, ?, ?, ?)"),
+		collection.Id, collection.Name, collection.Description, collection.CreatedTime)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sc.setCollectionAppIds(tx, collection.Id, collection.AppIds)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// Read the collections matching a condition, e.g., "id = ?", with their apps
+func (sc *SqlClient) queryCollections(cond string, args ...interface{}) ([]*Collection, error) {
+	rows, err := sc.db.Query(sc.rebind("SELECT "+sqlCollectionColumns+" FROM collections WHERE "+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like queryApps, read all the rows before loading the apps
+	collections := []*Collection{}
+	for rows.Next() {
+		collection := &Collection{}
+		err = rows.Scan(&collection.Id, &collection.Name, &collection.Description, &collection.CreatedTime)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, collection := range collections {
+		collection.AppIds = []string{}
+		rows, err = sc.db.Query(sc.rebind("SELECT app_id FROM collection_apps WHERE collection_id = ? ORDER BY idx"),
+			collection.Id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			appId := ""
+			err = rows.Scan(&appId)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			collection.AppIds = append(collection.AppIds, appId)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return collections, nil
+}
+
+func (sc *SqlClient) GetCollection(id string) (*Collection, error) {
+	collections, err := sc.queryCollections("id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, nil
+	}
+	return collections[0], nil
+}
+
+func (sc *SqlClient) GetCollections() ([]*Collection, error) {
+	return sc.queryCollections("1 = 1 ORDER BY created_time DESC")
+}
+
+func (sc *SqlClient) UpdateCollection(collection *Collection) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(sc.rebind("UPDATE collections SET name = ?, description = ?, created_time = ? WHERE id = ?"),
+		collection.Name, collection.Description, collection.CreatedTime, collection.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = sc.setCollectionAppIds(tx, collection.Id, collection.AppIds)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (sc *SqlClient) DeleteCollection(id string) error {
+	result, err := sc.db.Exec(sc.rebind("DELETE FROM collections WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -20,11 +20,92 @@ func IsDuplicateAttributeError(err error) bool {
 	return ok
 }
 
+// Returned by GetGalleryApps when the cursor cannot be decoded
+type ErrorBadCursor string
+
+func (ebc ErrorBadCursor) Error() string {
+	return fmt.Sprintf("Bad cursor %s", string(ebc))
+}
+
+func IsBadCursorError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorBadCursor)
+	return ok
+}
+
+// Returned by UpdateApp when the app has changed since it was read
+type ErrorVersionConflict string
+
+func (evc ErrorVersionConflict) Error() string {
+	return fmt.Sprintf("App %s has been changed by someone else", string(evc))
+}
+
+func IsVersionConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ErrorVersionConflict)
+	return ok
+}
+
 type KeyValuePair struct {
 	Key   string `bson:"key"`
 	Value string `bson:"value"`
 }
 
+// Roles of the users on an app, from the most to the least powerful. Owners
+// can do everything, editors everything but deleting the app and changing
+// its settings and collaborators, and viewers only look at it.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// A user the app is shared with. The owner of the app (UserId) isn't one.
+type Collaborator struct {
+	UserId string `bson:"user_id" json:"user_id"`
+	Role   string `bson:"role" json:"role"`
+}
+
+// A group of users owning apps together, so that the apps don't depend on
+// any one of them. The role of a member applies to all the apps of the team,
+// and the owners of the team also manage its members.
+type Team struct {
+	Id          string       `bson:"_id"`
+	Name        string       `bson:"name"`
+	Members     []TeamMember `bson:"members"`
+	CreatedTime time.Time    `bson:"created_time"`
+}
+
+type TeamMember struct {
+	UserId string `bson:"user_id" json:"user_id"`
+	Role   string `bson:"role" json:"role"`
+}
+
+// Idle policies of an app. By default, the context of an app is closed after
+// the cluster-wide expiration time. Custom apps use their own IdleTimeout, and
+// always-on apps are never closed for inactivity.
+const (
+	IdlePolicyDefault  = "default"
+	IdlePolicyCustom   = "custom"
+	IdlePolicyAlwaysOn = "always_on"
+)
+
+// Resource limits of the container of an app. Zero means the default of the
+// plan of the owner, see DefaultResourceLimits.
+type ResourceLimits struct {
+	// In thousandths of a CPU core
+	CpuMillis    int64 `bson:"cpu_millis" json:"cpu_millis"`
+	MemoryMB     int64 `bson:"memory_mb" json:"memory_mb"`
+	DiskMB       int64 `bson:"disk_mb" json:"disk_mb"`
+	MaxProcesses int64 `bson:"max_processes" json:"max_processes"`
+}
+
 type App struct {
 	// Metadata
 	Id           string    `bson:"_id"`
@@ -37,23 +118,111 @@ type App struct {
 	AccessedTime time.Time `bson:"accessed_time"`
 	Private      bool      `bson:"private"`
 
+	// Name of the runtime, see the runtimes package. Empty for apps
+	// created before there was a choice, which run on the default one.
+	Runtime  string         `bson:"runtime"`
 	StartCmd string         `bson:"start_cmd"`
 	EnvVars  []KeyValuePair `bson:"env_vars"`
 
-	Gallery bool `bson:"gallery"`
+	// Gallery apps are public examples. The tags categorize them, and the
+	// number of their forks is their popularity.
+	Gallery   bool     `bson:"gallery"`
+	Tags      []string `bson:"tags"`
+	ForkCount int64    `bson:"fork_count"`
+
+	// Empty for apps created before idle policies existed, which is the
+	// same as IdlePolicyDefault. IdleTimeout is in seconds, and is only
+	// used by IdlePolicyCustom.
+	IdlePolicy  string `bson:"idle_policy"`
+	IdleTimeout int64  `bson:"idle_timeout"`
+
+	// Set by the admins, on top of the defaults of the plan of the owner
+	Limits ResourceLimits `bson:"limits"`
 
 	// APIs enabled for this app
 	ApiIds []string `bson:"api_ids"`
 
+	// Users the app is shared with, see GetRole
+	Collaborators []Collaborator `bson:"collaborators"`
+
+	// The team owning the app instead of a user. Apps owned by neither
+	// are anonymous, see IsAnonymous.
+	TeamId string `bson:"team_id"`
+
 	SourceTimestamp  int64 `bson:"source_timestamp"`
 	RunningTimestamp int64 `bson:"running_timestamp"`
+
+	// Incremented by UpdateApp and the atomic env var, API and
+	// collaborator operations. They fail with ErrorVersionConflict if the
+	// app in the database has a different version, so that
+	// concurrent changes don't silently overwrite each other. Missing for
+	// apps created before, which is the same as 0.
+	Version int64 `bson:"version"`
+
+	// Set by DeleteApp, which moves the app to the trash. Apps in the trash
+	// are left out by all getters but the ones of the trash, yet keep their
+	// name and worktree until PurgeApp removes them for good.
+	Deleted     bool      `bson:"deleted"`
+	DeletedTime time.Time `bson:"deleted_time"`
+}
+
+// A named copy of the worktree of an app at some point in time. The
+// snapshot has a worktree of its own, which nothing writes to, and which the
+// app can be restored from. Like the worktrees of the apps, the ones of the
+// snapshots aren't dangling until the record is gone.
+type Snapshot struct {
+	Id          string    `bson:"_id"`
+	AppId       string    `bson:"app_id"`
+	Name        string    `bson:"name"`
+	WorktreeId  string    `bson:"worktree_id"`
+	UserId      string    `bson:"user_id"`
+	CreatedTime time.Time `bson:"created_time"`
 }
 
+// Orders of the gallery apps, from the newest or the most forked one
+const (
+	GallerySortNewest  = "newest"
+	GallerySortPopular = "popular"
+)
+
+// A page of the gallery apps. All the words of Search must appear in the name
+// or the description of an app. The mongodb client uses its text index, so
+// only whole words match there, while the others match any part of the text.
+type GalleryQuery struct {
+	Search string
+	Tag    string
+	Sort   string
+
+	// Returned with the previous page, empty for the first one
+	Cursor string
+	Limit  int
+}
+
+// An admin-curated list of gallery apps, e.g., to feature them on the front
+// page. Apps that are gone or no longer in the gallery are skipped when the
+// collection is shown.
+type Collection struct {
+	Id          string    `bson:"_id"`
+	Name        string    `bson:"name"`
+	Description string    `bson:"description"`
+	AppIds      []string  `bson:"app_ids"`
+	CreatedTime time.Time `bson:"created_time"`
+}
+
+// Plans of the users, which decide the default resource limits of their apps
+const (
+	PlanFree = "free"
+	PlanPro  = "pro"
+)
+
 type User struct {
 	Id       string `json:"user_id"`
 	Name     string `json:"name"`
 	Nickname string `json:"nickname"`
 	Picture  string `json:"picture"`
+
+	// Read from the app_metadata of the Auth0 user. Not exposed.
+	Plan string `json:"-"`
 }
 
 type Api struct {
@@ -67,6 +236,10 @@ type Api struct {
 	RequiredEnvVarKeys []string `bson:"required_env_var_keys"`
 	OptionalEnvVarKeys []string `bson:"optional_env_var_keys"`
 	Snippet            string   `bson:"snippet"`
+
+	// Deprecated APIs stay enabled for the apps using them, but cannot be
+	// enabled for more apps
+	Deprecated bool `bson:"deprecated"`
 }
 
 type Client interface {
@@ -78,13 +251,67 @@ type Client interface {
 	UpdateAppSourceTimestamp(app *App) error
 	UpdateAppRunningTimestamp(app *App) error
 
+	// Change one env var, API or collaborator of the app, without
+	// rewriting the others. The app is reloaded. Like UpdateApp, they fail
+	// with ErrorVersionConflict if the app changed since it was loaded.
+	SetAppEnvVar(app *App, key string, value string) error
+	RemoveAppEnvVar(app *App, key string) error
+	AddAppApiId(app *App, apiId string) error
+	RemoveAppApiId(app *App, apiId string) error
+	SetAppCollaborator(app *App, userId string, role string) error
+	RemoveAppCollaborator(app *App, userId string) error
+
 	GetApp(id string) (*App, error)
 	GetAppByName(name string) (*App, error)
 	GetAppsByUserId(userId string) ([]*App, error)
+	GetAppsByCollaboratorId(userId string) ([]*App, error)
+	GetAppsByTeamId(teamId string) ([]*App, error)
 	GetAppByWorktreeId(worktreeId string) (*App, error)
-	GetGalleryApps(limit int) ([]*App, error)
+	GetAppsByIds(ids []string) ([]*App, error)
+
+	// Return a page of the gallery apps, and the cursor of the next page,
+	// or "" if it is the last one
+	GetGalleryApps(query GalleryQuery) ([]*App, string, error)
+	// Count a fork of the app. Like the timestamps, doesn't change the
+	// version.
+	IncrementAppForkCount(id string) error
 
+	// Move the app to the trash. RestoreApp takes it out again, and
+	// PurgeApp removes an app for good if it was moved to the trash before
+	// the given time, so that an app restored and deleted again in the
+	// meantime isn't purged early.
 	DeleteApp(id string) error
+	RestoreApp(id string) (*App, error)
+	PurgeApp(id string, deletedBefore time.Time) error
+
+	// Trash functions
+	GetDeletedApp(id string) (*App, error)
+	GetDeletedAppsByUserId(userId string) ([]*App, error)
+	GetDeletedAppsByTeamId(teamId string) ([]*App, error)
+	GetAppsDeletedBefore(t time.Time) ([]*App, error)
+
+	// Snapshot functions. The snapshots of an app are purged together
+	// with it.
+	NewSnapshot(snapshot *Snapshot) (*Snapshot, error)
+	GetSnapshot(id string) (*Snapshot, error)
+	GetSnapshotsByAppId(appId string) ([]*Snapshot, error)
+	DeleteSnapshot(id string) error
+
+	// Team functions. Like the ones of the apps, the member functions
+	// are atomic and reload the team.
+	NewTeam(team *Team) (*Team, error)
+	GetTeam(id string) (*Team, error)
+	GetTeamsByUserId(userId string) ([]*Team, error)
+	SetTeamMember(team *Team, userId string, role string) error
+	RemoveTeamMember(team *Team, userId string) error
+
+	// Featured collection functions, for the admins. UpdateCollection
+	// replaces the whole collection.
+	NewCollection(collection *Collection) (*Collection, error)
+	GetCollection(id string) (*Collection, error)
+	GetCollections() ([]*Collection, error)
+	UpdateCollection(collection *Collection) error
+	DeleteCollection(id string) error
 
 	// User functions
 	GetUser(id string) (*User, error)
@@ -93,4 +320,11 @@ type Client interface {
 	GetApis() ([]*Api, error)
 	GetApi(id string) (*Api, error)
 	GetApisByIds(ids []string) ([]*Api, error)
+
+	// Api catalog functions, for the admins. NewApi picks an ID if there
+	// is none, and UpdateApi replaces the whole API.
+	NewApi(api *Api) (*Api, error)
+	UpdateApi(api *Api) error
+	DeleteApi(id string) error
+	GetAppsByApiId(apiId string) ([]*App, error)
 }
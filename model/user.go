@@ -81,12 +81,22 @@ func (uc *UserClient) GetUser(id string) (*User, error) {
 
 		if resp.StatusCode == 200 {
 			dec := json.NewDecoder(resp.Body)
-			user := &User{}
-			err = dec.Decode(user)
+			auth0User := struct {
+				User
+				AppMetadata struct {
+					Plan string `json:"plan"`
+				} `json:"app_metadata"`
+			}{}
+			err = dec.Decode(&auth0User)
 			resp.Body.Close()
 			if err != nil {
 				return nil, err
 			} else {
+				user := &auth0User.User
+				user.Plan = auth0User.AppMetadata.Plan
+				if user.Plan == "" {
+					user.Plan = PlanFree
+				}
 				return user, nil
 			}
 		} else if resp.StatusCode == 401 {
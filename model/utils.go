@@ -1,10 +1,16 @@
 package model
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"github.com/dustinkirkland/golang-petname"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/runtimes"
 	"github.com/satori/go.uuid"
 	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
 func NewAppId() string {
@@ -15,10 +21,27 @@ func NewAppName() string {
 	return petname.Generate(2, "-")
 }
 
+func NewSnapshotId() string {
+	return uuid.NewV4().String()
+}
+
+func NewTeamId() string {
+	return uuid.NewV4().String()
+}
+
+func NewApiId() string {
+	return uuid.NewV4().String()
+}
+
+func NewCollectionId() string {
+	return uuid.NewV4().String()
+}
+
 func (app *App) ToJsonMap() map[string]interface{} {
 	return map[string]interface{}{
 		"id":                app.Id,
 		"user_id":           app.UserId,
+		"team_id":           app.TeamId,
 		"name":              app.Name,
 		"description":       app.Description,
 		"icon":              app.Icon,
@@ -26,6 +49,114 @@ func (app *App) ToJsonMap() map[string]interface{} {
 		"accessed_time":     app.AccessedTime,
 		"source_timestamp":  app.SourceTimestamp,
 		"running_timestamp": app.RunningTimestamp,
+		"runtime":           app.GetRuntime().Name,
+		"tags":              app.GetTags(),
+		"fork_count":        app.ForkCount,
+	}
+}
+
+// Apps created before there were tags have none
+func (app *App) GetTags() []string {
+	if app.Tags == nil {
+		return []string{}
+	}
+	return app.Tags
+}
+
+// Get the runtime of the app. Unknown runtimes fall back to the default one.
+func (app *App) GetRuntime() *runtimes.Runtime {
+	rt := runtimes.Get(app.Runtime)
+	if rt == nil {
+		return runtimes.Default()
+	}
+	return rt
+}
+
+// Anonymous apps belong to everyone until adopted
+func (app *App) IsAnonymous() bool {
+	return app.UserId == "" && app.TeamId == ""
+}
+
+// The role of a user on the app, or "" if the user has no access. The team
+// is the one of the app, if any. Apps that aren't private can be viewed by
+// everyone, see GetMemberRole for the others.
+func (app *App) GetRole(userId string, team *Team) string {
+	role := app.GetMemberRole(userId, team)
+	if role == "" && !app.Private {
+		return RoleViewer
+	}
+	return role
+}
+
+// The role the user has been given on the app, or "" if the user is neither
+// its owner, a member of its team nor a collaborator. Members of the team
+// have their team role, unless they have a higher one as collaborators.
+func (app *App) GetMemberRole(userId string, team *Team) string {
+	if app.IsAnonymous() || (app.UserId != "" && app.UserId == userId) {
+		return RoleOwner
+	}
+
+	role := ""
+	if team != nil && team.Id == app.TeamId {
+		role = team.GetRole(userId)
+	}
+
+	for _, collaborator := range app.Collaborators {
+		if collaborator.UserId == userId && roleRanks[collaborator.Role] > roleRanks[role] {
+			role = collaborator.Role
+		}
+	}
+	return role
+}
+
+// The role of a user in the team, or "" if the user isn't a member
+func (team *Team) GetRole(userId string) string {
+	for _, member := range team.Members {
+		if member.UserId == userId {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// The number of the owners of the team, which must never drop to zero
+func (team *Team) NumOwners() int {
+	n := 0
+	for _, member := range team.Members {
+		if member.Role == RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+func IsValidRole(role string) bool {
+	_, found := roleRanks[role]
+	return found
+}
+
+// Whether a role allows everything the required role does
+func RoleIncludes(role string, requiredRole string) bool {
+	return roleRanks[role] >= roleRanks[requiredRole] && roleRanks[role] > 0
+}
+
+func (app *App) GetIdlePolicy() string {
+	if app.IdlePolicy == "" {
+		return IdlePolicyDefault
+	}
+	return app.IdlePolicy
+}
+
+func (app *App) IdlePolicyToJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"idle_policy":  app.GetIdlePolicy(),
+		"idle_timeout": app.IdleTimeout,
 	}
 }
 
@@ -45,6 +176,36 @@ func (app *App) GetSystemEnvVarMap() map[string]string {
 	}
 }
 
+// The worktree of the snapshot is internal
+func (snapshot *Snapshot) ToJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           snapshot.Id,
+		"app_id":       snapshot.AppId,
+		"name":         snapshot.Name,
+		"user_id":      snapshot.UserId,
+		"created_time": snapshot.CreatedTime,
+	}
+}
+
+func (team *Team) ToJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           team.Id,
+		"name":         team.Name,
+		"members":      team.Members,
+		"created_time": team.CreatedTime,
+	}
+}
+
+func (collection *Collection) ToJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           collection.Id,
+		"name":         collection.Name,
+		"description":  collection.Description,
+		"app_ids":      collection.AppIds,
+		"created_time": collection.CreatedTime,
+	}
+}
+
 func (api *Api) ToJsonMap() map[string]interface{} {
 	return map[string]interface{}{
 		"id":          api.Id,
@@ -54,6 +215,7 @@ func (api *Api) ToJsonMap() map[string]interface{} {
 		"portal_url":  api.PortalUrl,
 		"tags":        api.Tags,
 		"snippet":     api.Snippet,
+		"deprecated":  api.Deprecated,
 	}
 }
 
@@ -80,3 +242,192 @@ func (bat AppsByAccessedTime) Less(i, j int) bool {
 func SortAppsByAccessedTime(apps []*App) {
 	sort.Sort(AppsByAccessedTime(apps))
 }
+
+type AppsByDeletedTime []*App
+
+func (bdt AppsByDeletedTime) Len() int      { return len(bdt) }
+func (bdt AppsByDeletedTime) Swap(i, j int) { bdt[i], bdt[j] = bdt[j], bdt[i] }
+func (bdt AppsByDeletedTime) Less(i, j int) bool {
+	return bdt[i].DeletedTime.After(bdt[j].DeletedTime)
+}
+
+func SortAppsByDeletedTime(apps []*App) {
+	sort.Sort(AppsByDeletedTime(apps))
+}
+
+type SnapshotsByCreatedTime []*Snapshot
+
+func (bct SnapshotsByCreatedTime) Len() int      { return len(bct) }
+func (bct SnapshotsByCreatedTime) Swap(i, j int) { bct[i], bct[j] = bct[j], bct[i] }
+func (bct SnapshotsByCreatedTime) Less(i, j int) bool {
+	return bct[i].CreatedTime.After(bct[j].CreatedTime)
+}
+
+func SortSnapshotsByCreatedTime(snapshots []*Snapshot) {
+	sort.Sort(SnapshotsByCreatedTime(snapshots))
+}
+
+type TeamsByCreatedTime []*Team
+
+func (bct TeamsByCreatedTime) Len() int      { return len(bct) }
+func (bct TeamsByCreatedTime) Swap(i, j int) { bct[i], bct[j] = bct[j], bct[i] }
+func (bct TeamsByCreatedTime) Less(i, j int) bool {
+	return bct[i].CreatedTime.After(bct[j].CreatedTime)
+}
+
+func SortTeamsByCreatedTime(teams []*Team) {
+	sort.Sort(TeamsByCreatedTime(teams))
+}
+
+type CollectionsByCreatedTime []*Collection
+
+func (bct CollectionsByCreatedTime) Len() int      { return len(bct) }
+func (bct CollectionsByCreatedTime) Swap(i, j int) { bct[i], bct[j] = bct[j], bct[i] }
+func (bct CollectionsByCreatedTime) Less(i, j int) bool {
+	return bct[i].CreatedTime.After(bct[j].CreatedTime)
+}
+
+func SortCollectionsByCreatedTime(collections []*Collection) {
+	sort.Sort(CollectionsByCreatedTime(collections))
+}
+
+type appsByGalleryQuery struct {
+	apps  []*App
+	query *GalleryQuery
+}
+
+func (bq appsByGalleryQuery) Len() int      { return len(bq.apps) }
+func (bq appsByGalleryQuery) Swap(i, j int) { bq.apps[i], bq.apps[j] = bq.apps[j], bq.apps[i] }
+func (bq appsByGalleryQuery) Less(i, j int) bool {
+	return bq.query.less(bq.apps[i], bq.apps[j])
+}
+
+// Sort the apps in the order of the query, like the database would
+func SortGalleryApps(apps []*App, query GalleryQuery) {
+	sort.Sort(appsByGalleryQuery{apps, &query})
+}
+
+// A gallery cursor points at the last app of the previous page, by its key in
+// the order of the query and its ID, which breaks the ties
+type galleryCursor struct {
+	Key int64  `json:"key"`
+	Id  string `json:"id"`
+}
+
+func (query *GalleryQuery) sortKey(app *App) int64 {
+	if query.Sort == GallerySortPopular {
+		return app.ForkCount
+	}
+	return app.CreatedTime.UnixNano()
+}
+
+// The time of a sort key of GallerySortNewest
+func gallerySortKeyTime(key int64) time.Time {
+	return time.Unix(0, key)
+}
+
+// Whether app a comes before app b in the order of the query
+func (query *GalleryQuery) less(a *App, b *App) bool {
+	aKey, bKey := query.sortKey(a), query.sortKey(b)
+	if aKey != bKey {
+		return aKey > bKey
+	}
+	return a.Id > b.Id
+}
+
+// Return the cursor of the query, or nil for the first page
+func (query *GalleryQuery) decodeCursor() (*galleryCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrorBadCursor(query.Cursor)
+	}
+
+	cursor := &galleryCursor{}
+	err = json.Unmarshal(buf, cursor)
+	if err != nil || cursor.Id == "" {
+		return nil, ErrorBadCursor(query.Cursor)
+	}
+	return cursor, nil
+}
+
+// Whether the app comes after the cursor in the order of the query
+func (query *GalleryQuery) isAfter(app *App, cursor *galleryCursor) bool {
+	key := query.sortKey(app)
+	return key < cursor.Key || (key == cursor.Key && app.Id < cursor.Id)
+}
+
+// Cut the sorted apps, read up to one more than the limit, to the page, and
+// return the cursor of the next page, if there is one
+func (query *GalleryQuery) page(apps []*App) ([]*App, string) {
+	if query.Limit <= 0 {
+		return []*App{}, ""
+	} else if len(apps) <= query.Limit {
+		return apps, ""
+	}
+
+	apps = apps[:query.Limit]
+	last := apps[len(apps)-1]
+	buf, _ := json.Marshal(galleryCursor{
+		Key: query.sortKey(last),
+		Id:  last.Id,
+	})
+	return apps, base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (query *GalleryQuery) searchWords() []string {
+	// Quotes are used by the mongodb text search
+	return strings.Fields(strings.ToLower(strings.Replace(query.Search, "\"", " ", -1)))
+}
+
+// Whether all the words appear in the name or the description of the app
+func (app *App) matchesSearchWords(words []string) bool {
+	name := strings.ToLower(app.Name)
+	description := strings.ToLower(app.Description)
+	for _, word := range words {
+		if !strings.Contains(name, word) && !strings.Contains(description, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (app *App) hasTag(tag string) bool {
+	for _, t := range app.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// The default resource limits of the apps whose owner is on the given plan
+func DefaultResourceLimits(plan string) ResourceLimits {
+	limits := config.PlanResourceLimits(plan)
+	return ResourceLimits{
+		CpuMillis:    limits.CpuMillis,
+		MemoryMB:     limits.MemoryMB,
+		DiskMB:       limits.DiskMB,
+		MaxProcesses: limits.MaxProcesses,
+	}
+}
+
+// Fill the unset limits with the given defaults
+func (limits ResourceLimits) WithDefaults(defaults ResourceLimits) ResourceLimits {
+	if limits.CpuMillis == 0 {
+		limits.CpuMillis = defaults.CpuMillis
+	}
+	if limits.MemoryMB == 0 {
+		limits.MemoryMB = defaults.MemoryMB
+	}
+	if limits.DiskMB == 0 {
+		limits.DiskMB = defaults.DiskMB
+	}
+	if limits.MaxProcesses == 0 {
+		limits.MaxProcesses = defaults.MaxProcesses
+	}
+	return limits
+}
@@ -0,0 +1,135 @@
+package runtimes
+
+import (
+	"fmt"
+	"github.com/postverta/pv_backend/config"
+	"sort"
+	"strings"
+)
+
+// Names of the supported runtimes
+const (
+	Node   = "node"
+	Python = "python"
+	Go     = "go"
+	Static = "static"
+)
+
+// Everything the backend needs to know to run the apps of a language
+type Runtime struct {
+	Name string
+
+	// Container image and the directories of the exec task
+	// configurations in it
+	Image           string
+	ExecConfigRoots []string
+
+	// Start command of new apps
+	DefaultStartCmd string
+
+	// The file at the root of a project of this runtime. It is used to
+	// find the project root when importing.
+	ManifestFile string
+
+	// Command and working directory of the language server. {port} is
+	// replaced by the listening port. Empty if there is no language
+	// server.
+	LangServerCmd     []string
+	LangServerRunPath string
+
+	// Exec tasks to add and remove a package (with the NAME and optional
+	// VERSION keys), and to sync the type definitions after. Empty if the
+	// runtime doesn't support it.
+	InstallPackageTask string
+	RemovePackageTask  string
+	SyncTypesTask      string
+}
+
+// Get the language server command for the given port
+func (rt *Runtime) GetLangServerCmd(port uint32) []string {
+	cmd := make([]string, len(rt.LangServerCmd))
+	for i, arg := range rt.LangServerCmd {
+		cmd[i] = strings.Replace(arg, "{port}", fmt.Sprintf("%d", port), -1)
+	}
+	return cmd
+}
+
+var registry = map[string]*Runtime{
+	Node: &Runtime{
+		Name:  Node,
+		Image: config.ClusterRuntimeImage(Node),
+		ExecConfigRoots: []string{
+			"/etc/task/common",
+			"/etc/task/javascript",
+		},
+		DefaultStartCmd:    "node index.js",
+		ManifestFile:       "package.json",
+		LangServerCmd:      []string{"/usr/local/bin/javascript-typescript-langserver", "-p", "{port}"},
+		LangServerRunPath:  "/langserver",
+		InstallPackageTask: "npm_install_pkg",
+		RemovePackageTask:  "npm_remove_pkg",
+		SyncTypesTask:      "sync_types",
+	},
+	Python: &Runtime{
+		Name:  Python,
+		Image: config.ClusterRuntimeImage(Python),
+		ExecConfigRoots: []string{
+			"/etc/task/common",
+			"/etc/task/python",
+		},
+		DefaultStartCmd:    "python main.py",
+		ManifestFile:       "requirements.txt",
+		LangServerCmd:      []string{"/usr/local/bin/pyls", "--tcp", "--host", "0.0.0.0", "--port", "{port}"},
+		LangServerRunPath:  "/app",
+		InstallPackageTask: "pip_install_pkg",
+		RemovePackageTask:  "pip_remove_pkg",
+	},
+	Go: &Runtime{
+		Name:  Go,
+		Image: config.ClusterRuntimeImage(Go),
+		ExecConfigRoots: []string{
+			"/etc/task/common",
+			"/etc/task/go",
+		},
+		DefaultStartCmd:    "go run .",
+		ManifestFile:       "go.mod",
+		LangServerCmd:      []string{"/usr/local/bin/go-langserver", "-mode", "tcp", "-addr", ":{port}"},
+		LangServerRunPath:  "/app",
+		InstallPackageTask: "go_get_pkg",
+		RemovePackageTask:  "go_remove_pkg",
+	},
+	Static: &Runtime{
+		Name:  Static,
+		Image: config.ClusterRuntimeImage(Static),
+		ExecConfigRoots: []string{
+			"/etc/task/common",
+			"/etc/task/static",
+		},
+		DefaultStartCmd: "/scripts/static_server",
+		ManifestFile:    "index.html",
+	},
+}
+
+// The runtime of apps that don't specify one, which are all the apps created
+// before there was a choice
+func Default() *Runtime {
+	return registry[Node]
+}
+
+// Get a runtime by name. The empty name is the default runtime. Return nil if
+// there is no such runtime.
+func Get(name string) *Runtime {
+	if name == "" {
+		return Default()
+	}
+	return registry[name]
+}
+
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The fields of an API the admins can set. Deprecation has its own endpoint.
+type apiInput struct {
+	Id                 string   `json:"id"`
+	Name               string   `json:"name"`
+	LogoUrl            string   `json:"logo_url"`
+	Description        string   `json:"description"`
+	PortalUrl          string   `json:"portal_url"`
+	Tags               []string `json:"tags"`
+	Packages           []string `json:"packages"`
+	RequiredEnvVarKeys []string `json:"required_env_var_keys"`
+	OptionalEnvVarKeys []string `json:"optional_env_var_keys"`
+	Snippet            string   `json:"snippet"`
+}
+
+func validateApiInput(input *apiInput) error {
+	if input.Id != "" {
+		if matched, _ := regexp.MatchString(`^[a-z0-9][a-z0-9\-_]*$`, input.Id); !matched {
+			return fmt.Errorf("Bad API ID %s", input.Id)
+		}
+	}
+
+	if len(input.Name) == 0 || len(input.Name) > 100 {
+		return fmt.Errorf("Bad API name %s", input.Name)
+	}
+
+	packages := make(map[string]bool)
+	for _, pkg := range input.Packages {
+		// npm package names, optionally with a version or a tag
+		if matched, _ := regexp.MatchString(`^(@[a-z0-9\-~][a-z0-9\-._~]*/)?[a-z0-9\-~][a-z0-9\-._~]*(@[a-zA-Z0-9\-._~^*]+)?$`, pkg); !matched {
+			return fmt.Errorf("Bad package %s", pkg)
+		} else if packages[pkg] {
+			return fmt.Errorf("Duplicate package %s", pkg)
+		}
+		packages[pkg] = true
+	}
+
+	systemEnvVars := (&model.App{}).GetSystemEnvVarMap()
+	keys := make(map[string]bool)
+	for _, key := range append(append([]string{}, input.RequiredEnvVarKeys...), input.OptionalEnvVarKeys...) {
+		if matched, _ := regexp.MatchString(`^[a-zA-Z_]+[a-zA-Z0-9_]*$`, key); !matched {
+			return fmt.Errorf("Bad environment variable key %s", key)
+		} else if _, found := systemEnvVars[key]; found {
+			return fmt.Errorf("Environment variable key %s is reserved", key)
+		} else if keys[key] {
+			return fmt.Errorf("Duplicate environment variable key %s", key)
+		}
+		keys[key] = true
+	}
+
+	// The snippet shows the users where the keys go
+	if len(input.Snippet) == 0 || len(input.Snippet) > 64*1024 {
+		return fmt.Errorf("Bad snippet length %d", len(input.Snippet))
+	}
+	for _, key := range input.RequiredEnvVarKeys {
+		if !strings.Contains(input.Snippet, key) {
+			return fmt.Errorf("Snippet doesn't use required environment variable key %s", key)
+		}
+	}
+
+	return nil
+}
+
+// Decode and validate the input. Write the response and return nil if it is
+// bad.
+func readApiInput(w http.ResponseWriter, r *http.Request) *apiInput {
+	input := &apiInput{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(input)
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	err = validateApiInput(input)
+	if err != nil {
+		log.Println("[WARNING] Bad API:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		buf, _ := json.Marshal(map[string]string{
+			"error": err.Error(),
+		})
+		w.Write(buf)
+		return nil
+	}
+	return input
+}
+
+// Unlike the users, the admins see the packages and the env var keys
+func adminApiToJsonMap(api *model.Api) map[string]interface{} {
+	m := api.ToJsonMap()
+	m["packages"] = api.Packages
+	m["required_env_var_keys"] = api.RequiredEnvVarKeys
+	m["optional_env_var_keys"] = api.OptionalEnvVarKeys
+	return m
+}
+
+func appsToJson(apps []*model.App) []map[string]interface{} {
+	output := make([]map[string]interface{}, 0)
+	for _, app := range apps {
+		output = append(output, app.ToJsonMap())
+	}
+	return output
+}
+
+// The entries of a that aren't in b
+func stringsMissingFrom(a []string, b []string) []string {
+	missing := []string{}
+	for _, s := range a {
+		found := false
+		for _, t := range b {
+			if s == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func HandleAdminApisGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	apis, err := model.C().GetApis()
+	if err != nil {
+		log.Println("[ERROR] Cannot get APIs in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output := make([]map[string]interface{}, 0)
+	for _, api := range apis {
+		output = append(output, adminApiToJsonMap(api))
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func HandleAdminApisPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	input := readApiInput(w, r)
+	if input == nil {
+		return
+	}
+
+	api, err := model.C().NewApi(&model.Api{
+		Id:                 input.Id,
+		Name:               input.Name,
+		LogoUrl:            input.LogoUrl,
+		Description:        input.Description,
+		PortalUrl:          input.PortalUrl,
+		Tags:               input.Tags,
+		Packages:           input.Packages,
+		RequiredEnvVarKeys: input.RequiredEnvVarKeys,
+		OptionalEnvVarKeys: input.OptionalEnvVarKeys,
+		Snippet:            input.Snippet,
+	})
+	if model.IsDuplicateAttributeError(err) {
+		log.Println("[WARNING] API", input.Id, "exists already")
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot create API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "created API", api.Id)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(adminApiToJsonMap(api))
+	w.Write(buf)
+}
+
+// Update an API. If its packages change, the apps that have it enabled keep
+// the old ones until the API is disabled and enabled again, so they are
+// reported to the admin.
+func HandleAdminApiPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	api, err := model.C().GetApi(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if api == nil {
+		log.Println("[WARNING] Cannot find API")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	input := readApiInput(w, r)
+	if input == nil {
+		return
+	}
+
+	if input.Id != "" && input.Id != api.Id {
+		log.Println("[WARNING] Cannot change the ID of API", api.Id)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	packagesAdded := stringsMissingFrom(input.Packages, api.Packages)
+	packagesRemoved := stringsMissingFrom(api.Packages, input.Packages)
+
+	api.Name = input.Name
+	api.LogoUrl = input.LogoUrl
+	api.Description = input.Description
+	api.PortalUrl = input.PortalUrl
+	api.Tags = input.Tags
+	api.Packages = input.Packages
+	api.RequiredEnvVarKeys = input.RequiredEnvVarKeys
+	api.OptionalEnvVarKeys = input.OptionalEnvVarKeys
+	api.Snippet = input.Snippet
+	err = model.C().UpdateApi(api)
+	if err != nil {
+		log.Println("[ERROR] Cannot update API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("[INFO] Admin", userId, "updated API", api.Id)
+
+	output := map[string]interface{}{
+		"api":              adminApiToJsonMap(api),
+		"packages_added":   packagesAdded,
+		"packages_removed": packagesRemoved,
+		"apps":             []map[string]interface{}{},
+	}
+	if len(packagesAdded) > 0 || len(packagesRemoved) > 0 {
+		apps, err := model.C().GetAppsByApiId(api.Id)
+		if err != nil {
+			log.Println("[ERROR] Cannot get apps in database:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Println("[INFO] Packages of API", api.Id, "changed,", len(apps), "apps have it enabled")
+		output["apps"] = appsToJson(apps)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(output)
+	w.Write(buf)
+}
+
+// Deprecate an API, or take the deprecation back
+func HandleAdminApiDeprecatePost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	type Input struct {
+		Deprecated bool `json:"deprecated"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	api, err := model.C().GetApi(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if api == nil {
+		log.Println("[WARNING] Cannot find API")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	api.Deprecated = input.Deprecated
+	err = model.C().UpdateApi(api)
+	if err != nil {
+		log.Println("[ERROR] Cannot update API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "set deprecation of API", api.Id, "to", api.Deprecated)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(adminApiToJsonMap(api))
+	w.Write(buf)
+}
+
+// Delete an API. APIs still enabled for some apps cannot be deleted, those
+// apps are returned instead. Deprecate the API first to stop it from spreading.
+func HandleAdminApiDelete(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	api, err := model.C().GetApi(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if api == nil {
+		log.Println("[WARNING] Cannot find API")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	apps, err := model.C().GetAppsByApiId(api.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot get apps in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(apps) > 0 {
+		log.Println("[WARNING] API", api.Id, "is still enabled for", len(apps), "apps")
+		w.WriteHeader(http.StatusConflict)
+		buf, _ := json.Marshal(map[string]interface{}{
+			"apps": appsToJson(apps),
+		})
+		w.Write(buf)
+		return
+	}
+
+	err = model.C().DeleteApi(api.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot delete API in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "deleted API", api.Id)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/cluster"
+	"log"
+	"net/http"
+)
+
+func HandleAdminClusterAgentsGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(cluster.C().ListAgents())
+	w.Write(buf)
+}
+
+func HandleAdminClusterContextsGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(cluster.C().ListContexts())
+	w.Write(buf)
+}
+
+// Close the context of an app, even if it is in use. The worktree is saved
+// first, unless the "save" query parameter is "false" (e.g., when the
+// container is too stuck to save).
+func HandleAdminClusterContextDelete(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	appId := vars["id"]
+	save := r.URL.Query().Get("save") != "false"
+
+	log.Println("[INFO] Admin", userId, "force-closing context of app", appId, "save:", save)
+	err := cluster.C().ForceCloseContext(appId, save)
+	if cluster.IsNoContextError(err) {
+		log.Println("[WARNING] App", appId, "has no context")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot close context of app", appId, "err:", err)
+		WriteCallError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleAdminClusterQuarantineGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(cluster.C().ListQuarantine())
+	w.Write(buf)
+}
+
+// Retry closing the quarantined context of an app right away
+func HandleAdminClusterQuarantineRetryPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	appId := vars["id"]
+
+	err := cluster.C().RetryQuarantined(appId)
+	if cluster.IsNotQuarantinedError(err) {
+		log.Println("[WARNING] App", appId, "is not quarantined")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Still cannot close context of app", appId, "err:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Make a quarantined app available again without closing its context, once
+// the container has been cleaned up by hand
+func HandleAdminClusterQuarantineDelete(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	appId := vars["id"]
+
+	log.Println("[INFO] Admin", userId, "resolving quarantine of app", appId)
+	err := cluster.C().ResolveQuarantined(appId)
+	if cluster.IsNotQuarantinedError(err) {
+		log.Println("[WARNING] App", appId, "is not quarantined")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot resolve quarantine of app", appId, "err:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+)
+
+// The fields of a featured collection the admins can set
+type collectionInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	AppIds      []string `json:"app_ids"`
+}
+
+// Check the input, and that its apps exist and are in the gallery
+func validateCollectionInput(input *collectionInput) error {
+	if len(input.Name) == 0 || len(input.Name) > 100 {
+		return fmt.Errorf("Bad collection name %s", input.Name)
+	}
+
+	if len(input.Description) > 1000 {
+		return fmt.Errorf("Bad collection description length %d", len(input.Description))
+	}
+
+	appIds := make(map[string]bool)
+	for _, appId := range input.AppIds {
+		if appIds[appId] {
+			return fmt.Errorf("Duplicate app %s", appId)
+		}
+		appIds[appId] = true
+	}
+
+	apps, err := model.C().GetAppsByIds(input.AppIds)
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		if app.Gallery {
+			delete(appIds, app.Id)
+		}
+	}
+	for appId := range appIds {
+		return fmt.Errorf("App %s is not in the gallery", appId)
+	}
+
+	return nil
+}
+
+// Decode and validate the input. Write the response and return nil if it is
+// bad.
+func readCollectionInput(w http.ResponseWriter, r *http.Request) *collectionInput {
+	input := &collectionInput{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(input)
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	if input.AppIds == nil {
+		input.AppIds = []string{}
+	}
+
+	err = validateCollectionInput(input)
+	if err != nil {
+		log.Println("[WARNING] Bad collection:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		buf, _ := json.Marshal(map[string]string{
+			"error": err.Error(),
+		})
+		w.Write(buf)
+		return nil
+	}
+	return input
+}
+
+func HandleAdminGalleryCollectionsPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	input := readCollectionInput(w, r)
+	if input == nil {
+		return
+	}
+
+	collection, err := model.C().NewCollection(&model.Collection{
+		Name:        input.Name,
+		Description: input.Description,
+		AppIds:      input.AppIds,
+	})
+	if err != nil {
+		log.Println("[ERROR] Cannot create collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "created collection", collection.Id)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collection.ToJsonMap())
+	w.Write(buf)
+}
+
+func HandleAdminGalleryCollectionPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	collection, err := model.C().GetCollection(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if collection == nil {
+		log.Println("[WARNING] Cannot find collection")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	input := readCollectionInput(w, r)
+	if input == nil {
+		return
+	}
+
+	collection.Name = input.Name
+	collection.Description = input.Description
+	collection.AppIds = input.AppIds
+	err = model.C().UpdateCollection(collection)
+	if err != nil {
+		log.Println("[ERROR] Cannot update collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "updated collection", collection.Id)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collection.ToJsonMap())
+	w.Write(buf)
+}
+
+func HandleAdminGalleryCollectionDelete(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	collection, err := model.C().GetCollection(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if collection == nil {
+		log.Println("[WARNING] Cannot find collection")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = model.C().DeleteCollection(collection.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot delete collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "deleted collection", collection.Id)
+	w.WriteHeader(http.StatusOK)
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"encoding/json"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
+	"github.com/postverta/pv_backend/runtimes"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	"github.com/gorilla/mux"
 	gcontext "golang.org/x/net/context"
@@ -22,16 +24,24 @@ func HandleAppApisGet(userId string, app *model.App, context *cluster.Context, w
 		return
 	}
 
-	results := make([]map[string]interface{}, len(apis))
-	for i, api := range apis {
-		results[i] = api.ToJsonMap()
-		results[i]["enabled"] = false
+	results := make([]map[string]interface{}, 0, len(apis))
+	for _, api := range apis {
+		enabled := false
 		for _, apiId := range app.ApiIds {
 			if apiId == api.Id {
-				results[i]["enabled"] = true
+				enabled = true
 				break
 			}
 		}
+
+		// Deprecated APIs are only shown to the apps using them
+		if api.Deprecated && !enabled {
+			continue
+		}
+
+		result := api.ToJsonMap()
+		result["enabled"] = enabled
+		results = append(results, result)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -71,6 +81,19 @@ func HandleAppApiPost(userId string, app *model.App, context *cluster.Context, w
 		return
 	}
 
+	if api.Deprecated {
+		log.Println("[WARNING] API", api.Id, "is deprecated")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The packages of the APIs are npm packages
+	if len(api.Packages) > 0 && app.GetRuntime().Name != runtimes.Node {
+		log.Println("[WARNING] API", api.Id, "is not supported by runtime", app.GetRuntime().Name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	for _, pkg := range api.Packages {
 		req := &execproto.ExecReq{
 			TaskName: "npm_install_pkg",
@@ -82,19 +105,20 @@ func HandleAppApiPost(userId string, app *model.App, context *cluster.Context, w
 			},
 			WaitForCompletion: true,
 		}
-		_, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+		callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+		_, err := context.GetExecServiceClient().Exec(callCtx, req)
+		cancel()
 		if err != nil {
 			log.Println("[ERROR] Cannot run command:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteCallError(w, err)
 			return
 		}
 	}
 
-	app.ApiIds = append(app.ApiIds, api.Id)
-	err = model.C().UpdateApp(app, []string{"ApiIds"})
+	err = model.C().AddAppApiId(app, api.Id)
 	if err != nil {
 		log.Println("[ERROR] Cannot save app to database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
@@ -130,11 +154,9 @@ func HandleAppApiDelete(userId string, app *model.App, context *cluster.Context,
 	}
 
 	found := false
-	idx := 0
-	for i, apiId := range app.ApiIds {
+	for _, apiId := range app.ApiIds {
 		if apiId == api.Id {
 			found = true
-			idx = i
 			break
 		}
 	}
@@ -156,22 +178,20 @@ func HandleAppApiDelete(userId string, app *model.App, context *cluster.Context,
 			},
 			WaitForCompletion: true,
 		}
-		_, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+		callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+		_, err := context.GetExecServiceClient().Exec(callCtx, req)
+		cancel()
 		if err != nil {
 			log.Println("[ERROR] Cannot run command:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteCallError(w, err)
 			return
 		}
 	}
 
-	copy(app.ApiIds[idx:], app.ApiIds[idx+1:])
-	app.ApiIds[len(app.ApiIds)-1] = ""
-	app.ApiIds = app.ApiIds[:len(app.ApiIds)-1]
-
-	err = model.C().UpdateApp(app, []string{"ApiIds"})
+	err = model.C().RemoveAppApiId(app, api.Id)
 	if err != nil {
 		log.Println("[ERROR] Cannot save app to database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
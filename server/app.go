@@ -22,11 +22,35 @@ func HandleAppsGet(userId string, w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	// Also the apps shared with the user
+	sharedApps, err := model.C().GetAppsByCollaboratorId(userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get apps in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	apps = append(apps, sharedApps...)
 	model.SortAppsByAccessedTime(apps)
 
+	// Load the teams of the user once for the roles. The user has no role
+	// from the teams the user isn't a member of.
+	teams, err := model.C().GetTeamsByUserId(userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get teams in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	teamMap := make(map[string]*model.Team)
+	for _, team := range teams {
+		teamMap[team.Id] = team
+	}
+
 	output := make([]map[string]interface{}, 0)
 	for _, app := range apps {
-		output = append(output, app.ToJsonMap())
+		appMap := app.ToJsonMap()
+		appMap["role"] = app.GetRole(userId, teamMap[app.TeamId])
+		output = append(output, appMap)
 	}
 
 	buf, _ := json.Marshal(output)
@@ -72,7 +96,7 @@ func HandleAppNamePost(userId string, app *model.App, w http.ResponseWriter, r *
 		return
 	} else if err != nil {
 		log.Println("[ERROR] Cannot update app in database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
@@ -106,7 +130,7 @@ func HandleAppDescriptionPost(userId string, app *model.App, w http.ResponseWrit
 	err = model.C().UpdateAppDescription(app, input.NewDescription)
 	if err != nil {
 		log.Println("[ERROR] Cannot update app in database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
@@ -180,7 +204,7 @@ func HandleAppIconPost(userId string, app *model.App, w http.ResponseWriter, r *
 		err = model.C().UpdateApp(app, []string{"Icon"})
 		if err != nil {
 			log.Println("[ERROR] Cannot update database:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteUpdateAppError(w, err)
 			return
 		}
 
@@ -193,8 +217,8 @@ func HandleAppIconPost(userId string, app *model.App, w http.ResponseWriter, r *
 func HandleAppDelete(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
 	SetCommonHeaders(w, true)
 
-	// First delete the app in database. This will fail all future requests
-	// with regard to this app.
+	// Move the app to the trash. This will fail all future requests with
+	// regard to this app, until the owner restores it.
 	err := model.C().DeleteApp(app.Id)
 	if err != nil {
 		log.Println("[ERROR] Cannot delete app in database:", err)
@@ -202,19 +226,20 @@ func HandleAppDelete(userId string, app *model.App, w http.ResponseWriter, r *ht
 		return
 	}
 
-	// We don't delete the worktree image immediately. An async sweeping
-	// task will clear all dangling images eventually.
+	// The app keeps its name and worktree image while in the trash. Once
+	// PurgeTrash removes it, an async sweeping task clears the dangling
+	// image.
 	w.WriteHeader(http.StatusOK)
 }
 
 func HandleAppAdoptPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
 	SetCommonHeaders(w, true)
-	if app.UserId == "" {
+	if app.IsAnonymous() {
 		app.UserId = userId
 		err := model.C().UpdateApp(app, []string{"UserId"})
 		if err != nil {
 			log.Println("[ERROR] Cannot update app in database:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteUpdateAppError(w, err)
 			return
 		}
 	}
@@ -225,15 +250,16 @@ func HandleAppAdoptPost(userId string, app *model.App, w http.ResponseWriter, r
 
 func HandleAppAccessGet(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
 	SetCommonHeaders(w, true)
-	accessMode := ""
-	if app.UserId != userId && app.UserId != "" {
-		// Not my application, allow viewer mode
-		accessMode = "viewer"
-	} else if app.UserId == userId {
-		// My own application, or I'm an anonymous user checking out another anonymous app
-		accessMode = "owner"
-	} else {
-		// Similar to above, but I can potentially adopt the anonymous application
+	accessMode, err := GetAppRole(app, userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get team in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if app.IsAnonymous() && userId != "" {
+		// Anyone can change an anonymous application, but I can also
+		// adopt it
 		accessMode = "adopter"
 	}
 
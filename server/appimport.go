@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
+	"github.com/postverta/pv_backend/runtimes"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	"github.com/satori/go.uuid"
 	gcontext "golang.org/x/net/context"
@@ -67,13 +69,13 @@ func getGithubCommit(githubUser string, githubRepo string, branch string) (strin
 	return sha, nil
 }
 
-func getGithubPackageJson(githubUser string, githubRepo string, commit string) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/package.json?ref=%s", githubUser, githubRepo, commit))
+func getGithubFile(githubUser string, githubRepo string, commit string, filePath string) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s", githubUser, githubRepo, filePath, commit))
 	if err != nil {
 		return "", err
 	}
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Failed to get github package.json, error code:%d", resp.StatusCode)
+		return "", fmt.Errorf("Failed to get github %s, error code:%d", filePath, resp.StatusCode)
 	}
 
 	dec := json.NewDecoder(resp.Body)
@@ -112,6 +114,7 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		GithubUser string
 		GithubRepo string
 		Branch     string
+		Runtime    string
 	}
 	input := Input{}
 	decoder := json.NewDecoder(r.Body)
@@ -129,6 +132,13 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	rt := runtimes.Get(input.Runtime)
+	if rt == nil {
+		log.Println("[WARNING] Unknown runtime:", input.Runtime)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	commit, err := getGithubCommit(input.GithubUser, input.GithubRepo, input.Branch)
 	if err != nil {
 		log.Println("[WARNING] Cannot get github commit:", err)
@@ -136,9 +146,10 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	packageJson, err := getGithubPackageJson(input.GithubUser, input.GithubRepo, commit)
+	// The manifest tells whether the repo is a project of the runtime
+	manifest, err := getGithubFile(input.GithubUser, input.GithubRepo, commit, rt.ManifestFile)
 	if err != nil {
-		log.Println("[WARNING] Cannot get github package.json:", err)
+		log.Println("[WARNING] Cannot get github", rt.ManifestFile, "err:", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -149,35 +160,32 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	packageJsonDescription, err := GetPackageJsonDescription(packageJson)
-	if err != nil {
-		log.Println("[WARNING] Cannot get package.json description:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
 
 	// We prefer github's description
 	description := githubDescription
-	if description == "" {
-		description = packageJsonDescription
-	}
+	if rt.Name == runtimes.Node {
+		packageJsonDescription, err := GetPackageJsonDescription(manifest)
+		if err != nil {
+			log.Println("[WARNING] Cannot get package.json description:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-	startCmd, err := GetPackageJsonStartCmd(packageJson)
-	if err != nil {
-		log.Println("[WARNING] Cannot get package.json start command:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		if description == "" {
+			description = packageJsonDescription
+		}
 	}
 
-	// TODO: for now, we don't allow custom start command. Always use index.js
-	// as a starting point
-	startCmd = "node index.js"
+	// TODO: for now, we don't allow custom start command. Always use the
+	// default of the runtime (e.g., index.js for node) as a starting point
+	startCmd := rt.DefaultStartCmd
 
 	// Allocate a new worktree ID
 	app := &model.App{
 		WorktreeId:  uuid.NewV4().String(),
 		Description: description,
 		UserId:      userId,
+		Runtime:     rt.Name,
 		StartCmd:    startCmd,
 		EnvVars:     []model.KeyValuePair{},
 		ApiIds:      []string{},
@@ -190,10 +198,10 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	context, closeFunc, err := cluster.C().GetContext(app.Id, "", app.WorktreeId)
+	context, closeFunc, err := cluster.C().GetContext(r.Context(), app.Id, "", app.WorktreeId, AppContextOptions(app))
 	if err != nil {
 		log.Println("[ERROR] Cannot get context for app", app.Id, "err:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteContextError(w, err)
 		return
 	}
 	defer closeFunc()
@@ -220,18 +228,20 @@ func HandleAppsImportPost(userId string, w http.ResponseWriter, r *http.Request)
 		},
 		WaitForCompletion: true,
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), execReq)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, execReq)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot exec command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
 	// Also sync types
-	err = ContextSyncTypes(context)
+	err = ContextSyncTypes(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot sync types:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
@@ -32,7 +33,7 @@ func HandleAppAlivePost(userId string, app *model.App, context *cluster.Context,
 		err := model.C().UpdateApp(app, []string{"AccessedTime"})
 		if err != nil {
 			log.Println("[ERROR] Cannot update app in database:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteUpdateAppError(w, err)
 			return
 		}
 	}
@@ -49,10 +50,12 @@ func HandleAppFilesGet(userId string, app *model.App, context *cluster.Context,
 		TaskName:          "file_list",
 		WaitForCompletion: true,
 	}
-	resp, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextFileCallTimeout())
+	resp, err := context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -80,10 +83,10 @@ func HandleAppFileGet(userId string, app *model.App, context *cluster.Context, w
 		return
 	}
 
-	content, err := ContextReadFile(context, string(path))
+	content, err := ContextReadFile(r.Context(), context, string(path))
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -121,10 +124,12 @@ func HandleAppFilePost(userId string, app *model.App, context *cluster.Context,
 		Data:              content,
 		WaitForCompletion: true,
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextFileCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -177,10 +182,12 @@ func HandleAppFileMovePost(userId string, app *model.App, context *cluster.Conte
 			},
 		},
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextFileCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -233,10 +240,12 @@ func HandleAppFileCopyPost(userId string, app *model.App, context *cluster.Conte
 			},
 		},
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextFileCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -273,10 +282,12 @@ func HandleAppFileDelete(userId string, app *model.App, context *cluster.Context
 			},
 		},
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextFileCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -298,10 +309,10 @@ func HandleAppExportGet(userId string, app *model.App, context *cluster.Context,
 	SetCommonHeaders(w, false)
 
 	// get package.json file for packages
-	packageJsonContent, err := ContextReadFile(context, "package.json")
+	packageJsonContent, err := ContextReadFile(r.Context(), context, "package.json")
 	if err != nil {
 		log.Println("[ERROR] Cannot get package.json:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -326,10 +337,12 @@ func HandleAppExportGet(userId string, app *model.App, context *cluster.Context,
 		TaskName:          "file_export_zip",
 		WaitForCompletion: true,
 	}
-	resp, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+	resp, err := context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -408,10 +421,10 @@ func HandleAppExportGet(userId string, app *model.App, context *cluster.Context,
 func HandleAppEnablePost(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request) {
 	SetCommonHeaders(w, true)
 
-	err := ContextEnableAppProcess(context, app)
+	err := ContextEnableAppProcess(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot start process:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -424,17 +437,17 @@ func HandleAppUpdatePost(userId string, app *model.App, context *cluster.Context
 	SetCommonHeaders(w, true)
 
 	// We always try to enable the app before restarting it, in case the app is still sleeping
-	err := ContextEnableAppProcess(context, app)
+	err := ContextEnableAppProcess(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot enable app:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
-	err = ContextRestartAppProcess(context, app)
+	err = ContextRestartAppProcess(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot restart app:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -463,10 +476,12 @@ func HandleAppForkPost(userId string, app *model.App, w http.ResponseWriter, r *
 	context, closeFunc := cluster.C().GetExistingContext(app.Id)
 	if context != nil {
 		wtClient := context.GetWorktreeServiceClient()
-		_, err := wtClient.Save(gcontext.Background(), &worktreeproto.SaveReq{})
+		callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextSaveCallTimeout())
+		_, err := wtClient.Save(callCtx, &worktreeproto.SaveReq{})
+		cancel()
 		if err != nil {
 			log.Println("[ERROR] Cannot save worktree for app", app.Id, "err:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteCallError(w, err)
 			closeFunc()
 			return
 		}
@@ -487,6 +502,7 @@ func HandleAppForkPost(userId string, app *model.App, w http.ResponseWriter, r *
 		Description: app.Description,
 		Icon:        app.Icon,
 		UserId:      userId,
+		Runtime:     app.Runtime,
 		StartCmd:    app.StartCmd,
 		EnvVars:     newEnvVars,
 		ApiIds:      app.ApiIds,
@@ -499,10 +515,18 @@ func HandleAppForkPost(userId string, app *model.App, w http.ResponseWriter, r *
 		return
 	}
 
-	context, closeFunc, err = cluster.C().GetContext(forkApp.Id, app.WorktreeId, forkApp.WorktreeId)
+	// The gallery sorts by the number of forks. Missing one isn't worth
+	// failing the fork.
+	err = model.C().IncrementAppForkCount(app.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot count fork of app", app.Id, "in database:", err)
+	}
+
+	context, closeFunc, err = cluster.C().GetContext(r.Context(), forkApp.Id, app.WorktreeId, forkApp.WorktreeId,
+		AppContextOptions(forkApp))
 	if err != nil {
 		log.Println("[ERROR] Cannot create fork app context:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteContextError(w, err)
 		return
 	}
 	closeFunc()
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
+	"github.com/postverta/pv_backend/runtimes"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	"github.com/satori/go.uuid"
 	gcontext "golang.org/x/net/context"
@@ -17,44 +19,45 @@ import (
 	"strings"
 )
 
-// Couple of heuristics to look for the root directory in the ZIP file
-func findProjectRootAndPackageJson(zipContent []byte) (rootDir string, packageJsonString string, err error) {
+// Couple of heuristics to look for the root directory in the ZIP file, which
+// has the manifest file of the runtime (e.g., package.json)
+func findProjectRootAndManifest(zipContent []byte, manifestFile string) (rootDir string, manifestString string, err error) {
 	dataReader := bytes.NewReader(zipContent)
 	zipReader, err := zip.NewReader(dataReader, int64(len(zipContent)))
 	if err != nil {
 		return "", "", err
 	}
 
-	// The algorithm is fairly simple and naive. We find the package.json with the shortest path length.
-	var packageJsonFile *zip.File
+	// The algorithm is fairly simple and naive. We find the manifest with the shortest path length.
+	var manifest *zip.File
 	shortestPathLength := 0
 	rootDir = ""
 	for _, file := range zipReader.File {
-		if file.Name == "package.json" || strings.HasSuffix(file.Name, "/package.json") {
+		if file.Name == manifestFile || strings.HasSuffix(file.Name, "/"+manifestFile) {
 			if len(file.Name) < shortestPathLength || shortestPathLength == 0 {
 				shortestPathLength = len(file.Name)
-				packageJsonFile = file
+				manifest = file
 				rootDir = path.Dir(file.Name)
 			}
 		}
 	}
 
-	if packageJsonFile == nil {
-		return "", "", fmt.Errorf("Cannot find package.json in the zip")
+	if manifest == nil {
+		return "", "", fmt.Errorf("Cannot find %s in the zip", manifestFile)
 	}
 
-	packageJsonReader, err := packageJsonFile.Open()
+	manifestReader, err := manifest.Open()
 	if err != nil {
 		return "", "", err
 	}
-	defer packageJsonReader.Close()
+	defer manifestReader.Close()
 
-	packageJsonContent, err := ioutil.ReadAll(packageJsonReader)
+	manifestContent, err := ioutil.ReadAll(manifestReader)
 	if err != nil {
 		return "", "", err
 	}
 
-	return rootDir, string(packageJsonContent), nil
+	return rootDir, string(manifestContent), nil
 }
 
 func HandleAppsUploadPost(userId string, w http.ResponseWriter, r *http.Request) {
@@ -67,26 +70,39 @@ func HandleAppsUploadPost(userId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	rootDir, packageJsonString, err := findProjectRootAndPackageJson(content)
-	if err != nil {
-		log.Println("[WARNING] Cannot get package.json:", err)
+	// The body is the zip file, so the runtime comes as a query parameter
+	runtimeName := r.URL.Query().Get("runtime")
+	rt := runtimes.Get(runtimeName)
+	if rt == nil {
+		log.Println("[WARNING] Unknown runtime:", runtimeName)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	description, err := GetPackageJsonDescription(packageJsonString)
+	rootDir, manifestString, err := findProjectRootAndManifest(content, rt.ManifestFile)
 	if err != nil {
-		log.Println("[WARNING] Cannot parse package.json")
+		log.Println("[WARNING] Cannot get", rt.ManifestFile, "err:", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	description := ""
+	if rt.Name == runtimes.Node {
+		description, err = GetPackageJsonDescription(manifestString)
+		if err != nil {
+			log.Println("[WARNING] Cannot parse package.json")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Allocate a new worktree ID
 	app := &model.App{
 		WorktreeId:  uuid.NewV4().String(),
 		Description: description,
 		UserId:      userId,
-		StartCmd:    "node index.js",
+		Runtime:     rt.Name,
+		StartCmd:    rt.DefaultStartCmd,
 		EnvVars:     []model.KeyValuePair{},
 		ApiIds:      []string{},
 	}
@@ -98,10 +114,10 @@ func HandleAppsUploadPost(userId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	context, closeFunc, err := cluster.C().GetContext(app.Id, "", app.WorktreeId)
+	context, closeFunc, err := cluster.C().GetContext(r.Context(), app.Id, "", app.WorktreeId, AppContextOptions(app))
 	if err != nil {
 		log.Println("[ERROR] Cannot get context for app", app.Id, "err:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteContextError(w, err)
 		return
 	}
 	defer closeFunc()
@@ -117,18 +133,20 @@ func HandleAppsUploadPost(userId string, w http.ResponseWriter, r *http.Request)
 		Data:              content,
 		WaitForCompletion: true,
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), execReq)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, execReq)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot exec command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
 	// Also sync types
-	err = ContextSyncTypes(context)
+	err = ContextSyncTypes(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot sync types:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
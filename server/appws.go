@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/logmgr"
 	"github.com/postverta/pv_backend/model"
 	"github.com/postverta/pv_backend/util"
@@ -125,8 +126,8 @@ func HandleAppStateWebSocket(userId string, app *model.App, context *cluster.Con
 
 	for {
 		select {
-		case ps := <-stateChan:
-			err := kaConn.WriteMessage(websocket.TextMessage, []byte(ps.String()))
+		case event := <-stateChan:
+			err := kaConn.WriteMessage(websocket.TextMessage, []byte(event.State.String()))
 			if err != nil {
 				return
 			}
@@ -134,6 +135,9 @@ func HandleAppStateWebSocket(userId string, app *model.App, context *cluster.Con
 			return
 		case <-kaConn.InterruptedChan:
 			return
+		case <-context.Done:
+			// The context is going away, the client will reconnect
+			return
 		}
 	}
 }
@@ -141,27 +145,43 @@ func HandleAppStateWebSocket(userId string, app *model.App, context *cluster.Con
 func HandleAppLangServerWebSocket(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request) {
 	// First try to sync types dependencies. Must do this for legacy
 	// workspaces, as otherwise we won't find the root path.
-	err := ContextSyncTypes(context)
+	err := ContextSyncTypes(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot sync types:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
+		return
+	}
+
+	rt := app.GetRuntime()
+	if len(rt.LangServerCmd) == 0 {
+		log.Println("[WARNING] Runtime", rt.Name, "has no language server")
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	// Enable the language server process
+	port, err := context.AllocateProcessPort(LangServerProcessName, LangServerProcessPort)
+	if err != nil {
+		log.Println("[ERROR] Cannot allocate port for language server:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	req := &processproto.ConfigureProcessReq{
-		ProcessName:   "lang-server",
+		ProcessName:   LangServerProcessName,
 		Enabled:       true,
-		StartCmd:      []string{"/usr/local/bin/javascript-typescript-langserver", "-p", "2089"},
-		RunPath:       "/langserver",
-		ListeningPort: 2089,
+		StartCmd:      rt.GetLangServerCmd(port),
+		RunPath:       rt.LangServerRunPath,
+		ListeningPort: port,
 		EnvVars:       make([]*processproto.KeyValuePair, 0),
 	}
 
-	_, err = context.GetProcessServiceClient().ConfigureProcess(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextProcessCallTimeout())
+	_, err = context.GetProcessServiceClient().ConfigureProcess(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot enable language server process:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -175,12 +195,14 @@ func HandleAppLangServerWebSocket(userId string, app *model.App, context *cluste
 		}
 
 		req := &processproto.GetProcessStateReq{
-			ProcessName: "lang-server",
+			ProcessName: LangServerProcessName,
 		}
-		resp, err := context.GetProcessServiceClient().GetProcessState(gcontext.Background(), req)
+		callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextProcessCallTimeout())
+		resp, err := context.GetProcessServiceClient().GetProcessState(callCtx, req)
+		cancel()
 		if err != nil {
 			log.Println("[ERROR] Cannot get language server process state:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteCallError(w, err)
 			return
 		}
 
@@ -190,7 +212,8 @@ func HandleAppLangServerWebSocket(userId string, app *model.App, context *cluste
 		<-time.After(100 * time.Millisecond)
 	}
 
-	lspConn, err := net.Dial("tcp", context.LspEndpoint)
+	lspEndpoint, _ := context.GetProcessEndpoint(LangServerProcessName)
+	lspConn, err := net.Dial("tcp", lspEndpoint)
 	if err != nil {
 		log.Println("[ERROR] Cannot connect to the language server:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -311,5 +334,8 @@ func HandleAppLangServerWebSocket(userId string, app *model.App, context *cluste
 		return
 	case <-kaConn.InterruptedChan:
 		return
+	case <-context.Done:
+		// The context is going away, the client will reconnect
+		return
 	}
 }
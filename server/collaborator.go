@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+)
+
+// The owner comes first, then the collaborators in the order they were added
+func collaboratorsToJson(app *model.App) []model.Collaborator {
+	output := make([]model.Collaborator, 0, len(app.Collaborators)+1)
+	if app.UserId != "" {
+		output = append(output, model.Collaborator{
+			UserId: app.UserId,
+			Role:   model.RoleOwner,
+		})
+	}
+	return append(output, app.Collaborators...)
+}
+
+func isCollaborator(app *model.App, userId string) bool {
+	for _, collaborator := range app.Collaborators {
+		if collaborator.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func HandleAppCollaboratorsGet(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collaboratorsToJson(app))
+	w.Write(buf)
+}
+
+// Invite a user to the app with a role
+func HandleAppCollaboratorsPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	input := model.Collaborator{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.UserId == "" || !model.IsValidRole(input.Role) {
+		log.Println("[WARNING] Bad collaborator:", input.UserId, input.Role)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.UserId == app.UserId || isCollaborator(app, input.UserId) {
+		// Use HandleAppCollaboratorPost to change the role
+		log.Println("[WARNING] User", input.UserId, "already has access to the app")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = model.C().SetAppCollaborator(app, input.UserId, input.Role)
+	if err != nil {
+		log.Println("[ERROR] Cannot save app to database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collaboratorsToJson(app))
+	w.Write(buf)
+}
+
+// Change the role of a collaborator
+func HandleAppCollaboratorPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	collaboratorId := vars["user_id"]
+
+	type Input struct {
+		Role string `json:"role"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !model.IsValidRole(input.Role) {
+		log.Println("[WARNING] Bad role:", input.Role)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !isCollaborator(app, collaboratorId) {
+		log.Println("[WARNING] User", collaboratorId, "is not a collaborator of the app")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = model.C().SetAppCollaborator(app, collaboratorId, input.Role)
+	if err != nil {
+		log.Println("[ERROR] Cannot save app to database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collaboratorsToJson(app))
+	w.Write(buf)
+}
+
+// Remove a collaborator. Owners can remove anyone, and the others only
+// themselves.
+func HandleAppCollaboratorDelete(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	collaboratorId := vars["user_id"]
+
+	if collaboratorId != userId {
+		role, err := GetAppMemberRole(app, userId)
+		if err != nil {
+			log.Println("[ERROR] Cannot get team in database:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if role != model.RoleOwner {
+			log.Println("[WARNING] User", userId, "cannot remove other collaborators")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	if !isCollaborator(app, collaboratorId) {
+		// Nothing to delete
+		w.WriteHeader(http.StatusOK)
+		buf, _ := json.Marshal(collaboratorsToJson(app))
+		w.Write(buf)
+		return
+	}
+
+	err := model.C().RemoveAppCollaborator(app, collaboratorId)
+	if err != nil {
+		log.Println("[ERROR] Cannot save app to database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(collaboratorsToJson(app))
+	w.Write(buf)
+}
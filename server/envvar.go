@@ -132,27 +132,10 @@ func HandleAppEnvVarPost(userId string, app *model.App, w http.ResponseWriter, r
 		return
 	}
 
-	value := string(content)
-	found := false
-	for i, kv := range app.EnvVars {
-		if kv.Key == key {
-			app.EnvVars[i].Value = value
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		app.EnvVars = append(app.EnvVars, model.KeyValuePair{
-			Key:   key,
-			Value: value,
-		})
-	}
-
-	err = model.C().UpdateApp(app, []string{"EnvVars"})
+	err = model.C().SetAppEnvVar(app, key, string(content))
 	if err != nil {
 		log.Println("[ERROR] Cannot save app to database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
@@ -188,10 +171,8 @@ func HandleAppEnvVarDelete(userId string, app *model.App, w http.ResponseWriter,
 	// TODO: we shouldn't allow deleting API env vars either.
 
 	found := false
-	idx := 0
-	for i, kv := range app.EnvVars {
+	for _, kv := range app.EnvVars {
 		if kv.Key == key {
-			idx = i
 			found = true
 			break
 		}
@@ -203,13 +184,10 @@ func HandleAppEnvVarDelete(userId string, app *model.App, w http.ResponseWriter,
 		return
 	}
 
-	copy(app.EnvVars[idx:], app.EnvVars[idx+1:])
-	app.EnvVars = app.EnvVars[:len(app.EnvVars)-1]
-
-	err := model.C().UpdateApp(app, []string{"EnvVars"})
+	err := model.C().RemoveAppEnvVar(app, key)
 	if err != nil {
 		log.Println("[ERROR] Cannot save app to database:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteUpdateAppError(w, err)
 		return
 	}
 
@@ -2,12 +2,20 @@ package server
 
 import (
 	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
 	"log"
 	"net/http"
+	"regexp"
 	"strconv"
 )
 
+// List a page of the gallery apps. Besides the limit, the query can have a
+// search string q, a tag, a sort order (newest or popular) and the cursor of
+// the previous page. The cursor of the next page is returned in the
+// X-Next-Cursor header, which is missing on the last page, so the body stays
+// a list of apps.
 func HandleGalleryAppsGet(w http.ResponseWriter, r *http.Request) {
 	SetCommonHeaders(w, true)
 	queries := r.URL.Query()
@@ -25,8 +33,33 @@ func HandleGalleryAppsGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apps, err := model.C().GetGalleryApps(limit)
-	if err != nil {
+	if limit <= 0 || limit > config.GalleryMaxLimit() {
+		log.Println("[WARNING] Bad limit:", limit)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := model.GalleryQuery{
+		Search: queries.Get("q"),
+		Tag:    queries.Get("tag"),
+		Sort:   queries.Get("sort"),
+		Cursor: queries.Get("cursor"),
+		Limit:  limit,
+	}
+	if query.Sort == "" {
+		query.Sort = model.GallerySortNewest
+	} else if query.Sort != model.GallerySortNewest && query.Sort != model.GallerySortPopular {
+		log.Println("[WARNING] Bad sort:", query.Sort)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	apps, nextCursor, err := model.C().GetGalleryApps(query)
+	if model.IsBadCursorError(err) {
+		log.Println("[WARNING] Bad cursor:", query.Cursor)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Println("[ERROR] Cannot get apps in database:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -37,7 +70,132 @@ func HandleGalleryAppsGet(w http.ResponseWriter, r *http.Request) {
 		output = append(output, app.ToJsonMap())
 	}
 
+	// The browsers hide the other headers from the scripts
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor")
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func HandleGalleryCollectionsGet(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	collections, err := model.C().GetCollections()
+	if err != nil {
+		log.Println("[ERROR] Cannot get collections in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output := make([]map[string]interface{}, 0)
+	for _, collection := range collections {
+		output = append(output, collection.ToJsonMap())
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Return the collection with its apps, in the order the admins gave. Apps
+// that are gone or no longer in the gallery are skipped.
+func HandleGalleryCollectionGet(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+
+	collection, err := model.C().GetCollection(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get collection in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if collection == nil {
+		log.Println("[WARNING] Cannot find collection")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	apps, err := model.C().GetAppsByIds(collection.AppIds)
+	if err != nil {
+		log.Println("[ERROR] Cannot get apps in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	idToApp := make(map[string]*model.App)
+	for _, app := range apps {
+		idToApp[app.Id] = app
+	}
+
+	appsOutput := make([]map[string]interface{}, 0)
+	for _, appId := range collection.AppIds {
+		if app, found := idToApp[appId]; found && app.Gallery {
+			appsOutput = append(appsOutput, app.ToJsonMap())
+		}
+	}
+
+	output := collection.ToJsonMap()
+	output["apps"] = appsOutput
+
 	buf, _ := json.Marshal(output)
 	w.WriteHeader(http.StatusOK)
 	w.Write(buf)
 }
+
+// Replace the tags of the app, by which the gallery can be filtered
+func HandleAppTagsPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		Tags []string `json:"tags"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Tags) > 10 {
+		log.Println("[WARNING] Too many tags:", len(input.Tags))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tags := make(map[string]bool)
+	for _, tag := range input.Tags {
+		if matched, _ := regexp.MatchString(`^[a-z0-9][a-z0-9\-]*$`, tag); !matched || len(tag) > 30 {
+			log.Println("[WARNING] Bad tag:", tag)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if tags[tag] {
+			log.Println("[WARNING] Duplicate tag:", tag)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tags[tag] = true
+	}
+
+	app.Tags = input.Tags
+	if app.Tags == nil {
+		app.Tags = []string{}
+	}
+	err = model.C().UpdateApp(app, []string{"Tags"})
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(app.ToJsonMap())
+	w.Write(buf)
+}
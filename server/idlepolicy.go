@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Serializes the check of the always-on cap with the update, so that two
+// concurrent requests cannot both take the last slot.
+var alwaysOnMutex sync.Mutex
+
+func HandleAppIdlePolicyGet(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(app.IdlePolicyToJsonMap())
+	w.Write(buf)
+}
+
+func HandleAppIdlePolicyPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		IdlePolicy  string `json:"idle_policy"`
+		IdleTimeout int64  `json:"idle_timeout"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+	if err != nil {
+		log.Println("[WARNING] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch input.IdlePolicy {
+	case model.IdlePolicyDefault, model.IdlePolicyAlwaysOn:
+		input.IdleTimeout = 0
+	case model.IdlePolicyCustom:
+		idleTimeout := time.Duration(input.IdleTimeout) * time.Second
+		if idleTimeout < config.AppMinIdleTimeout() || idleTimeout > config.AppMaxIdleTimeout() {
+			log.Println("[WARNING] Idle timeout out of range:", input.IdleTimeout)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		log.Println("[WARNING] Unknown idle policy:", input.IdlePolicy)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	alwaysOnMutex.Lock()
+	defer alwaysOnMutex.Unlock()
+
+	if input.IdlePolicy == model.IdlePolicyAlwaysOn && app.GetIdlePolicy() != model.IdlePolicyAlwaysOn {
+		// The limit is per owner, be it a user or a team
+		var apps []*model.App
+		if app.TeamId != "" {
+			apps, err = model.C().GetAppsByTeamId(app.TeamId)
+		} else {
+			apps, err = model.C().GetAppsByUserId(app.UserId)
+		}
+		if err != nil {
+			log.Println("[ERROR] Cannot get apps from database:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		numAlwaysOn := 0
+		for _, userApp := range apps {
+			if userApp.GetIdlePolicy() == model.IdlePolicyAlwaysOn {
+				numAlwaysOn++
+			}
+		}
+
+		if numAlwaysOn >= config.AppMaxAlwaysOnAppsPerUser() {
+			log.Println("[WARNING] Owner of app", app.Id, "has too many always-on apps")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	app.IdlePolicy = input.IdlePolicy
+	app.IdleTimeout = input.IdleTimeout
+	err = model.C().UpdateApp(app, []string{"IdlePolicy", "IdleTimeout"})
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	// Apply the new policy to the running context right away
+	cluster.C().SetAppIdleTimeout(app.Id, cluster.AppIdleTimeout(app))
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(app.IdlePolicyToJsonMap())
+	w.Write(buf)
+}
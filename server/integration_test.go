@@ -0,0 +1,413 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/fake"
+	"github.com/postverta/pv_backend/model"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The suite drives the API server end to end: the handlers run against a
+// DummyClient, and a cluster of fake agents, which keep the files and the
+// processes of the contexts in memory.
+var (
+	testAgents []*fake.Agent
+	testServer *httptest.Server
+)
+
+func TestMain(m *testing.M) {
+	agents, agentConfigs, err := fake.StartAgents(2)
+	if err != nil {
+		log.Fatal("Cannot start fake agents:", err)
+	}
+	testAgents = agents
+
+	err = model.InitGlobalClient(func() (model.Client, error) {
+		return model.NewDummyClient(), nil
+	})
+	if err != nil {
+		log.Fatal("Cannot initialize database:", err)
+	}
+
+	placement, err := cluster.NewPlacementStrategy(config.ClusterPlacementStrategy())
+	if err != nil {
+		log.Fatal("Cannot create placement strategy:", err)
+	}
+	err = cluster.InitGlobalCluster(agentConfigs, placement, config.ClusterContextExpirationTime())
+	if err != nil {
+		log.Fatal("Cannot initialize cluster:", err)
+	}
+
+	testServer = httptest.NewServer(NewRouter())
+	code := m.Run()
+
+	testServer.Close()
+	cluster.C().Shutdown(config.ClusterShutdownDeadline(), true)
+	for _, agent := range testAgents {
+		agent.Stop()
+	}
+	os.Exit(code)
+}
+
+func testAccessToken(t *testing.T, userId string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": userId})
+	accessToken, err := token.SignedString(config.Auth0Secret())
+	if err != nil {
+		t.Fatal("Cannot sign access token:", err)
+	}
+	return accessToken
+}
+
+// Send a request to the API server as the user, or anonymously if userId is
+// empty. Return the status code and the body of the response.
+func testRequest(t *testing.T, userId string, method string, path string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, testServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot create request:", err)
+	}
+	if userId != "" {
+		req.Header.Set("Authorization", "Bearer "+testAccessToken(t, userId))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Cannot send request:", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Cannot read response:", err)
+	}
+	return resp.StatusCode, buf
+}
+
+// Like testRequest, but fail the test unless the status code is the expected
+// one
+func expectRequest(t *testing.T, expectedStatus int, userId string, method string, path string, body string) []byte {
+	status, buf := testRequest(t, userId, method, path, body)
+	if status != expectedStatus {
+		t.Fatalf("%s %s as %q: expecting status %d, got %d", method, path, userId, expectedStatus, status)
+	}
+	return buf
+}
+
+func decodeTestResponse(t *testing.T, buf []byte, v interface{}) {
+	err := json.Unmarshal(buf, v)
+	if err != nil {
+		t.Fatalf("Cannot decode response %q: %s", buf, err)
+	}
+}
+
+func newTestApp(t *testing.T, app *model.App) *model.App {
+	app.WorktreeId = uuid.NewV4().String()
+	app, err := model.C().NewApp(app)
+	if err != nil {
+		t.Fatal("Cannot create app:", err)
+	}
+	return app
+}
+
+func newTestTeam(t *testing.T, members ...model.TeamMember) *model.Team {
+	team, err := model.C().NewTeam(&model.Team{Name: "team", Members: members})
+	if err != nil {
+		t.Fatal("Cannot create team:", err)
+	}
+	return team
+}
+
+// A user no other test knows, for the tests that count the apps of the
+// user, as the database is shared by all the tests
+func newTestUserId(name string) string {
+	return name + "-" + uuid.NewV4().String()
+}
+
+func getTestApp(t *testing.T, id string) *model.App {
+	app, err := model.C().GetApp(id)
+	if err != nil || app == nil {
+		t.Fatal("Cannot get app", id, "err:", err)
+	}
+	return app
+}
+
+// Get the fake context of the app, on whichever agent it was opened
+func getTestContext(t *testing.T, app *model.App) *fake.Context {
+	for _, agent := range testAgents {
+		if context := agent.GetContextByWorktreeId(app.WorktreeId); context != nil {
+			return context
+		}
+	}
+	t.Fatal("Cannot find context of app", app.Id)
+	return nil
+}
+
+func testFilePath(path string) string {
+	return base64.StdEncoding.EncodeToString([]byte(path))
+}
+
+func responseAppIds(t *testing.T, buf []byte) map[string]string {
+	apps := []map[string]interface{}{}
+	decodeTestResponse(t, buf, &apps)
+	roles := make(map[string]string)
+	for _, app := range apps {
+		role, _ := app["role"].(string)
+		roles[app["id"].(string)] = role
+	}
+	return roles
+}
+
+func TestFiles(t *testing.T) {
+	app := newTestApp(t, &model.App{UserId: "alice"})
+	appPath := "/app/" + app.Id
+
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/file/"+testFilePath("index.js"), "hello")
+	if files := getTestContext(t, app).GetFiles(); string(files["index.js"]) != "hello" {
+		t.Error("Wrong files in context:", files)
+	}
+
+	// Everyone can read the files of a public app, but not change them
+	files := []string{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "", "GET", appPath+"/files", ""), &files)
+	if len(files) != 1 || files[0] != "index.js" {
+		t.Error("Wrong files:", files)
+	}
+	content := expectRequest(t, http.StatusOK, "", "GET", appPath+"/file/"+testFilePath("index.js"), "")
+	if string(content) != "hello" {
+		t.Errorf("Wrong file content %q", content)
+	}
+	expectRequest(t, http.StatusForbidden, "mallory", "POST", appPath+"/file/"+testFilePath("index.js"), "bye")
+	expectRequest(t, http.StatusForbidden, "mallory", "DELETE", appPath+"/file/"+testFilePath("index.js"), "")
+
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/file/"+testFilePath("index.js")+"/move",
+		`{"To": "main.js"}`)
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/file/"+testFilePath("main.js")+"/copy",
+		`{"To": "copy.js"}`)
+	expectRequest(t, http.StatusOK, "alice", "DELETE", appPath+"/file/"+testFilePath("main.js"), "")
+
+	contextFiles := getTestContext(t, app).GetFiles()
+	if len(contextFiles) != 1 || string(contextFiles["copy.js"]) != "hello" {
+		t.Error("Wrong files in context:", contextFiles)
+	}
+	expectRequest(t, http.StatusBadRequest, "alice", "GET", appPath+"/file/not-base64", "")
+}
+
+func TestProcesses(t *testing.T) {
+	app := newTestApp(t, &model.App{UserId: "alice"})
+	appPath := "/app/" + app.Id
+
+	output := struct {
+		Port uint32 `json:"port"`
+	}{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/process/worker",
+		`{"start_cmd": "node worker.js", "listening": true}`), &output)
+	if output.Port == 0 {
+		t.Error("Listening process has no port")
+	}
+
+	process := getTestContext(t, app).GetProcess("worker")
+	if process == nil || process.State.String() != "RUNNING" {
+		t.Fatal("Process is not running:", process)
+	}
+	if process.ListeningPort != output.Port || process.EnvVars["PORT"] != fmt.Sprintf("%d", output.Port) {
+		t.Error("Process doesn't listen on port", output.Port, "process:", process)
+	}
+
+	state := struct {
+		State string `json:"state"`
+	}{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "", "GET", appPath+"/process/worker", ""), &state)
+	if state.State != "RUNNING" {
+		t.Error("Wrong process state:", state.State)
+	}
+
+	// The processes of the backend are off limits
+	expectRequest(t, http.StatusBadRequest, "alice", "POST", appPath+"/process/"+AppProcessName,
+		`{"start_cmd": "node index.js"}`)
+	expectRequest(t, http.StatusBadRequest, "alice", "POST", appPath+"/process/worker2", `{}`)
+	expectRequest(t, http.StatusForbidden, "mallory", "DELETE", appPath+"/process/worker", "")
+
+	expectRequest(t, http.StatusOK, "alice", "DELETE", appPath+"/process/worker", "")
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "", "GET", appPath+"/process/worker", ""), &state)
+	if state.State != "NOT_RUNNING" {
+		t.Error("Wrong process state:", state.State)
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	app := newTestApp(t, &model.App{UserId: "alice"})
+	appPath := "/app/" + app.Id
+
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/env_var/FOO", "bar")
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/env_var/BAZ", "qux")
+	expectRequest(t, http.StatusBadRequest, "alice", "POST", appPath+"/env_var/1FOO", "bar")
+	expectRequest(t, http.StatusForbidden, "mallory", "POST", appPath+"/env_var/FOO", "evil")
+	expectRequest(t, http.StatusForbidden, "mallory", "GET", appPath+"/env_vars", "")
+
+	envVars := map[string][]map[string]interface{}{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "alice", "GET", appPath+"/env_vars", ""), &envVars)
+	defaultEnvVars := envVars["_default"]
+	if len(defaultEnvVars) != 2 || defaultEnvVars[0]["key"] != "BAZ" || defaultEnvVars[1]["key"] != "FOO" ||
+		defaultEnvVars[1]["value"] != "bar" {
+		t.Error("Wrong env vars:", defaultEnvVars)
+	}
+
+	expectRequest(t, http.StatusOK, "alice", "DELETE", appPath+"/env_var/FOO", "")
+	expectRequest(t, http.StatusOK, "alice", "DELETE", appPath+"/env_var/FOO", "")
+	if app = getTestApp(t, app.Id); len(app.EnvVars) != 1 || app.EnvVars[0].Key != "BAZ" {
+		t.Error("Wrong env vars in database:", app.EnvVars)
+	}
+}
+
+func TestCollaborators(t *testing.T) {
+	app := newTestApp(t, &model.App{UserId: "alice"})
+	appPath := "/app/" + app.Id
+
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/collaborators", `{"user_id": "bob", "role": "editor"}`)
+	expectRequest(t, http.StatusConflict, "alice", "POST", appPath+"/collaborators", `{"user_id": "bob", "role": "viewer"}`)
+	expectRequest(t, http.StatusBadRequest, "alice", "POST", appPath+"/collaborators", `{"user_id": "carol", "role": "admin"}`)
+	expectRequest(t, http.StatusForbidden, "bob", "POST", appPath+"/collaborators", `{"user_id": "carol", "role": "viewer"}`)
+	expectRequest(t, http.StatusOK, "bob", "POST", appPath+"/env_var/FOO", "bar")
+
+	collaborators := []model.Collaborator{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "bob", "GET", appPath+"/collaborators", ""), &collaborators)
+	if len(collaborators) != 2 || collaborators[0] != (model.Collaborator{UserId: "alice", Role: model.RoleOwner}) ||
+		collaborators[1] != (model.Collaborator{UserId: "bob", Role: model.RoleEditor}) {
+		t.Error("Wrong collaborators:", collaborators)
+	}
+
+	// Public viewers of the app aren't members of it
+	expectRequest(t, http.StatusForbidden, "mallory", "GET", appPath+"/collaborators", "")
+	expectRequest(t, http.StatusForbidden, "mallory", "DELETE", appPath+"/collaborator/mallory", "")
+	expectRequest(t, http.StatusForbidden, "bob", "DELETE", appPath+"/collaborator/alice", "")
+
+	expectRequest(t, http.StatusOK, "alice", "POST", appPath+"/collaborator/bob", `{"role": "viewer"}`)
+	expectRequest(t, http.StatusNotFound, "alice", "POST", appPath+"/collaborator/carol", `{"role": "viewer"}`)
+	expectRequest(t, http.StatusForbidden, "bob", "POST", appPath+"/env_var/FOO", "baz")
+
+	expectRequest(t, http.StatusOK, "bob", "DELETE", appPath+"/collaborator/bob", "")
+	expectRequest(t, http.StatusForbidden, "bob", "GET", appPath+"/collaborators", "")
+	if app = getTestApp(t, app.Id); len(app.Collaborators) != 0 {
+		t.Error("Wrong collaborators in database:", app.Collaborators)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	team := struct {
+		Id   string `json:"id"`
+		Role string `json:"role"`
+	}{}
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "alice", "POST", "/teams", `{"name": "Team"}`), &team)
+	if team.Role != model.RoleOwner {
+		t.Error("Creator of the team has role", team.Role)
+	}
+	teamPath := "/team/" + team.Id
+	app := newTestApp(t, &model.App{TeamId: team.Id, Private: true})
+
+	expectRequest(t, http.StatusForbidden, "bob", "GET", teamPath, "")
+	expectRequest(t, http.StatusForbidden, "bob", "GET", "/app/"+app.Id, "")
+	if roles := responseAppIds(t, expectRequest(t, http.StatusOK, "bob", "GET", "/apps", "")); roles[app.Id] != "" {
+		t.Error("Non-member of the team has role", roles[app.Id])
+	}
+
+	expectRequest(t, http.StatusOK, "alice", "POST", teamPath+"/members", `{"user_id": "bob", "role": "viewer"}`)
+	expectRequest(t, http.StatusConflict, "alice", "POST", teamPath+"/members", `{"user_id": "bob", "role": "editor"}`)
+	expectRequest(t, http.StatusForbidden, "bob", "POST", teamPath+"/members", `{"user_id": "carol", "role": "viewer"}`)
+	expectRequest(t, http.StatusForbidden, "carol", "DELETE", teamPath+"/member/carol", "")
+
+	decodeTestResponse(t, expectRequest(t, http.StatusOK, "bob", "GET", teamPath, ""), &team)
+	if team.Role != model.RoleViewer {
+		t.Error("Wrong role of member:", team.Role)
+	}
+	expectRequest(t, http.StatusOK, "bob", "GET", "/app/"+app.Id, "")
+	if roles := responseAppIds(t, expectRequest(t, http.StatusOK, "bob", "GET", teamPath+"/apps", "")); roles[app.Id] != model.RoleViewer {
+		t.Error("Wrong apps of team:", roles)
+	}
+
+	// The last owner cannot leave
+	expectRequest(t, http.StatusConflict, "alice", "DELETE", teamPath+"/member/alice", "")
+	expectRequest(t, http.StatusConflict, "alice", "POST", teamPath+"/member/alice", `{"role": "editor"}`)
+
+	expectRequest(t, http.StatusOK, "bob", "DELETE", teamPath+"/member/bob", "")
+	expectRequest(t, http.StatusForbidden, "bob", "GET", teamPath, "")
+	expectRequest(t, http.StatusForbidden, "bob", "GET", "/app/"+app.Id, "")
+}
+
+func TestAppsRoles(t *testing.T) {
+	dave := newTestUserId("dave")
+	team := newTestTeam(t, model.TeamMember{UserId: "alice", Role: model.RoleOwner},
+		model.TeamMember{UserId: dave, Role: model.RoleEditor})
+	otherTeam := newTestTeam(t, model.TeamMember{UserId: "alice", Role: model.RoleOwner})
+	ownApp := newTestApp(t, &model.App{UserId: dave})
+	teamApp := newTestApp(t, &model.App{UserId: dave, TeamId: team.Id})
+	otherTeamApp := newTestApp(t, &model.App{UserId: "carol", TeamId: otherTeam.Id})
+	sharedApp := newTestApp(t, &model.App{UserId: "carol", Private: true})
+	err := model.C().SetAppCollaborator(sharedApp, dave, model.RoleViewer)
+	if err != nil {
+		t.Fatal("Cannot add collaborator:", err)
+	}
+	err = model.C().SetAppCollaborator(otherTeamApp, dave, model.RoleEditor)
+	if err != nil {
+		t.Fatal("Cannot add collaborator:", err)
+	}
+
+	roles := responseAppIds(t, expectRequest(t, http.StatusOK, dave, "GET", "/apps", ""))
+	expectedRoles := map[string]string{
+		ownApp.Id:       model.RoleOwner,
+		teamApp.Id:      model.RoleOwner,
+		otherTeamApp.Id: model.RoleEditor,
+		sharedApp.Id:    model.RoleViewer,
+	}
+	if len(roles) != len(expectedRoles) {
+		t.Error("Wrong apps:", roles)
+	}
+	for id, role := range expectedRoles {
+		if roles[id] != role {
+			t.Error("App", id, "has role", roles[id], "instead of", role)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	erin := newTestUserId("erin")
+	frank := newTestUserId("frank")
+	team := newTestTeam(t, model.TeamMember{UserId: erin, Role: model.RoleOwner},
+		model.TeamMember{UserId: frank, Role: model.RoleEditor})
+	ownApp := newTestApp(t, &model.App{UserId: erin})
+	teamApp := newTestApp(t, &model.App{TeamId: team.Id})
+
+	expectRequest(t, http.StatusForbidden, frank, "DELETE", "/app/"+teamApp.Id, "")
+	expectRequest(t, http.StatusOK, erin, "DELETE", "/app/"+ownApp.Id, "")
+	expectRequest(t, http.StatusOK, erin, "DELETE", "/app/"+teamApp.Id, "")
+	expectRequest(t, http.StatusNotFound, erin, "GET", "/app/"+teamApp.Id, "")
+	expectRequest(t, http.StatusNotFound, erin, "POST", "/app/"+teamApp.Id+"/env_var/FOO", "bar")
+
+	// The owners of the team see its apps in the trash, its other members
+	// don't
+	trash := responseAppIds(t, expectRequest(t, http.StatusOK, erin, "GET", "/apps/trash", ""))
+	if _, found := trash[ownApp.Id]; !found || len(trash) != 2 {
+		t.Error("Wrong trash:", trash)
+	}
+	if _, found := trash[teamApp.Id]; !found {
+		t.Error("Team app is missing from the trash of its owner:", trash)
+	}
+	if trash := responseAppIds(t, expectRequest(t, http.StatusOK, frank, "GET", "/apps/trash", "")); len(trash) != 0 {
+		t.Error("Wrong trash of team editor:", trash)
+	}
+
+	expectRequest(t, http.StatusForbidden, frank, "POST", "/apps/trash/"+teamApp.Id+"/restore", "")
+	expectRequest(t, http.StatusOK, erin, "POST", "/apps/trash/"+teamApp.Id+"/restore", "")
+	expectRequest(t, http.StatusNotFound, erin, "POST", "/apps/trash/"+teamApp.Id+"/restore", "")
+	expectRequest(t, http.StatusOK, frank, "GET", "/app/"+teamApp.Id, "")
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"log"
+	"net/http"
+)
+
+func HandleInternalAgentsPost(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		Endpoint string `json:"endpoint"`
+		Weight   uint   `json:"weight"`
+		Capacity uint   `json:"capacity"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+	if err != nil {
+		log.Println("[WARNING] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.Endpoint == "" {
+		log.Println("[WARNING] Must provide agent endpoint")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.Weight == 0 {
+		input.Weight = 1
+	}
+
+	err = cluster.C().AddAgent(config.AgentConfig{
+		Endpoint: input.Endpoint,
+		Weight:   input.Weight,
+		Capacity: input.Capacity,
+	})
+	if cluster.IsDuplicateAgentError(err) {
+		log.Println("[WARNING] Agent already exists:", input.Endpoint)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot add agent", input.Endpoint, "err:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleInternalAgentDelete(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	endpoint := vars["endpoint"]
+
+	err := cluster.C().RemoveAgent(endpoint)
+	if cluster.IsUnknownAgentError(err) {
+		log.Println("[WARNING] Cannot find agent:", endpoint)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if cluster.IsAgentInUseError(err) {
+		log.Println("[WARNING] Agent still has contexts:", endpoint)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot remove agent", endpoint, "err:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleInternalAgentDrainPost(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	endpoint := vars["endpoint"]
+
+	failedAppIds, err := cluster.C().DrainAgent(endpoint)
+	if cluster.IsUnknownAgentError(err) {
+		log.Println("[WARNING] Cannot find agent:", endpoint)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot drain agent", endpoint, "err:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Draining is done when no app failed. Otherwise the caller can retry
+	// later, the agent stays out of placement in the meantime.
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"failed_app_ids": failedAppIds,
+	})
+	w.Write(buf)
+}
+
+// Report the hits and misses of the container pool. A high miss rate means
+// the pool is too small.
+func HandleInternalPoolGet(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(cluster.C().GetPoolStats())
+	w.Write(buf)
+}
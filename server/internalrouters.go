@@ -32,6 +32,34 @@ var internalRoutes = []Route{
 		HandleInternalAppLogPost,
 	},
 
+	Route{
+		"InternalAgentsPost",
+		"POST",
+		"/internal/agents",
+		HandleInternalAgentsPost,
+	},
+
+	Route{
+		"InternalAgentDelete",
+		"DELETE",
+		"/internal/agent/{endpoint}",
+		HandleInternalAgentDelete,
+	},
+
+	Route{
+		"InternalAgentDrainPost",
+		"POST",
+		"/internal/agent/{endpoint}/drain",
+		HandleInternalAgentDrainPost,
+	},
+
+	Route{
+		"InternalPoolGet",
+		"GET",
+		"/internal/pool",
+		HandleInternalPoolGet,
+	},
+
 	/*
 		Route{
 			"InternalAppBackup",
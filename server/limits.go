@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type userPlanCacheEntry struct {
+	plan        string
+	expiredTime time.Time
+}
+
+var userPlanCache = make(map[string]userPlanCacheEntry)
+var userPlanCacheMutex sync.Mutex
+
+// When the expired entries are next dropped from the cache
+var userPlanCacheSweepTime time.Time
+
+// Get the plan of a user. It is cached, as it is needed for every request
+// that may open a context. If the user cannot be read, fall back to the free
+// plan.
+func GetUserPlan(userId string) string {
+	if userId == "" {
+		return model.PlanFree
+	}
+
+	userPlanCacheMutex.Lock()
+	entry, found := userPlanCache[userId]
+	userPlanCacheMutex.Unlock()
+	if found && time.Now().Before(entry.expiredTime) {
+		return entry.plan
+	}
+
+	plan := model.PlanFree
+	cacheTime := config.UserPlanCacheTime()
+	user, err := model.C().GetUser(userId)
+	if err != nil {
+		// Retry soon, but don't hammer Auth0 while it is down
+		log.Println("[WARNING] Cannot get user", userId, "assuming free plan, err:", err)
+		cacheTime = config.UserPlanFailureCacheTime()
+	} else if user != nil {
+		plan = user.Plan
+	}
+
+	now := time.Now()
+	userPlanCacheMutex.Lock()
+	userPlanCache[userId] = userPlanCacheEntry{
+		plan:        plan,
+		expiredTime: now.Add(cacheTime),
+	}
+	if now.After(userPlanCacheSweepTime) {
+		for id, entry := range userPlanCache {
+			if now.After(entry.expiredTime) {
+				delete(userPlanCache, id)
+			}
+		}
+		userPlanCacheSweepTime = now.Add(config.UserPlanCacheTime())
+	}
+	userPlanCacheMutex.Unlock()
+	return plan
+}
+
+// Get the effective resource limits of an app. Team apps have no owning user,
+// so they get the defaults of the free plan unless the admins raise them.
+func AppResourceLimits(app *model.App) model.ResourceLimits {
+	return app.Limits.WithDefaults(model.DefaultResourceLimits(GetUserPlan(app.UserId)))
+}
+
+func AppContextOptions(app *model.App) cluster.ContextOptions {
+	return cluster.ContextOptions{
+		IdleTimeout: cluster.AppIdleTimeout(app),
+		Limits:      AppResourceLimits(app),
+		Runtime:     app.GetRuntime(),
+	}
+}
+
+func appLimitsToJsonMap(app *model.App) map[string]interface{} {
+	return map[string]interface{}{
+		"plan":      GetUserPlan(app.UserId),
+		"limits":    AppResourceLimits(app),
+		"overrides": app.Limits,
+	}
+}
+
+func HandleAppLimitsGet(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(appLimitsToJsonMap(app))
+	w.Write(buf)
+}
+
+// Override the limits of an app. Zero values fall back to the defaults of the
+// plan. The new limits apply the next time the context of the app is opened.
+func HandleAdminAppLimitsPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	limits := model.ResourceLimits{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&limits)
+	if err != nil {
+		log.Println("[WARNING] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if limits.CpuMillis < 0 || limits.MemoryMB < 0 || limits.DiskMB < 0 || limits.MaxProcesses < 0 {
+		log.Println("[WARNING] Negative resource limits:", limits)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log.Println("[INFO] Admin", userId, "setting limits of app", app.Id, "to", limits)
+	app.Limits = limits
+	err = model.C().UpdateApp(app, []string{"Limits"})
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(appLimitsToJsonMap(app))
+	w.Write(buf)
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/postverta/pv_backend/cluster"
 	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"log"
 	"net/http"
 	"strings"
@@ -16,6 +19,8 @@ type HttpHandlerWithUserId func(userId string, w http.ResponseWriter, r *http.Re
 
 type HttpHandlerWithUserIdAndApp func(userId string, app *model.App, w http.ResponseWriter, r *http.Request)
 
+type HttpHandlerWithUserIdAndTeam func(userId string, team *model.Team, w http.ResponseWriter, r *http.Request)
+
 type HttpHandlerWithContext func(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request)
 
 func verifyAccessToken(accessToken string) (valid bool, userId string) {
@@ -59,13 +64,59 @@ func CheckAuth(inner HttpHandlerWithUserId, authOptional bool) http.HandlerFunc
 		} else if !authOptional {
 			SetCommonHeaders(w, true)
 			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
 
 		inner(userId, w, r)
 	})
 }
 
-func CheckApp(inner HttpHandlerWithUserIdAndApp, publicAccess bool, ignoreOwnership bool) HttpHandlerWithUserId {
+// Only let the admins through. Must be wrapped in CheckAuth.
+func CheckAdmin(inner HttpHandlerWithUserId) HttpHandlerWithUserId {
+	return HttpHandlerWithUserId(func(userId string, w http.ResponseWriter, r *http.Request) {
+		if !IsAdmin(userId) {
+			log.Println("[WARNING] User", userId, "is not an admin")
+			SetCommonHeaders(w, true)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		inner(userId, w, r)
+	})
+}
+
+func IsAdmin(userId string) bool {
+	if userId == "" {
+		return false
+	}
+
+	for _, adminUserId := range config.AdminUserIds() {
+		if adminUserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Let anyone through CheckApp, e.g., for the routes that check the access on
+// their own
+const AnyRole = ""
+
+// Load the app, and only let the users with at least the required role on it
+// through, see GetAppRole.
+func CheckApp(inner HttpHandlerWithUserIdAndApp, requiredRole string) HttpHandlerWithUserId {
+	return checkApp(inner, requiredRole, GetAppRole)
+}
+
+// Like CheckApp, but the role must have been given to the user, see
+// GetAppMemberRole. For the routes about the members of the app, which the
+// public viewers of the app have no business with.
+func CheckAppMember(inner HttpHandlerWithUserIdAndApp, requiredRole string) HttpHandlerWithUserId {
+	return checkApp(inner, requiredRole, GetAppMemberRole)
+}
+
+func checkApp(inner HttpHandlerWithUserIdAndApp, requiredRole string,
+	getRole func(app *model.App, userId string) (string, error)) HttpHandlerWithUserId {
 	return HttpHandlerWithUserId(func(userId string, w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		appId := vars["id"]
@@ -86,24 +137,166 @@ func CheckApp(inner HttpHandlerWithUserIdAndApp, publicAccess bool, ignoreOwners
 			return
 		}
 
-		if app.UserId != userId && app.UserId != "" && !ignoreOwnership &&
-			(app.Private || !publicAccess) {
-			log.Println("[WARNING] User doesn't own the app")
+		if requiredRole != AnyRole {
+			role, err := getRole(app, userId)
+			if err != nil {
+				log.Println("[ERROR] Cannot get team in database:", err)
+				SetCommonHeaders(w, true)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if !model.RoleIncludes(role, requiredRole) {
+				log.Println("[WARNING] User doesn't have the", requiredRole, "role on the app")
+				SetCommonHeaders(w, true)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		inner(userId, app, w, r)
+	})
+}
+
+// The role of a user on the app, see model.App.GetRole. The team of the app,
+// if any, is loaded for it.
+func GetAppRole(app *model.App, userId string) (string, error) {
+	team, err := getAppTeam(app)
+	if err != nil {
+		return "", err
+	}
+	return app.GetRole(userId, team), nil
+}
+
+// The role given to a user on the app, see model.App.GetMemberRole
+func GetAppMemberRole(app *model.App, userId string) (string, error) {
+	team, err := getAppTeam(app)
+	if err != nil {
+		return "", err
+	}
+	return app.GetMemberRole(userId, team), nil
+}
+
+func getAppTeam(app *model.App) (*model.Team, error) {
+	if app.TeamId == "" {
+		return nil, nil
+	}
+	return model.C().GetTeam(app.TeamId)
+}
+
+// Load the team, and only let its members with at least the required role in
+// it through. Unlike the apps, teams have no public viewers, so any role
+// requires an explicit membership.
+func CheckTeam(inner HttpHandlerWithUserIdAndTeam, requiredRole string) HttpHandlerWithUserId {
+	return HttpHandlerWithUserId(func(userId string, w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		team, err := model.C().GetTeam(vars["id"])
+		if err != nil {
+			log.Println("[ERROR] Cannot get team in database:", err)
+			SetCommonHeaders(w, true)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if team == nil {
+			log.Println("[WARNING] Cannot find team")
+			SetCommonHeaders(w, true)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !model.RoleIncludes(team.GetRole(userId), requiredRole) {
+			log.Println("[WARNING] User doesn't have the", requiredRole, "role in the team")
 			SetCommonHeaders(w, true)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 
-		inner(userId, app, w, r)
+		inner(userId, team, w, r)
 	})
 }
 
+// Map an error from cluster.GetContext to the HTTP status code
+func ContextErrorStatusCode(err error) int {
+	if cluster.IsClusterFullError(err) || cluster.IsAppQuarantinedError(err) ||
+		cluster.IsClusterShuttingDownError(err) {
+		return http.StatusServiceUnavailable
+	}
+	return CallErrorStatusCode(err)
+}
+
+// Write the response for an error from cluster.GetContext. Errors the client
+// can act upon come with a code in the body.
+func WriteContextError(w http.ResponseWriter, err error) {
+	code := ""
+	if cluster.IsClusterFullError(err) {
+		code = "cluster_full"
+	} else if cluster.IsAppQuarantinedError(err) {
+		code = "app_unavailable"
+	} else if cluster.IsClusterShuttingDownError(err) {
+		code = "shutting_down"
+	} else {
+		WriteCallError(w, err)
+		return
+	}
+
+	w.WriteHeader(ContextErrorStatusCode(err))
+	buf, _ := json.Marshal(map[string]string{
+		"error": code,
+	})
+	w.Write(buf)
+}
+
+// Write the response for an error from model.UpdateApp. A version conflict
+// means a concurrent request changed the app first, and the client may retry.
+func WriteUpdateAppError(w http.ResponseWriter, err error) {
+	if !model.IsVersionConflictError(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	buf, _ := json.Marshal(map[string]string{
+		"error": "conflict",
+	})
+	w.Write(buf)
+}
+
+// Not a standard code, but commonly used in logs for requests whose client
+// went away before the response
+const StatusClientClosedRequest = 499
+
+// Map an error from a gRPC call to a context to the HTTP status code
+func CallErrorStatusCode(err error) int {
+	switch grpc.Code(err) {
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Canceled:
+		return StatusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Write the response for a failed gRPC call to a context. Timeouts come with
+// a code in the body, like the errors of WriteContextError.
+func WriteCallError(w http.ResponseWriter, err error) {
+	w.WriteHeader(CallErrorStatusCode(err))
+	if grpc.Code(err) == codes.DeadlineExceeded {
+		buf, _ := json.Marshal(map[string]string{
+			"error": "timeout",
+		})
+		w.Write(buf)
+	}
+}
+
 func CheckAppContext(inner HttpHandlerWithContext) HttpHandlerWithUserIdAndApp {
 	return HttpHandlerWithUserIdAndApp(func(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
-		context, closeFunc, err := cluster.C().GetContext(app.Id, app.WorktreeId, app.WorktreeId)
+		context, closeFunc, err := cluster.C().GetContext(r.Context(), app.Id, app.WorktreeId, app.WorktreeId,
+			AppContextOptions(app))
 		if err != nil {
 			log.Println("[ERROR] Cannot get context for app", app.Id, "err:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteContextError(w, err)
 			return
 		}
 		defer closeFunc()
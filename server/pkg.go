@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	"github.com/gorilla/mux"
@@ -19,16 +20,16 @@ func HandleAppPackagesGet(userId string, app *model.App, context *cluster.Contex
 	// package-lock.json.  From package.json we can get the list of first-level
 	// dependencies, and from package-lock.json we can know the actual version
 	// of those packages.
-	packageJson, err := ContextReadFile(context, "package.json")
+	packageJson, err := ContextReadFile(r.Context(), context, "package.json")
 	if err != nil {
 		log.Println("[ERROR] Cannot read package.json:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
-	packageLockJson, err := ContextReadFile(context, "package-lock.json")
+	packageLockJson, err := ContextReadFile(r.Context(), context, "package-lock.json")
 	if err != nil {
 		log.Println("[ERROR] Cannot read package-lock.json:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -143,8 +144,15 @@ func HandleAppPackagePost(userId string, app *model.App, context *cluster.Contex
 		version = parts[2]
 	}
 
+	taskName := app.GetRuntime().InstallPackageTask
+	if taskName == "" {
+		log.Println("[WARNING] Runtime", app.GetRuntime().Name, "has no packages")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	req := &execproto.ExecReq{
-		TaskName: "npm_install_pkg",
+		TaskName: taskName,
 		KeyValues: []*execproto.ExecReq_KeyValuePair{
 			&execproto.ExecReq_KeyValuePair{
 				Key:   "NAME",
@@ -157,18 +165,20 @@ func HandleAppPackagePost(userId string, app *model.App, context *cluster.Contex
 		},
 		WaitForCompletion: true,
 	}
-	_, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+	_, err := context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
 	// Also sync types
-	err = ContextSyncTypes(context)
+	err = ContextSyncTypes(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot sync types:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -189,8 +199,15 @@ func HandleAppPackageDelete(userId string, app *model.App, context *cluster.Cont
 	vars := mux.Vars(r)
 	name := vars["name"]
 
+	taskName := app.GetRuntime().RemovePackageTask
+	if taskName == "" {
+		log.Println("[WARNING] Runtime", app.GetRuntime().Name, "has no packages")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	req := &execproto.ExecReq{
-		TaskName: "npm_remove_pkg",
+		TaskName: taskName,
 		KeyValues: []*execproto.ExecReq_KeyValuePair{
 			&execproto.ExecReq_KeyValuePair{
 				Key:   "NAME",
@@ -199,18 +216,20 @@ func HandleAppPackageDelete(userId string, app *model.App, context *cluster.Cont
 		},
 		WaitForCompletion: true,
 	}
-	_, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextTaskCallTimeout())
+	_, err := context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		log.Println("[ERROR] Cannot run command:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
 	// Also sync types
-	err = ContextSyncTypes(context)
+	err = ContextSyncTypes(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot sync types:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	processproto "github.com/postverta/pv_exec/proto/process"
+	gcontext "golang.org/x/net/context"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+var processNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9\-]*$`)
+
+// Validate the name of an additional process. The well-known processes are
+// managed by the backend and cannot be touched through this API.
+func checkProcessName(name string) bool {
+	if name == AppProcessName || name == LangServerProcessName {
+		return false
+	}
+
+	return processNameRegexp.MatchString(name)
+}
+
+func HandleAppProcessGet(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if !checkProcessName(name) {
+		log.Println("[WARNING] Bad process name:", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := &processproto.GetProcessStateReq{
+		ProcessName: name,
+	}
+	callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextProcessCallTimeout())
+	resp, err := context.GetProcessServiceClient().GetProcessState(callCtx, req)
+	cancel()
+	if err != nil {
+		log.Println("[ERROR] Cannot get process state:", err)
+		WriteCallError(w, err)
+		return
+	}
+
+	_, listening := context.GetProcessEndpoint(name)
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"name":      name,
+		"state":     resp.ProcessState.String(),
+		"listening": listening,
+	})
+	w.Write(buf)
+}
+
+func HandleAppProcessPost(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if !checkProcessName(name) {
+		log.Println("[WARNING] Bad process name:", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type Input struct {
+		StartCmd  string `json:"start_cmd"`
+		Listening bool   `json:"listening"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+	if err != nil {
+		log.Println("[WARNING] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.StartCmd == "" {
+		log.Println("[WARNING] Must provide a start command")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	port, err := ContextEnableNamedProcess(r.Context(), context, app, name, input.StartCmd, input.Listening)
+	if cluster.IsNoFreePortError(err) {
+		log.Println("[WARNING] No free port for process", name, "of app", app.Id)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("[ERROR] Cannot enable process:", err)
+		WriteCallError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"name": name,
+		"port": port,
+	})
+	w.Write(buf)
+}
+
+func HandleAppProcessDelete(userId string, app *model.App, context *cluster.Context, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if !checkProcessName(name) {
+		log.Println("[WARNING] Bad process name:", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := ContextDisableNamedProcess(r.Context(), context, name)
+	if err != nil {
+		log.Println("[ERROR] Cannot disable process:", err)
+		WriteCallError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
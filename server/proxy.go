@@ -5,6 +5,7 @@ import (
 	"github.com/postverta/pv_backend/model"
 	processproto "github.com/postverta/pv_exec/proto/process"
 	"github.com/yhat/wsutil"
+	gcontext "golang.org/x/net/context"
 	"gopkg.in/segmentio/analytics-go.v3"
 	"log"
 	"net/http"
@@ -50,72 +51,93 @@ func (h *ReverseProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	context, closeFunc, err := cluster.C().GetContext(app.Id, app.WorktreeId, app.WorktreeId)
+	context, closeFunc, err := cluster.C().GetContext(r.Context(), app.Id, app.WorktreeId, app.WorktreeId, AppContextOptions(app))
 	if err != nil {
 		log.Println("[ERROR] Cannot get context for app", app.Id, "err:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteContextError(w, err)
 		return
 	}
 	defer closeFunc()
 
 	// To be sure, we always try to enable the process first
-	err = ContextEnableAppProcess(context, app)
+	err = ContextEnableAppProcess(r.Context(), context, app)
 	if err != nil {
 		log.Println("[ERROR] Cannot enable app:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteCallError(w, err)
 		return
 	}
 
 	// Wait until we have reached the running state, or timeout
-	startTime := time.Now()
-	timeoutDuration := 10 * time.Second
-	for {
-		if context.AppState == processproto.ProcessState_RUNNING {
-			// This is ugly: we pass the app endpoint to
-			// the director through a new header in request.
-			r.Header.Add("POSTVERTA_APP_ENDPOINT", context.GetAppEndpoint())
-
-			// Log the event
-			if h.analyticsClient != nil {
-				properties := analytics.NewProperties().
-					Set("address", r.RemoteAddr).
-					Set("app_id", app.Id).
-					Set("app_name", app.Name).
-					Set("method", r.Method).
-					Set("url", r.URL.String()).
-					Set("delay", time.Since(proxyStartTime))
-
-				h.analyticsClient.Enqueue(analytics.Track{
-					UserId:     "PROXY_USER",
-					Event:      "proxy - hit",
-					Properties: properties,
-				})
-			}
+	state, ok := waitForAppProcess(r.Context(), context, 10*time.Second)
+	if !ok {
+		log.Println("[ERROR] Timeout waiting for the app to become running")
+		// TODO: some special error message?
+		http.NotFound(w, r)
+		return
+	} else if state == processproto.ProcessState_FINISHED {
+		log.Println("[ERROR] Process has stopped")
+		// TODO: some special error message?
+		http.NotFound(w, r)
+		return
+	}
 
-			// call reverse proxies
-			if wsutil.IsWebSocketRequest(r) {
-				r.URL.Scheme = "ws"
-				h.WebSocketReverseProxy.ServeHTTP(w, r)
-			} else {
-				r.URL.Scheme = "http"
-				h.ReverseProxy.ServeHTTP(w, r)
-			}
-			return
-		} else if context.AppState == processproto.ProcessState_FINISHED {
-			log.Println("[ERROR] Process has stopped")
-			// TODO: some special error message?
-			http.NotFound(w, r)
-			return
-		}
+	appEndpoint, found := context.GetProcessEndpoint(AppProcessName)
+	if !found {
+		log.Println("[ERROR] App process has no endpoint")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		if time.Now().Sub(startTime) > timeoutDuration {
-			log.Println("[ERROR] Timeout waiting for the app to become running")
-			// TODO: some special error message?
-			http.NotFound(w, r)
-			return
-		}
+	// This is ugly: we pass the app endpoint to
+	// the director through a new header in request.
+	r.Header.Add("POSTVERTA_APP_ENDPOINT", appEndpoint)
+
+	// Log the event
+	if h.analyticsClient != nil {
+		properties := analytics.NewProperties().
+			Set("address", r.RemoteAddr).
+			Set("app_id", app.Id).
+			Set("app_name", app.Name).
+			Set("method", r.Method).
+			Set("url", r.URL.String()).
+			Set("delay", time.Since(proxyStartTime))
+
+		h.analyticsClient.Enqueue(analytics.Track{
+			UserId:     "PROXY_USER",
+			Event:      "proxy - hit",
+			Properties: properties,
+		})
+	}
 
-		<-time.After(10 * time.Millisecond)
+	// call reverse proxies
+	if wsutil.IsWebSocketRequest(r) {
+		r.URL.Scheme = "ws"
+		h.WebSocketReverseProxy.ServeHTTP(w, r)
+	} else {
+		r.URL.Scheme = "http"
+		h.ReverseProxy.ServeHTTP(w, r)
+	}
+}
+
+// Wait until the app process has reached either the running or the finished
+// state. Return false on timeout.
+func waitForAppProcess(ctx gcontext.Context, context *cluster.Context, timeout time.Duration) (processproto.ProcessState, bool) {
+	stateChan, chanId := context.GetAppStateChan()
+	defer context.RemoveAppStateChan(chanId)
+
+	timeoutChan := time.After(timeout)
+	for {
+		select {
+		case event := <-stateChan:
+			if event.State == processproto.ProcessState_RUNNING ||
+				event.State == processproto.ProcessState_FINISHED {
+				return event.State, true
+			}
+		case <-timeoutChan:
+			return processproto.ProcessState_NOT_RUNNING, false
+		case <-ctx.Done():
+			return processproto.ProcessState_NOT_RUNNING, false
+		}
 	}
 }
 
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/model"
 	"net/http"
 )
 
@@ -75,35 +76,77 @@ var routes = Routes{
 		"AppGet",
 		"GET",
 		"/app/{id}",
-		CheckAuth(CheckApp(HandleAppGet, true, false), true),
+		CheckAuth(CheckApp(HandleAppGet, model.RoleViewer), true),
 	},
 
 	Route{
 		"AppNamePost",
 		"POST",
 		"/app/{id}/name",
-		CheckAuth(CheckApp(HandleAppNamePost, false, false), true),
+		CheckAuth(CheckApp(HandleAppNamePost, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppDescriptionPost",
 		"POST",
 		"/app/{id}/description",
-		CheckAuth(CheckApp(HandleAppDescriptionPost, false, false), true),
+		CheckAuth(CheckApp(HandleAppDescriptionPost, model.RoleEditor), true),
+	},
+
+	Route{
+		"AppTagsPost",
+		"POST",
+		"/app/{id}/tags",
+		CheckAuth(CheckApp(HandleAppTagsPost, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppIconPost",
 		"POST",
 		"/app/{id}/icon",
-		CheckAuth(CheckApp(HandleAppIconPost, false, false), true),
+		CheckAuth(CheckApp(HandleAppIconPost, model.RoleEditor), true),
+	},
+
+	Route{
+		"AppIdlePolicyGet",
+		"GET",
+		"/app/{id}/idle_policy",
+		CheckAuth(CheckApp(HandleAppIdlePolicyGet, model.RoleEditor), true),
+	},
+
+	Route{
+		"AppIdlePolicyPost",
+		"POST",
+		"/app/{id}/idle_policy",
+		CheckAuth(CheckApp(HandleAppIdlePolicyPost, model.RoleOwner), true),
+	},
+
+	Route{
+		"AppLimitsGet",
+		"GET",
+		"/app/{id}/limits",
+		CheckAuth(CheckApp(HandleAppLimitsGet, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppDelete",
 		"DELETE",
 		"/app/{id}",
-		CheckAuth(CheckApp(HandleAppDelete, false, false), true),
+		CheckAuth(CheckApp(HandleAppDelete, model.RoleOwner), true),
+	},
+
+	Route{
+		"TrashAppsGet",
+		"GET",
+		"/apps/trash",
+		CheckAuth(HandleTrashAppsGet, false),
+	},
+
+	Route{
+		"TrashAppRestorePost",
+		"POST",
+		"/apps/trash/{id}/restore",
+		CheckAuth(HandleTrashAppRestorePost, false),
 	},
 
 	Route{
@@ -117,154 +160,231 @@ var routes = Routes{
 		"AppAdoptPost",
 		"POST",
 		"/app/{id}/adopt",
-		CheckAuth(CheckApp(HandleAppAdoptPost, false, false), false),
+		CheckAuth(CheckApp(HandleAppAdoptPost, model.RoleOwner), false),
+	},
+
+	Route{
+		"AppTransferPost",
+		"POST",
+		"/app/{id}/transfer",
+		CheckAuth(CheckApp(HandleAppTransferPost, model.RoleOwner), false),
 	},
 
 	Route{
 		"AppAlivePost",
 		"POST",
 		"/app/{id}/alive",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppAlivePost), true, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppAlivePost), model.RoleViewer), true),
 	},
 
 	Route{
 		"AppAccessGet",
 		"GET",
 		"/app/{id}/access",
-		CheckAuth(CheckApp(HandleAppAccessGet, true, false), true),
+		CheckAuth(CheckApp(HandleAppAccessGet, model.RoleViewer), true),
 	},
 
 	Route{
 		"AppForkPost",
 		"POST",
 		"/app/{id}/fork",
-		CheckAuth(CheckApp(HandleAppForkPost, true, false), true),
+		CheckAuth(CheckApp(HandleAppForkPost, model.RoleViewer), true),
 	},
 
 	Route{
 		"AppFilesGet",
 		"GET",
 		"/app/{id}/files",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFilesGet), true, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFilesGet), model.RoleViewer), true),
 	},
 
 	Route{
 		"AppFileGet",
 		"GET",
 		"/app/{id}/file/{path}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFileGet), true, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFileGet), model.RoleViewer), true),
 	},
 
 	Route{
 		"AppFilePost",
 		"POST",
 		"/app/{id}/file/{path}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFilePost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFilePost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppFileMovePost",
 		"POST",
 		"/app/{id}/file/{path}/move",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFileMovePost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFileMovePost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppFileCopyPost",
 		"POST",
 		"/app/{id}/file/{path}/copy",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFileCopyPost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFileCopyPost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppFileDelete",
 		"DELETE",
 		"/app/{id}/file/{path}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppFileDelete), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppFileDelete), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppExportGet",
 		"GET",
 		"/app/{id}/export",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppExportGet), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppExportGet), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppUpdatePost",
 		"POST",
 		"/app/{id}/update",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppUpdatePost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppUpdatePost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppEnablePost",
 		"POST",
 		"/app/{id}/enable",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppEnablePost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppEnablePost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppPackagesGet",
 		"GET",
 		"/app/{id}/packages",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppPackagesGet), true, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppPackagesGet), model.RoleViewer), true),
 	},
 
 	Route{
 		"AppPackagePost",
 		"POST",
 		"/app/{id}/package/{name:.*}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppPackagePost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppPackagePost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppPackageDelete",
 		"DELETE",
 		"/app/{id}/package/{name:.*}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppPackageDelete), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppPackageDelete), model.RoleEditor), true),
+	},
+
+	Route{
+		"AppCollaboratorsGet",
+		"GET",
+		"/app/{id}/collaborators",
+		CheckAuth(CheckAppMember(HandleAppCollaboratorsGet, model.RoleEditor), false),
+	},
+
+	Route{
+		"AppCollaboratorsPost",
+		"POST",
+		"/app/{id}/collaborators",
+		CheckAuth(CheckApp(HandleAppCollaboratorsPost, model.RoleOwner), false),
+	},
+
+	Route{
+		"AppCollaboratorPost",
+		"POST",
+		"/app/{id}/collaborator/{user_id}",
+		CheckAuth(CheckApp(HandleAppCollaboratorPost, model.RoleOwner), false),
+	},
+
+	Route{
+		"AppCollaboratorDelete",
+		"DELETE",
+		"/app/{id}/collaborator/{user_id}",
+		CheckAuth(CheckAppMember(HandleAppCollaboratorDelete, model.RoleViewer), false),
+	},
+
+	Route{
+		"AppSnapshotsGet",
+		"GET",
+		"/app/{id}/snapshots",
+		CheckAuth(CheckApp(HandleAppSnapshotsGet, model.RoleEditor), true),
+	},
+
+	Route{
+		"AppSnapshotsPost",
+		"POST",
+		"/app/{id}/snapshots",
+		CheckAuth(CheckApp(HandleAppSnapshotsPost, model.RoleEditor), true),
+	},
+
+	Route{
+		"AppSnapshotRestorePost",
+		"POST",
+		"/app/{id}/snapshot/{snapshot_id}/restore",
+		CheckAuth(CheckApp(HandleAppSnapshotRestorePost, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppApisGet",
 		"GET",
 		"/app/{id}/apis",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppApisGet), true, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppApisGet), model.RoleViewer), true),
 	},
 
 	Route{
 		"AppApiPost",
 		"POST",
 		"/app/{id}/api/{api_id}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppApiPost), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppApiPost), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppApiDelete",
 		"DELETE",
 		"/app/{id}/api/{api_id}",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppApiDelete), false, false), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppApiDelete), model.RoleEditor), true),
+	},
+
+	Route{
+		"AppProcessGet",
+		"GET",
+		"/app/{id}/process/{name}",
+		CheckAuth(CheckApp(CheckAppContext(HandleAppProcessGet), model.RoleViewer), true),
+	},
+
+	Route{
+		"AppProcessPost",
+		"POST",
+		"/app/{id}/process/{name}",
+		CheckAuth(CheckApp(CheckAppContext(HandleAppProcessPost), model.RoleEditor), true),
+	},
+
+	Route{
+		"AppProcessDelete",
+		"DELETE",
+		"/app/{id}/process/{name}",
+		CheckAuth(CheckApp(CheckAppContext(HandleAppProcessDelete), model.RoleEditor), true),
 	},
 
 	Route{
 		"AppEnvVarsGet",
 		"GET",
 		"/app/{id}/env_vars",
-		CheckAuth(CheckApp(HandleAppEnvVarsGet, false, false), true),
+		CheckAuth(CheckApp(HandleAppEnvVarsGet, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppEnvVarPost",
 		"POST",
 		"/app/{id}/env_var/{name}",
-		CheckAuth(CheckApp(HandleAppEnvVarPost, false, false), true),
+		CheckAuth(CheckApp(HandleAppEnvVarPost, model.RoleEditor), true),
 	},
 
 	Route{
 		"AppEnvVarDelete",
 		"DELETE",
 		"/app/{id}/env_var/{name}",
-		CheckAuth(CheckApp(HandleAppEnvVarDelete, false, false), true),
+		CheckAuth(CheckApp(HandleAppEnvVarDelete, model.RoleEditor), true),
 	},
 
 	Route{
@@ -274,6 +394,27 @@ var routes = Routes{
 		HandleGalleryAppsGet,
 	},
 
+	Route{
+		"GalleryCollectionsGet",
+		"GET",
+		"/gallery/collections",
+		HandleGalleryCollectionsGet,
+	},
+
+	Route{
+		"GalleryCollectionGet",
+		"GET",
+		"/gallery/collection/{id}",
+		HandleGalleryCollectionGet,
+	},
+
+	Route{
+		"RuntimesGet",
+		"GET",
+		"/runtimes",
+		HandleRuntimesGet,
+	},
+
 	Route{
 		"UserGet",
 		"GET",
@@ -299,13 +440,167 @@ var routes = Routes{
 		"AppStateWebSocket",
 		"GET",
 		"/app/{id}/state/ws",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppStateWebSocket), false, true), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppStateWebSocket), AnyRole), true),
 	},
 
 	Route{
 		"AppLangServerWebSocket",
 		"GET",
 		"/app/{id}/langserver/ws",
-		CheckAuth(CheckApp(CheckAppContext(HandleAppLangServerWebSocket), false, true), true),
+		CheckAuth(CheckApp(CheckAppContext(HandleAppLangServerWebSocket), AnyRole), true),
+	},
+
+	Route{
+		"TeamsGet",
+		"GET",
+		"/teams",
+		CheckAuth(HandleTeamsGet, false),
+	},
+
+	Route{
+		"TeamsPost",
+		"POST",
+		"/teams",
+		CheckAuth(HandleTeamsPost, false),
+	},
+
+	Route{
+		"TeamGet",
+		"GET",
+		"/team/{id}",
+		CheckAuth(CheckTeam(HandleTeamGet, model.RoleViewer), false),
+	},
+
+	Route{
+		"TeamAppsGet",
+		"GET",
+		"/team/{id}/apps",
+		CheckAuth(CheckTeam(HandleTeamAppsGet, model.RoleViewer), false),
+	},
+
+	Route{
+		"TeamMembersPost",
+		"POST",
+		"/team/{id}/members",
+		CheckAuth(CheckTeam(HandleTeamMembersPost, model.RoleOwner), false),
+	},
+
+	Route{
+		"TeamMemberPost",
+		"POST",
+		"/team/{id}/member/{user_id}",
+		CheckAuth(CheckTeam(HandleTeamMemberPost, model.RoleOwner), false),
+	},
+
+	Route{
+		"TeamMemberDelete",
+		"DELETE",
+		"/team/{id}/member/{user_id}",
+		CheckAuth(CheckTeam(HandleTeamMemberDelete, model.RoleViewer), false),
+	},
+
+	Route{
+		"AdminClusterAgentsGet",
+		"GET",
+		"/admin/cluster/agents",
+		CheckAuth(CheckAdmin(HandleAdminClusterAgentsGet), false),
+	},
+
+	Route{
+		"AdminClusterContextsGet",
+		"GET",
+		"/admin/cluster/contexts",
+		CheckAuth(CheckAdmin(HandleAdminClusterContextsGet), false),
+	},
+
+	Route{
+		"AdminClusterContextDelete",
+		"DELETE",
+		"/admin/cluster/context/{id}",
+		CheckAuth(CheckAdmin(HandleAdminClusterContextDelete), false),
+	},
+
+	Route{
+		"AdminClusterQuarantineGet",
+		"GET",
+		"/admin/cluster/quarantine",
+		CheckAuth(CheckAdmin(HandleAdminClusterQuarantineGet), false),
+	},
+
+	Route{
+		"AdminClusterQuarantineRetryPost",
+		"POST",
+		"/admin/cluster/quarantine/{id}/retry",
+		CheckAuth(CheckAdmin(HandleAdminClusterQuarantineRetryPost), false),
+	},
+
+	Route{
+		"AdminClusterQuarantineDelete",
+		"DELETE",
+		"/admin/cluster/quarantine/{id}",
+		CheckAuth(CheckAdmin(HandleAdminClusterQuarantineDelete), false),
+	},
+
+	Route{
+		"AdminApisGet",
+		"GET",
+		"/admin/apis",
+		CheckAuth(CheckAdmin(HandleAdminApisGet), false),
+	},
+
+	Route{
+		"AdminApisPost",
+		"POST",
+		"/admin/apis",
+		CheckAuth(CheckAdmin(HandleAdminApisPost), false),
+	},
+
+	Route{
+		"AdminApiPost",
+		"POST",
+		"/admin/api/{id}",
+		CheckAuth(CheckAdmin(HandleAdminApiPost), false),
+	},
+
+	Route{
+		"AdminApiDeprecatePost",
+		"POST",
+		"/admin/api/{id}/deprecate",
+		CheckAuth(CheckAdmin(HandleAdminApiDeprecatePost), false),
+	},
+
+	Route{
+		"AdminApiDelete",
+		"DELETE",
+		"/admin/api/{id}",
+		CheckAuth(CheckAdmin(HandleAdminApiDelete), false),
+	},
+
+	Route{
+		"AdminGalleryCollectionsPost",
+		"POST",
+		"/admin/gallery/collections",
+		CheckAuth(CheckAdmin(HandleAdminGalleryCollectionsPost), false),
+	},
+
+	Route{
+		"AdminGalleryCollectionPost",
+		"POST",
+		"/admin/gallery/collection/{id}",
+		CheckAuth(CheckAdmin(HandleAdminGalleryCollectionPost), false),
+	},
+
+	Route{
+		"AdminGalleryCollectionDelete",
+		"DELETE",
+		"/admin/gallery/collection/{id}",
+		CheckAuth(CheckAdmin(HandleAdminGalleryCollectionDelete), false),
+	},
+
+	Route{
+		"AdminAppLimitsPost",
+		"POST",
+		"/admin/app/{id}/limits",
+		CheckAuth(CheckAdmin(CheckApp(HandleAdminAppLimitsPost, AnyRole)), false),
 	},
 }
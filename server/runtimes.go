@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/postverta/pv_backend/runtimes"
+	"net/http"
+)
+
+// List the runtimes that can be chosen when creating an app
+func HandleRuntimesGet(w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	results := make([]map[string]interface{}, 0)
+	for _, name := range runtimes.Names() {
+		rt := runtimes.Get(name)
+		results = append(results, map[string]interface{}{
+			"name":            rt.Name,
+			"default":         rt == runtimes.Default(),
+			"start_cmd":       rt.DefaultStartCmd,
+			"manifest_file":   rt.ManifestFile,
+			"lang_server":     len(rt.LangServerCmd) > 0,
+			"package_manager": rt.InstallPackageTask != "",
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(results)
+	w.Write(buf)
+}
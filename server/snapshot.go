@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	worktreeproto "github.com/postverta/pv_exec/proto/worktree"
+	"github.com/satori/go.uuid"
+	gcontext "golang.org/x/net/context"
+	"log"
+	"net/http"
+)
+
+func HandleAppSnapshotsGet(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	snapshots, err := model.C().GetSnapshotsByAppId(app.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot get snapshots in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output := make([]map[string]interface{}, 0)
+	for _, snapshot := range snapshots {
+		output = append(output, snapshot.ToJsonMap())
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func HandleAppSnapshotsPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		Name string `json:"name"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Name) == 0 || len(input.Name) > 100 {
+		log.Println("[WARNING] Bad snapshot name:", input.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Make sure the worktree image is up-to-date, like fork does
+	context, closeFunc := cluster.C().GetExistingContext(app.Id)
+	if context != nil {
+		wtClient := context.GetWorktreeServiceClient()
+		callCtx, cancel := gcontext.WithTimeout(r.Context(), config.ContextSaveCallTimeout())
+		_, err := wtClient.Save(callCtx, &worktreeproto.SaveReq{})
+		cancel()
+		closeFunc()
+		if err != nil {
+			log.Println("[ERROR] Cannot save worktree for app", app.Id, "err:", err)
+			WriteCallError(w, err)
+			return
+		}
+	}
+
+	worktreeId := uuid.NewV4().String()
+	err = cluster.C().CopyWorktree(r.Context(), app.Id, app.WorktreeId, worktreeId, app.GetRuntime())
+	if err != nil {
+		log.Println("[ERROR] Cannot copy worktree for app", app.Id, "err:", err)
+		WriteContextError(w, err)
+		return
+	}
+
+	snapshot, err := model.C().NewSnapshot(&model.Snapshot{
+		AppId:      app.Id,
+		Name:       input.Name,
+		WorktreeId: worktreeId,
+		UserId:     userId,
+	})
+	if err != nil {
+		log.Println("[ERROR] Cannot create snapshot in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(snapshot.ToJsonMap())
+	w.Write(buf)
+}
+
+// Restore the app to a snapshot. The app gets a new worktree copied from the
+// snapshot, and its current worktree becomes a snapshot of its own, so that
+// the restore can be undone by restoring that one.
+func HandleAppSnapshotRestorePost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	vars := mux.Vars(r)
+	snapshot, err := model.C().GetSnapshot(vars["snapshot_id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get snapshot in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if snapshot == nil || snapshot.AppId != app.Id {
+		log.Println("[WARNING] Cannot find snapshot")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Save and close the context of the app, so that nothing writes to its
+	// current worktree anymore
+	err = cluster.C().ForceCloseContext(app.Id, true)
+	if err != nil && !cluster.IsNoContextError(err) {
+		log.Println("[ERROR] Cannot close context of app", app.Id, "err:", err)
+		WriteCallError(w, err)
+		return
+	}
+
+	worktreeId := uuid.NewV4().String()
+	err = cluster.C().CopyWorktree(r.Context(), app.Id, snapshot.WorktreeId, worktreeId, app.GetRuntime())
+	if err != nil {
+		log.Println("[ERROR] Cannot copy worktree for app", app.Id, "err:", err)
+		WriteContextError(w, err)
+		return
+	}
+
+	undoSnapshot, err := model.C().NewSnapshot(&model.Snapshot{
+		AppId:      app.Id,
+		Name:       "Before restoring " + snapshot.Name,
+		WorktreeId: app.WorktreeId,
+		UserId:     userId,
+	})
+	if err != nil {
+		log.Println("[ERROR] Cannot create snapshot in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	app.WorktreeId = worktreeId
+	err = model.C().UpdateApp(app, []string{"WorktreeId"})
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+		// The app still uses its old worktree
+		if deleteErr := model.C().DeleteSnapshot(undoSnapshot.Id); deleteErr != nil {
+			log.Println("[ERROR] Cannot delete snapshot in database:", deleteErr)
+		}
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	// A request may have reopened the context with the old worktree in the
+	// meantime. Its changes go to the new snapshot.
+	err = cluster.C().ForceCloseContext(app.Id, true)
+	if err != nil && !cluster.IsNoContextError(err) {
+		log.Println("[ERROR] Cannot close context of app", app.Id, "err:", err)
+	}
+
+	// Let the editors know that the source has changed
+	err = model.C().UpdateAppSourceTimestamp(app)
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"app":      app.ToJsonMap(),
+		"snapshot": undoSnapshot.ToJsonMap(),
+	})
+	w.Write(buf)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+)
+
+func teamToJsonMap(userId string, team *model.Team) map[string]interface{} {
+	m := team.ToJsonMap()
+	m["role"] = team.GetRole(userId)
+	return m
+}
+
+func HandleTeamsGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	teams, err := model.C().GetTeamsByUserId(userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get teams in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	model.SortTeamsByCreatedTime(teams)
+
+	output := make([]map[string]interface{}, 0)
+	for _, team := range teams {
+		output = append(output, teamToJsonMap(userId, team))
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Create a team, with the user as its first owner
+func HandleTeamsPost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		Name string `json:"name"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Name) == 0 || len(input.Name) > 100 {
+		log.Println("[WARNING] Bad team name:", input.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	team, err := model.C().NewTeam(&model.Team{
+		Name: input.Name,
+		Members: []model.TeamMember{
+			{
+				UserId: userId,
+				Role:   model.RoleOwner,
+			},
+		},
+	})
+	if err != nil {
+		log.Println("[ERROR] Cannot create team in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(teamToJsonMap(userId, team))
+	w.Write(buf)
+}
+
+func HandleTeamGet(userId string, team *model.Team, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(teamToJsonMap(userId, team))
+	w.Write(buf)
+}
+
+func HandleTeamAppsGet(userId string, team *model.Team, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	apps, err := model.C().GetAppsByTeamId(team.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot get apps in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	model.SortAppsByAccessedTime(apps)
+
+	output := make([]map[string]interface{}, 0)
+	for _, app := range apps {
+		appMap := app.ToJsonMap()
+		appMap["role"] = app.GetRole(userId, team)
+		output = append(output, appMap)
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Add a user to the team with a role
+func HandleTeamMembersPost(userId string, team *model.Team, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	input := model.TeamMember{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.UserId == "" || !model.IsValidRole(input.Role) {
+		log.Println("[WARNING] Bad team member:", input.UserId, input.Role)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if team.GetRole(input.UserId) != "" {
+		// Use HandleTeamMemberPost to change the role
+		log.Println("[WARNING] User", input.UserId, "is already a member of the team")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = model.C().SetTeamMember(team, input.UserId, input.Role)
+	if err != nil {
+		log.Println("[ERROR] Cannot save team to database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(teamToJsonMap(userId, team))
+	w.Write(buf)
+}
+
+// Change the role of a member. The last owner cannot step down, so that
+// someone is left to manage the team.
+func HandleTeamMemberPost(userId string, team *model.Team, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	memberId := vars["user_id"]
+
+	type Input struct {
+		Role string `json:"role"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !model.IsValidRole(input.Role) {
+		log.Println("[WARNING] Bad role:", input.Role)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	role := team.GetRole(memberId)
+	if role == "" {
+		log.Println("[WARNING] User", memberId, "is not a member of the team")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if role == model.RoleOwner && input.Role != model.RoleOwner && team.NumOwners() == 1 {
+		log.Println("[WARNING] Cannot change the role of the last owner of team", team.Id)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = model.C().SetTeamMember(team, memberId, input.Role)
+	if err != nil {
+		log.Println("[ERROR] Cannot save team to database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(teamToJsonMap(userId, team))
+	w.Write(buf)
+}
+
+// Remove a member. Owners can remove anyone but the last owner, and the
+// others only themselves.
+func HandleTeamMemberDelete(userId string, team *model.Team, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+	vars := mux.Vars(r)
+	memberId := vars["user_id"]
+
+	if memberId != userId && team.GetRole(userId) != model.RoleOwner {
+		log.Println("[WARNING] User", userId, "cannot remove other members")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	role := team.GetRole(memberId)
+	if role == "" {
+		// Nothing to delete
+		w.WriteHeader(http.StatusOK)
+		buf, _ := json.Marshal(teamToJsonMap(userId, team))
+		w.Write(buf)
+		return
+	}
+
+	if role == model.RoleOwner && team.NumOwners() == 1 {
+		log.Println("[WARNING] Cannot remove the last owner of team", team.Id)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err := model.C().RemoveTeamMember(team, memberId)
+	if err != nil {
+		log.Println("[ERROR] Cannot save team to database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(teamToJsonMap(userId, team))
+	w.Write(buf)
+}
+
+// Transfer the app to a user or a team, given by either user_id or team_id.
+// Only the owners of the app can give it away, and only to a team they can
+// edit the apps of, so that they don't lose the access to it by mistake.
+func HandleAppTransferPost(userId string, app *model.App, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	type Input struct {
+		UserId string `json:"user_id"`
+		TeamId string `json:"team_id"`
+	}
+	input := Input{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&input)
+
+	if err != nil {
+		log.Println("[ERROR] Cannot unmarshal input:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if (input.UserId == "") == (input.TeamId == "") {
+		log.Println("[WARNING] Exactly one of user_id and team_id must be set")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if input.TeamId != "" {
+		team, err := model.C().GetTeam(input.TeamId)
+		if err != nil {
+			log.Println("[ERROR] Cannot get team in database:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if team == nil {
+			log.Println("[WARNING] Cannot find team")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !model.RoleIncludes(team.GetRole(userId), model.RoleEditor) {
+			log.Println("[WARNING] User", userId, "cannot add apps to team", team.Id)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	// The new owner doesn't need to be a collaborator anymore
+	collaborators := []model.Collaborator{}
+	for _, collaborator := range app.Collaborators {
+		if collaborator.UserId != input.UserId {
+			collaborators = append(collaborators, collaborator)
+		}
+	}
+
+	app.UserId = input.UserId
+	app.TeamId = input.TeamId
+	app.Collaborators = collaborators
+	err = model.C().UpdateApp(app, []string{"UserId", "TeamId", "Collaborators"})
+	if err != nil {
+		log.Println("[ERROR] Cannot update app in database:", err)
+		WriteUpdateAppError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(app.ToJsonMap())
+	w.Write(buf)
+}
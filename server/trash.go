@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/postverta/pv_backend/config"
+	"github.com/postverta/pv_backend/model"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The JSON of an app in the trash, with when it is going to be purged
+func trashAppToJsonMap(app *model.App) map[string]interface{} {
+	m := app.ToJsonMap()
+	m["deleted_time"] = app.DeletedTime
+	m["purge_time"] = app.DeletedTime.Add(config.AppTrashRetention())
+	return m
+}
+
+// List the apps in the trash the user can restore: the ones the user owns,
+// and the ones of the teams the user is an owner of
+func HandleTrashAppsGet(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	apps, err := model.C().GetDeletedAppsByUserId(userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get deleted apps in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	teams, err := model.C().GetTeamsByUserId(userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get teams in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, app := range apps {
+		found[app.Id] = true
+	}
+	for _, team := range teams {
+		if team.GetRole(userId) != model.RoleOwner {
+			continue
+		}
+
+		teamApps, err := model.C().GetDeletedAppsByTeamId(team.Id)
+		if err != nil {
+			log.Println("[ERROR] Cannot get deleted apps in database:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, app := range teamApps {
+			if !found[app.Id] {
+				found[app.Id] = true
+				apps = append(apps, app)
+			}
+		}
+	}
+	model.SortAppsByDeletedTime(apps)
+
+	output := make([]map[string]interface{}, 0)
+	for _, app := range apps {
+		output = append(output, trashAppToJsonMap(app))
+	}
+
+	buf, _ := json.Marshal(output)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Take an app the user owns, alone or as an owner of its team, out of the
+// trash. CheckApp doesn't see the apps in the trash, so the ownership is
+// checked here.
+func HandleTrashAppRestorePost(userId string, w http.ResponseWriter, r *http.Request) {
+	SetCommonHeaders(w, true)
+
+	vars := mux.Vars(r)
+	app, err := model.C().GetDeletedApp(vars["id"])
+	if err != nil {
+		log.Println("[ERROR] Cannot get deleted app in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if app == nil {
+		log.Println("[WARNING] Cannot find app in trash")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	role, err := GetAppRole(app, userId)
+	if err != nil {
+		log.Println("[ERROR] Cannot get team in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Nobody owns the anonymous apps in the trash
+	if app.IsAnonymous() || role != model.RoleOwner {
+		log.Println("[WARNING] User doesn't own the app")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	app, err = model.C().RestoreApp(app.Id)
+	if err != nil {
+		log.Println("[ERROR] Cannot restore app in database:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf, _ := json.Marshal(app.ToJsonMap())
+	w.Write(buf)
+}
+
+// Purge the apps that have been in the trash for longer than the retention
+// period. Only then do the worktree images of an app and its snapshots become
+// dangling, and the async sweeping task deletes them.
+func PurgeTrash() {
+	cutoff := time.Now().Add(-config.AppTrashRetention())
+	apps, err := model.C().GetAppsDeletedBefore(cutoff)
+	if err != nil {
+		log.Println("[ERROR] Cannot get deleted apps in database:", err)
+		return
+	}
+
+	for _, app := range apps {
+		// May fail if the app has been restored in the meantime, or
+		// restored and deleted again
+		err = model.C().PurgeApp(app.Id, cutoff)
+		if err != nil {
+			log.Println("[WARNING] Cannot purge app", app.Id, "err:", err)
+			continue
+		}
+		log.Println("[INFO] Purged app", app.Id, "with worktree", app.WorktreeId)
+	}
+}
+
+// Purge the trash periodically. Never returns.
+func PurgeTrashPeriodically() {
+	for {
+		PurgeTrash()
+		time.Sleep(config.AppTrashPurgeInterval())
+	}
+}
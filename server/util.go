@@ -2,7 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/postverta/pv_backend/cluster"
+	"github.com/postverta/pv_backend/config"
 	"github.com/postverta/pv_backend/model"
 	execproto "github.com/postverta/pv_exec/proto/exec"
 	processproto "github.com/postverta/pv_exec/proto/process"
@@ -10,6 +12,14 @@ import (
 	"strings"
 )
 
+// Processes with a well-known name, and the port slots they prefer
+const (
+	AppProcessName        = "app"
+	AppProcessPort        = 8080
+	LangServerProcessName = "lang-server"
+	LangServerProcessPort = 2089
+)
+
 func NeedUpdateSourceTimestamp(filePath string) bool {
 	if strings.HasSuffix(filePath, ".md") {
 		// md files don't count as source
@@ -56,7 +66,7 @@ func GetPackageJsonStartCmd(packageJson string) (string, error) {
 	return start, nil
 }
 
-func ContextReadFile(context *cluster.Context, filePath string) (content []byte, err error) {
+func ContextReadFile(ctx gcontext.Context, context *cluster.Context, filePath string) (content []byte, err error) {
 	req := &execproto.ExecReq{
 		TaskName: "file_read",
 		KeyValues: []*execproto.ExecReq_KeyValuePair{
@@ -67,7 +77,9 @@ func ContextReadFile(context *cluster.Context, filePath string) (content []byte,
 		},
 		WaitForCompletion: true,
 	}
-	resp, err := context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextFileCallTimeout())
+	resp, err := context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
@@ -75,13 +87,18 @@ func ContextReadFile(context *cluster.Context, filePath string) (content []byte,
 	return resp.Data, nil
 }
 
-func ContextEnableAppProcess(context *cluster.Context, app *model.App) error {
+func ContextEnableAppProcess(ctx gcontext.Context, context *cluster.Context, app *model.App) error {
+	port, err := context.AllocateProcessPort(AppProcessName, AppProcessPort)
+	if err != nil {
+		return err
+	}
+
 	req := &processproto.ConfigureProcessReq{
-		ProcessName:   "app",
+		ProcessName:   AppProcessName,
 		Enabled:       true,
 		StartCmd:      []string{"/scripts/log_run", app.StartCmd},
 		RunPath:       "/app",
-		ListeningPort: 8080,
+		ListeningPort: port,
 		EnvVars:       make([]*processproto.KeyValuePair, 0),
 	}
 
@@ -99,13 +116,20 @@ func ContextEnableAppProcess(context *cluster.Context, app *model.App) error {
 		})
 	}
 
-	_, err := context.GetProcessServiceClient().ConfigureProcess(gcontext.Background(), req)
-	return err
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextProcessCallTimeout())
+	_, err = context.GetProcessServiceClient().ConfigureProcess(callCtx, req)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	context.PokeAppState()
+	return nil
 }
 
-func ContextRestartAppProcess(context *cluster.Context, app *model.App) error {
+func ContextRestartAppProcess(ctx gcontext.Context, context *cluster.Context, app *model.App) error {
 	req := &processproto.RestartProcessReq{
-		ProcessName: "app",
+		ProcessName: AppProcessName,
 		StartCmd:    []string{"/scripts/log_run", app.StartCmd},
 		EnvVars:     make([]*processproto.KeyValuePair, 0),
 	}
@@ -124,17 +148,103 @@ func ContextRestartAppProcess(context *cluster.Context, app *model.App) error {
 		})
 	}
 
-	_, err := context.GetProcessServiceClient().RestartProcess(gcontext.Background(), req)
-	return err
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextProcessCallTimeout())
+	_, err := context.GetProcessServiceClient().RestartProcess(callCtx, req)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	context.PokeAppState()
+	return nil
 }
 
-func ContextSyncTypes(context *cluster.Context) (err error) {
+// Enable an additional named process of the app, e.g., a worker or a
+// debugger. If the process listens, it gets a port slot, which is passed to
+// it in the PORT env var.
+func ContextEnableNamedProcess(ctx gcontext.Context, context *cluster.Context, app *model.App, processName string, startCmd string, listening bool) (port uint32, err error) {
+	if listening {
+		port, err = context.AllocateProcessPort(processName, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req := &processproto.ConfigureProcessReq{
+		ProcessName:   processName,
+		Enabled:       true,
+		StartCmd:      []string{"/scripts/log_run", startCmd},
+		RunPath:       "/app",
+		ListeningPort: port,
+		EnvVars:       make([]*processproto.KeyValuePair, 0),
+	}
+
+	for _, ev := range app.EnvVars {
+		req.EnvVars = append(req.EnvVars, &processproto.KeyValuePair{
+			Key:   ev.Key,
+			Value: ev.Value,
+		})
+	}
+
+	for k, v := range app.GetSystemEnvVarMap() {
+		req.EnvVars = append(req.EnvVars, &processproto.KeyValuePair{
+			Key:   k,
+			Value: v,
+		})
+	}
+
+	if listening {
+		req.EnvVars = append(req.EnvVars, &processproto.KeyValuePair{
+			Key:   "PORT",
+			Value: fmt.Sprintf("%d", port),
+		})
+	}
+
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextProcessCallTimeout())
+	_, err = context.GetProcessServiceClient().ConfigureProcess(callCtx, req)
+	cancel()
+	if err != nil {
+		context.ReleaseProcessPort(processName)
+		return 0, err
+	}
+
+	return port, nil
+}
+
+// Disable a named process, and give its port slot back.
+func ContextDisableNamedProcess(ctx gcontext.Context, context *cluster.Context, processName string) error {
+	req := &processproto.ConfigureProcessReq{
+		ProcessName: processName,
+		Enabled:     false,
+	}
+
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextProcessCallTimeout())
+	_, err := context.GetProcessServiceClient().ConfigureProcess(callCtx, req)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	context.ReleaseProcessPort(processName)
+	return nil
+}
+
+// Sync the type definitions of the installed packages, if the runtime of the
+// app has any
+func ContextSyncTypes(ctx gcontext.Context, context *cluster.Context, app *model.App) (err error) {
+	taskName := app.GetRuntime().SyncTypesTask
+	if taskName == "" {
+		return nil
+	}
+
 	req := &execproto.ExecReq{
-		TaskName:          "sync_types",
+		TaskName:          taskName,
 		KeyValues:         []*execproto.ExecReq_KeyValuePair{},
 		WaitForCompletion: true,
 	}
-	_, err = context.GetExecServiceClient().Exec(gcontext.Background(), req)
+	callCtx, cancel := gcontext.WithTimeout(ctx, config.ContextTaskCallTimeout())
+	_, err = context.GetExecServiceClient().Exec(callCtx, req)
+	cancel()
 	if err != nil {
 		return err
 	}